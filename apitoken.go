@@ -0,0 +1,55 @@
+package organizer
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Personal api tokens let scripts act on behalf of a user. Only the hash of
+// a token is stored, the token itself is shown once, right after creation.
+
+const apiTokenPrefix = "org_"
+
+const (
+	ScopeRead      ApiTokenScope = "read"
+	ScopeReadWrite ApiTokenScope = "read-write"
+)
+
+func ValidApiTokenScope(scope string) (ApiTokenScope, bool) {
+	switch ApiTokenScope(scope) {
+	case ScopeRead:
+		return ScopeRead, true
+	case ScopeReadWrite:
+		return ScopeReadWrite, true
+	}
+	return "", false
+}
+
+// Allows reports whether a request with method may be made with a token of
+// this scope. Read-only tokens are limited to safe methods.
+func (s ApiTokenScope) Allows(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return s == ScopeRead || s == ScopeReadWrite
+	}
+	return s == ScopeReadWrite
+}
+
+// NewApiToken returns a new token together with the hash to store. The
+// prefix makes leaked tokens easy to recognize, e.g. by secret scanners.
+func NewApiToken() (token string, hash TokenHash, err error) {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		return "", TokenHash{}, err
+	}
+	token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(bs)
+	return token, HashApiToken(token), nil
+}
+
+// HashApiToken ignores surrounding whitespace, which is easily copied along
+// with a token.
+func HashApiToken(token string) TokenHash {
+	return HashToken(strings.TrimSpace(token))
+}
@@ -0,0 +1,99 @@
+package organizer
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// The audit log answers what happened to an account, and from where. It
+// records authentication and account events, never their secrets.
+
+const (
+	AuditLoginRequested  AuditAction = "login_requested"
+	AuditLoginRedeemed   AuditAction = "login_redeemed"
+	AuditTokenFailed     AuditAction = "token_failed"
+	AuditCsrfFailed      AuditAction = "csrf_failed"
+	AuditLogout          AuditAction = "logout"
+	AuditSessionRevoked  AuditAction = "session_revoked"
+	AuditRoleChanged     AuditAction = "role_changed"
+	AuditEmailChanged    AuditAction = "email_changed"
+	AuditAccountDeleted  AuditAction = "account_deleted"
+	AuditAccountDisabled AuditAction = "account_disabled"
+	AuditAccountEnabled  AuditAction = "account_enabled"
+	// Impersonations are recorded for the user that was impersonated, with
+	// the admin as actor.
+	AuditImpersonationStarted AuditAction = "impersonation_started"
+	AuditImpersonationEnded   AuditAction = "impersonation_ended"
+)
+
+var auditActions = []AuditAction{
+	AuditLoginRequested,
+	AuditLoginRedeemed,
+	AuditTokenFailed,
+	AuditCsrfFailed,
+	AuditLogout,
+	AuditSessionRevoked,
+	AuditRoleChanged,
+	AuditEmailChanged,
+	AuditAccountDeleted,
+	AuditAccountDisabled,
+	AuditAccountEnabled,
+	AuditImpersonationStarted,
+	AuditImpersonationEnded,
+}
+
+func ValidAuditAction(action string) (AuditAction, bool) {
+	for _, a := range auditActions {
+		if AuditAction(action) == a {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// Label describes the action to users.
+func (a AuditAction) Label() string {
+	switch a {
+	case AuditLoginRequested:
+		return "Login angefordert"
+	case AuditLoginRedeemed:
+		return "Angemeldet"
+	case AuditTokenFailed:
+		return "Ungültiger Login-Token"
+	case AuditCsrfFailed:
+		return "Ungültiger CSRF-Token"
+	case AuditLogout:
+		return "Abgemeldet"
+	case AuditSessionRevoked:
+		return "Sitzung beendet"
+	case AuditRoleChanged:
+		return "Rolle geändert"
+	case AuditEmailChanged:
+		return "Email geändert"
+	case AuditAccountDeleted:
+		return "Konto gelöscht"
+	case AuditAccountDisabled:
+		return "Konto gesperrt"
+	case AuditAccountEnabled:
+		return "Konto entsperrt"
+	case AuditImpersonationStarted:
+		return "Ansicht durch Admin gestartet"
+	case AuditImpersonationEnded:
+		return "Ansicht durch Admin beendet"
+	}
+	return string(a)
+}
+
+// audit appends entry to the audit log, with the client of r filled in. A
+// failure is logged, but doesn't fail the request: the event has already
+// happened. For the same reason, the entry is written even if the client has
+// gone away in the meantime.
+func (s *Service) audit(r *http.Request, entry AuditEntry) {
+	client := s.clientInfo(r)
+	entry.IP = client.IP
+	entry.UserAgent = client.UserAgent
+	if err := s.repo.AppendAuditEntry(context.WithoutCancel(r.Context()), entry); err != nil {
+		slog.Error("failed to write audit log", "error", err, "action", entry.Action, "user", entry.User)
+	}
+}
@@ -0,0 +1,136 @@
+package organizer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Just enough of a CBOR (RFC 8949) decoder to read WebAuthn attestation
+// objects and COSE keys. Maps are decoded into map[any]any, with integer
+// keys as int64 and text keys as string. Indefinite lengths, tags and
+// floats are not supported, since authenticators don't use them.
+
+var errCborTruncated = errors.New("cbor: unexpected end of input")
+
+const cborMaxDepth = 16
+
+// cborDecode decodes the first data item in data and returns it together
+// with the bytes following it.
+func cborDecode(data []byte) (item any, rest []byte, err error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeDepth(data []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nesting too deep")
+	}
+	if len(data) < 1 {
+		return nil, nil, errCborTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		default:
+			return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+		}
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(data) < 1 {
+			return nil, nil, errCborTruncated
+		}
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25:
+		if len(data) < 2 {
+			return nil, nil, errCborTruncated
+		}
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26:
+		if len(data) < 4 {
+			return nil, nil, errCborTruncated
+		}
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27:
+		if len(data) < 8 {
+			return nil, nil, errCborTruncated
+		}
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if uint64(len(data)) < arg {
+			return nil, nil, errCborTruncated
+		}
+		bs, rest := data[:arg], data[arg:]
+		if major == 3 {
+			return string(bs), rest, nil
+		}
+		return append([]byte(nil), bs...), rest, nil
+	case 4:
+		if uint64(len(data)) < arg {
+			return nil, nil, errCborTruncated
+		}
+		arr := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, rest, err := cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, item)
+			data = rest
+		}
+		return arr, data, nil
+	case 5:
+		if uint64(len(data)) < 2*arg {
+			return nil, nil, errCborTruncated
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key type")
+			}
+			val, rest, err := cborDecodeDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = val
+			data = rest
+		}
+		return m, data, nil
+	default:
+		return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+	}
+}
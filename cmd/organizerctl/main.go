@@ -0,0 +1,512 @@
+// organizerctl manages the database of an organizer installation from the
+// command line. It connects the same way the server does, see
+// organizer.SqlConnectionFromEnv, so it works with every backend.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cvanloo/organizer"
+
+	// godotenv.Load(): loads .env from project root
+	_ "github.com/joho/godotenv/autoload"
+)
+
+const usage = `usage: organizerctl <command> [arguments]
+
+commands:
+  migrate status
+  migrate up [-to version] [-dry-run]
+  migrate down [-to version] [-dry-run]
+  user list
+  user create [-role role] <name> <email>
+  user set-role <email> <role>
+  user disable <email>
+  user enable <email>
+  event list [-deleted] [-search text]
+  event delete <id>
+  session list <email>
+  session revoke <email> [session]
+`
+
+// ctl is what the commands work with. The repository is only prepared by
+// the commands that need it, the migrate commands must also work on a
+// database that isn't up to date.
+type ctl struct {
+	db      *sql.DB
+	dialect organizer.Dialect
+	repo    organizer.Repository
+	auth    *organizer.Authenticator
+	out     io.Writer
+}
+
+type command func(ctx context.Context, c *ctl, args []string) error
+
+var commands = map[string]command{
+	"migrate status": migrateStatus,
+	"migrate up":     migrateUp,
+	"migrate down":   migrateDown,
+	"user list":      userList,
+	"user create":    userCreate,
+	"user set-role":  userSetRole,
+	"user disable":   userDisable,
+	"user enable":    userEnable,
+	"event list":     eventList,
+	"event delete":   eventDelete,
+	"session list":   sessionList,
+	"session revoke": sessionRevoke,
+}
+
+var errUsage = errors.New("invalid arguments")
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("organizerctl: ")
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	name := os.Args[1] + " " + os.Args[2]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cfg, err := organizer.SqlConnectionFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	db, repo, err := organizer.OpenDatabase(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	c := &ctl{
+		db:      db,
+		dialect: cfg.Dialect(),
+		repo:    repo,
+		auth:    organizer.NewAuthenticator(organizer.WithSessionStore(repo)),
+		out:     out,
+	}
+	err = cmd(ctx, c, os.Args[3:])
+	out.Flush()
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		db.Close()
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+// parse parses the flags of a command and checks that it got between min
+// and max positional arguments.
+func parse(flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		return nil, errUsage
+	}
+	return flags.Args(), nil
+}
+
+// prepare readies the repository, which only works once the database has
+// been migrated to the latest version.
+func (c *ctl) prepare(ctx context.Context) error {
+	status, err := organizer.Migrations(ctx, c.db, c.dialect)
+	if err != nil {
+		return err
+	}
+	for _, st := range status {
+		if !st.Applied {
+			return fmt.Errorf("database is not up to date, run: organizerctl migrate up")
+		}
+	}
+	return c.repo.Prepare(c.db)
+}
+
+func (c *ctl) userByEmail(ctx context.Context, email string) (organizer.User, error) {
+	user, err := c.repo.UserByEmail(ctx, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, fmt.Errorf("no such user: %s", email)
+	}
+	return user, err
+}
+
+// audit records what has been done from the command line. There is no
+// admin to name as actor, the user agent tells these entries apart.
+func (c *ctl) audit(ctx context.Context, entry organizer.AuditEntry) {
+	entry.UserAgent = "organizerctl"
+	if err := c.repo.AppendAuditEntry(ctx, entry); err != nil {
+		log.Printf("failed to write audit log: %v", err)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+func migrateStatus(ctx context.Context, c *ctl, args []string) error {
+	if _, err := parse(flag.NewFlagSet("status", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	status, err := organizer.Migrations(ctx, c.db, c.dialect)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "VERSION\tNAME\tAPPLIED\t")
+	for _, st := range status {
+		applied := "pending"
+		if st.Applied {
+			applied = formatTime(st.AppliedAt)
+		}
+		if st.Modified {
+			applied += " (modified)"
+		}
+		fmt.Fprintf(c.out, "%d\t%s\t%s\t\n", st.Version, st.Name, applied)
+	}
+	return nil
+}
+
+func migrateUp(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("up", flag.ContinueOnError)
+	target := flags.Int64("to", organizer.LatestVersion, "version to migrate to")
+	dryRun := flags.Bool("dry-run", false, "print the statements instead of running them")
+	if _, err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	current, err := currentVersion(ctx, c)
+	if err != nil {
+		return err
+	}
+	if *target < current {
+		return fmt.Errorf("database is at version %d already, use migrate down", current)
+	}
+	return migrateTo(ctx, c, *target, *dryRun)
+}
+
+// migrateDown reverts the latest migration, unless told otherwise.
+func migrateDown(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("down", flag.ContinueOnError)
+	target := flags.Int64("to", -1, "version to migrate to")
+	dryRun := flags.Bool("dry-run", false, "print the statements instead of running them")
+	if _, err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	current, err := currentVersion(ctx, c)
+	if err != nil {
+		return err
+	}
+	if *target == -1 {
+		*target = max(current-1, 0)
+	}
+	if *target > current {
+		return fmt.Errorf("database is at version %d only, use migrate up", current)
+	}
+	return migrateTo(ctx, c, *target, *dryRun)
+}
+
+func currentVersion(ctx context.Context, c *ctl) (int64, error) {
+	status, err := organizer.Migrations(ctx, c.db, c.dialect)
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	for _, st := range status {
+		if st.Applied {
+			current = st.Version
+		}
+	}
+	return current, nil
+}
+
+func migrateTo(ctx context.Context, c *ctl, target int64, dryRun bool) error {
+	opts := organizer.MigrateOptions{Target: target}
+	if dryRun {
+		opts.DryRun = os.Stdout
+	}
+	return organizer.Migrate(ctx, c.db, c.dialect, opts)
+}
+
+func userList(ctx context.Context, c *ctl, args []string) error {
+	if _, err := parse(flag.NewFlagSet("list", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	users, err := c.repo.Users(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "ID\tNAME\tEMAIL\tROLE\tSTATUS\t")
+	for _, u := range users {
+		status := "active"
+		if u.IsDisabled() {
+			status = "disabled since " + formatTime(u.DisabledAt.Time)
+		} else if !u.IsActive() {
+			status = "unverified"
+		}
+		fmt.Fprintf(c.out, "%d\t%s\t%s\t%s\t%s\t\n", u.ID, u.Name, u.Email, u.Role, status)
+	}
+	return nil
+}
+
+// userCreate adds a user that doesn't need to verify their email, like the
+// users that were added by hand before signups existed.
+func userCreate(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ContinueOnError)
+	roleName := flags.String("role", string(organizer.RoleUser), "role of the new user")
+	args, err := parse(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	role, ok := organizer.ValidRole(*roleName)
+	if !ok {
+		return fmt.Errorf("invalid role: %s", *roleName)
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	user := organizer.NewUser(args[0], args[1])
+	user.Role = role
+	user, err = c.repo.CreateUser(ctx, user)
+	if err != nil {
+		return err
+	}
+	if err := c.repo.ActivateUser(ctx, user.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "created user %d\n", user.ID)
+	return nil
+}
+
+func userSetRole(ctx context.Context, c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("set-role", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	role, ok := organizer.ValidRole(args[1])
+	if !ok {
+		return fmt.Errorf("invalid role: %s", args[1])
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	user, err := c.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.repo.SetUserRole(ctx, user.ID, role); err != nil {
+		return err
+	}
+	c.audit(ctx, organizer.AuditEntry{
+		User:   user.ID,
+		Action: organizer.AuditRoleChanged,
+		Detail: fmt.Sprintf("%s → %s", user.Role, role),
+	})
+	return nil
+}
+
+// userDisable locks the user out, and ends their sessions. Sessions only
+// end if the server keeps them in the database, see
+// organizer.WithPersistentSessions.
+func userDisable(ctx context.Context, c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("disable", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	user, err := c.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.repo.SetUserDisabled(ctx, user.ID, true); err != nil {
+		return err
+	}
+	c.audit(ctx, organizer.AuditEntry{User: user.ID, Action: organizer.AuditAccountDisabled})
+	if err := c.auth.RevokeAllSessions(ctx, user.ID); err != nil {
+		return err
+	}
+	c.audit(ctx, organizer.AuditEntry{User: user.ID, Action: organizer.AuditSessionRevoked, Detail: "all sessions"})
+	return nil
+}
+
+func userEnable(ctx context.Context, c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("enable", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	user, err := c.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if err := c.repo.SetUserDisabled(ctx, user.ID, false); err != nil {
+		return err
+	}
+	c.audit(ctx, organizer.AuditEntry{User: user.ID, Action: organizer.AuditAccountEnabled})
+	return nil
+}
+
+func eventList(ctx context.Context, c *ctl, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	deleted := flags.Bool("deleted", false, "list the events in the trash instead")
+	search := flags.String("search", "", "only list events whose title or description contains this")
+	if _, err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	if *deleted {
+		events, err := c.repo.DeletedEvents(ctx, 0)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "ID\tTITLE\tCREATED BY\tDELETED\t")
+		for _, e := range events {
+			fmt.Fprintf(c.out, "%d\t%s\t%d\t%s\t\n", e.ID, e.Title, e.CreatedBy, formatTime(e.DeletedAt))
+		}
+		return nil
+	}
+	events, err := c.repo.Events(ctx, organizer.EventQuery{Search: *search})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "ID\tTITLE\tCREATED BY\tPARTICIPANTS\t")
+	for _, e := range events {
+		fmt.Fprintf(c.out, "%d\t%s\t%d\t%d\t\n", e.ID, e.Title, e.CreatedBy, e.NumberOfParticipants)
+	}
+	return nil
+}
+
+// eventDelete moves the event to the trash, where its creator can restore it
+// until it's purged.
+func eventDelete(ctx context.Context, c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("delete", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid event id: %s", args[0])
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	err = c.repo.DeleteEvent(ctx, organizer.EventID(id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no such event: %d", id)
+	}
+	return err
+}
+
+// sessionID identifies a session on the command line. Handles can't be
+// used, they are signed with a secret only the server knows, but the hash
+// of the session id is just as safe to show.
+func sessionID(session *organizer.Session) string {
+	return hex.EncodeToString(session.Hash[:6])
+}
+
+func sessionList(ctx context.Context, c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("list", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	user, err := c.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	sessions, err := c.auth.SessionsOfUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "SESSION\tCREATED\tLAST SEEN\tIP\tSTATE\tUSER AGENT\t")
+	for _, session := range sessions {
+		state := "login pending"
+		if session.IsAuthenticated() {
+			state = "authenticated"
+		} else if session.HasPendingSecondFactor() {
+			state = "second factor pending"
+		}
+		if session.Impersonator() != 0 {
+			state += fmt.Sprintf(", impersonated by %d", session.Impersonator())
+		}
+		client := session.Client()
+		fmt.Fprintf(c.out, "%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			sessionID(session),
+			formatTime(session.Created),
+			formatTime(session.LastSeen()),
+			client.IP,
+			state,
+			client.UserAgent)
+	}
+	return nil
+}
+
+// sessionRevoke ends one session of the user, given by its id from session
+// list, or all of them.
+func sessionRevoke(ctx context.Context, c *ctl, args []string) error {
+	args, err := parse(flag.NewFlagSet("revoke", flag.ContinueOnError), args, 1, 2)
+	if err != nil {
+		return err
+	}
+	if err := c.prepare(ctx); err != nil {
+		return err
+	}
+	user, err := c.userByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		if err := c.auth.RevokeAllSessions(ctx, user.ID); err != nil {
+			return err
+		}
+		c.audit(ctx, organizer.AuditEntry{User: user.ID, Action: organizer.AuditSessionRevoked, Detail: "all sessions"})
+		return nil
+	}
+	sessions, err := c.auth.SessionsOfUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if strings.EqualFold(sessionID(session), args[1]) {
+			if err := session.Delete(ctx); err != nil {
+				return err
+			}
+			c.audit(ctx, organizer.AuditEntry{User: user.ID, Action: organizer.AuditSessionRevoked, Detail: "one session"})
+			return nil
+		}
+	}
+	return fmt.Errorf("no such session: %s", args[1])
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
@@ -33,18 +34,6 @@ func check1(err error) {
 	}
 }
 
-// @todo: read form config
-var cfg = organizer.SqlConnection{
-	Driver: "mysql",
-	User:   "organizer",
-	//Password: "todo",
-	SocketPath:  "/run/mysqld/mysqld.sock",
-	Database:    "organizer",
-	MaxConns:    50,
-	MaxLifetime: 3 * time.Minute,
-	UseSocket:   true,
-}
-
 // sudo fuser 8080/tcp -k
 func main() {
 	checkEnv := func(key string) string {
@@ -63,33 +52,61 @@ func main() {
 		ThisSender: checkEnv("MAIL_USER"),
 	}
 
+	cfg := check(organizer.SqlConnectionFromEnv())
+
+	// Signs csrf tokens and passkey challenges, so it has to survive
+	// restarts and be the same on every instance.
+	secret := check(base64.StdEncoding.DecodeString(checkEnv("SESSION_SECRET")))
+	if len(secret) < 32 {
+		log.Fatalf("SESSION_SECRET must be at least 32 bytes, got %d", len(secret))
+	}
+
 	mux := http.NewServeMux()
 
+	authOpts := []organizer.AuthOpt{
+		organizer.WithSecret(secret),
+		organizer.WithTokenLength(50),
+		organizer.WithSessionTokenExpiryLimit(time.Hour * 24 * 7),
+		organizer.WithLoginTokenExpiryLimit(10 * time.Minute),
+	}
+	if issuer, ok := os.LookupEnv("OIDC_ISSUER"); ok {
+		authOpts = append(authOpts, organizer.WithOidcProvider(organizer.NewOidcProvider(organizer.OidcConfig{
+			Issuer:       issuer,
+			ClientID:     checkEnv("OIDC_CLIENT_ID"),
+			ClientSecret: checkEnv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  "http://localhost:8080/oidc/callback",
+			Name:         checkEnv("OIDC_NAME"),
+		})))
+	}
+	auth := organizer.NewAuthenticator(authOpts...)
+
 	service, err := organizer.NewService(
 		organizer.WithUrl("http://localhost:8080/"),
 		organizer.WithMux(mux),
 		organizer.WithDatabase(cfg),
-		organizer.WithAuthentication(organizer.NewAuthenticator(
-			organizer.WithTokenLength(50),
-			organizer.WithSessionTokenExpiryLimit(time.Hour*24*7),
-			organizer.WithLoginTokenExpiryLimit(10*time.Minute),
-			organizer.WithCsrfTokenExpiryLimit(10*time.Minute),
-		)),
+		organizer.WithAuthentication(auth),
+		organizer.WithPersistentSessions(),
 		organizer.WithMailer(organizer.NewMailer(mailCfg)),
 	)
 	if err != nil {
 		log.Fatalf("failed to initialize service: %v", err)
 	}
 
+	if admin, ok := os.LookupEnv("ADMIN_EMAIL"); ok {
+		if err := service.GrantRole(context.Background(), admin, organizer.RoleAdmin); err != nil {
+			log.Fatalf("failed to appoint admin %s: %v", admin, err)
+		}
+	}
+
 	if isdelve.Enabled {
 		log.Print("warning: debug mode is enabled")
-		if testUser, ok := os.LookupEnv("TEST_USER"); ok {
-			sessionID := checkEnv("TEST_SESS")
-			session := check(service.TestUser(testUser, sessionID))
-			log.Printf("test user session token: %s", session.Value)
-		}
 	}
 
+	sweepCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	go auth.RunSweeper(sweepCtx, 5*time.Minute)
+	go service.RunPurger(sweepCtx, time.Hour)
+
 	srv := http.Server{
 		Addr:    ":8080",
 		Handler: service,
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/russross/blackfriday/v2"
 )
@@ -21,24 +24,47 @@ func init() {
 	})
 
 	template.Must(pages.Parse(HtmlLanding))
+	template.Must(pages.Parse(HtmlSignup))
 	template.Must(pages.Parse(HtmlLoginLinkSent))
 	template.Must(pages.Parse(HtmlConfirmLogin))
+	template.Must(pages.Parse(HtmlApproveLogin))
+	template.Must(pages.Parse(HtmlLoginApproved))
 	template.Must(pages.Parse(HtmlTitleBar))
 	template.Must(pages.Parse(HtmlEventListing))
 	template.Must(pages.Parse(HtmlCreate))
 	template.Must(pages.Parse(HtmlEventView))
 	template.Must(pages.Parse(HtmlEventRegistration))
+	template.Must(pages.Parse(HtmlProfile))
+	template.Must(pages.Parse(HtmlSessions))
+	template.Must(pages.Parse(HtmlApiTokens))
+	template.Must(pages.Parse(HtmlApiTokenCreated))
+	template.Must(pages.Parse(HtmlAdminUsers))
+	template.Must(pages.Parse(HtmlEmailChangeSent))
+	template.Must(pages.Parse(HtmlEmailChangeConfirm))
+	template.Must(pages.Parse(HtmlEmailChangeUndo))
+	template.Must(pages.Parse(HtmlEmailChangeDone))
+	template.Must(pages.Parse(HtmlAccountDeleted))
+	template.Must(pages.Parse(HtmlAuditLog))
+	template.Must(pages.Parse(HtmlImpersonationBanner))
+	template.Must(pages.Parse(HtmlSecondFactor))
+	template.Must(pages.Parse(HtmlTotpEnroll))
+	template.Must(pages.Parse(HtmlTotpRecoveryCodes))
+	template.Must(pages.Parse(HtmlTrash))
 }
 
 //go:embed htmx/htmx.js
 var htmxScript StringResponder
 
+//go:embed js/passkeys.js
+var passkeysScript StringResponder
+
 //go:embed styles.css
 var styles StringResponder
 
 func init() {
 	// @todo: uhhh...
 	fileToMime[htmxScript] = "application/javascript"
+	fileToMime[passkeysScript] = "application/javascript"
 	fileToMime[styles] = "text/css"
 }
 
@@ -61,6 +87,10 @@ func RenderMarkdown(data string) template.HTML {
 	return template.HTML(md)
 }
 
+type LandingData struct {
+	Oidc string // name of the identity provider, if configured
+}
+
 const HtmlLanding = `
 {{ define "Landing" }}
 <!DOCTYPE html>
@@ -71,6 +101,7 @@ const HtmlLanding = `
 	<meta name="viewport" content="width=device-width, initial-scale=1.0">
 	<link rel="stylesheet" href="/styles.css" title="Default Style">
 	<script src="/js/htmx.js"></script>
+	<script src="/js/passkeys.js"></script>
 </head>
 <body>
 	<h2>Login</h2>
@@ -80,24 +111,125 @@ const HtmlLanding = `
 		<input type="submit" value="Anmelden">
 		<p class="htmx-indicator">Loading...</p>
 	</form>
+	<div class="list">
+		<button type="button" onclick="loginWithPasskey()">Mit Passkey anmelden</button>
+		<p id="passkey-error"></p>
+	</div>
+{{ if .Oidc }}
+	<form action="/oidc/login" method="get" class="list">
+		<input type="submit" value="Mit {{ .Oidc }} anmelden">
+	</form>
+{{ end }}
+	<p class="text-center">Noch kein Konto? <a href="/signup">Registrieren</a></p>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlSignup = `
+{{ define "Signup" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Registrieren &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	<h2>Registrieren</h2>
+	<form hx-post="/signup" hx-target="body" hx-swap="innerHTML" class="list">
+		<label for="name">Name:</label>
+		<input type="text" name="name" id="name" maxlength="30" required>
+		<label for="email">Email:</label>
+		<input type="email" name="email" id="email" required>
+		<input type="submit" value="Registrieren">
+		<p class="htmx-indicator">Loading...</p>
+	</form>
+	<p class="text-center">Bereits registriert? <a href="/home">Anmelden</a></p>
 </body>
 </html>
 {{ end }}
 `
 
+type LoginLinkSentData struct {
+	Csrf   CsrfID
+	Failed bool
+}
+
 const HtmlLoginLinkSent = `
 {{ define "LoginLinkSent" }}
-<main class="text-center">
+<main class="text-center" hx-get="/auth/status" hx-trigger="every 3s">
 	<h2>Login-Link verschickt</h2>
 	<p>Überprüfe dein Postfach (auch Spam).</p>
-	<p>Du kannst dieses Fenster jetzt schliessen.</p>
+	<p>Öffne den Link auf einem beliebigen Gerät, oder gib den Code aus der Email hier ein.</p>
+{{ if .Failed }}
+	<p>Falscher oder abgelaufener Code.</p>
+{{ end }}
+	<form hx-post="/auth/code" hx-target="body" hx-swap="innerHTML" class="list">
+		<input type="hidden" name="csrf" id="csrf" value="{{.Csrf}}">
+		<label for="code">Code:</label>
+		<input type="text" name="code" id="code" inputmode="numeric" autocomplete="one-time-code" maxlength="6" required>
+		<input type="submit" value="Anmelden">
+	</form>
 </main>
 {{ end }}
 `
 
+type ApproveLoginData struct {
+	Token       LoginID
+	RequestedAt time.Time
+	Client      ClientInfo
+}
+
+const HtmlApproveLogin = `
+{{ define "ApproveLogin" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Login freigeben &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<h2>Login auf anderem Gerät freigeben</h2>
+	<p class="text-center">Dieser Login wurde am {{ .RequestedAt.Format "02.01.2006 um 15:04" }} von einem anderen Gerät aus angefordert.</p>
+	<p class="text-center">IP-Adresse: {{ .Client.IP }}<br>Browser: {{ .Client.UserAgent }}</p>
+	<p class="text-center">Gib den Login nur frei, wenn du ihn selbst angefordert hast. Das andere Gerät wird danach mit deinem Konto angemeldet.</p>
+	<form action="/auth/approve" method="post" class="list">
+		<input type="hidden" name="token" id="token" value="{{.Token}}">
+		<input type="submit" value="Login Freigeben">
+	</form>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlLoginApproved = `
+{{ define "LoginApproved" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Login freigegeben &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<main class="text-center">
+		<h2>Login freigegeben</h2>
+		<p>Das andere Gerät ist jetzt angemeldet. Du kannst dieses Fenster schliessen.</p>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
 type ConfirmLoginData struct {
 	Token LoginID
-	Csrf  string
+	Csrf  CsrfID
 }
 
 const HtmlConfirmLogin = `
@@ -125,11 +257,13 @@ const HtmlConfirmLogin = `
 const HtmlTitleBar = `
 {{ define "TitleBar" }}
 <header>
+	<div hx-get="/impersonation" hx-trigger="load" hx-swap="outerHTML"></div>
 	<nav>
 		<p><a href="/">Home</a></p>
 		<p><a href="/create">Create</a></p>
 		<p class="push"><a href="/about">About</a></p>
-		<p><a hx-post="/logout">Logout</a></p>
+		<p><a href="/profile">Profile</a></p>
+		<p><a hx-post="/logout" hx-headers='{"X-Csrf-Token": "{{ .Csrf }}"}'>Logout</a></p>
 	</nav>
 </header>
 {{ end }}
@@ -138,6 +272,16 @@ const HtmlTitleBar = `
 type (
 	EventListing struct {
 		Events []EventInfo
+		// The filters, as entered in the search form.
+		Search     string
+		Repeats    string
+		Free       bool
+		Mine       bool
+		Registered bool
+		Sort       EventSort
+		// More links to the next page, if there is one.
+		More string
+		Csrf CsrfID
 	}
 	EventInfo     struct {
 		ID                   EventID
@@ -149,6 +293,33 @@ type (
 	}
 )
 
+// query returns the parameters of the listing, continued after cursor.
+func (l EventListing) query(after EventCursor) url.Values {
+	q := url.Values{}
+	set := func(key string, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	on := func(key string, value bool) {
+		if value {
+			q.Set(key, "on")
+		}
+	}
+	set("q", l.Search)
+	set("repeats", l.Repeats)
+	on("free", l.Free)
+	on("mine", l.Mine)
+	on("registered", l.Registered)
+	set("sort", string(l.Sort))
+	cursor := strconv.Itoa(int(after.ID))
+	if l.Sort == SortTitle {
+		cursor += ":" + after.Title
+	}
+	q.Set("after", cursor)
+	return q
+}
+
 func (dto *EventInfo) From(e Event) *EventInfo {
 	dto.ID = e.ID
 	dto.Title = e.Title
@@ -211,6 +382,34 @@ const HtmlEventListing = `
 	{{ Render "TitleBar" . }}
 	<main>
 	<h2>Events</h2>
+	<form action="/events" method="get" class="list">
+		<div class="group-horiz">
+			<input type="search" name="q" value="{{ .Search }}" placeholder="Titel oder Beschreibung">
+			<select name="sort">
+				<option value="oldest"{{ if eq .Sort "oldest" }} selected="selected"{{ end }}>Älteste zuerst</option>
+				<option value="newest"{{ if eq .Sort "newest" }} selected="selected"{{ end }}>Neueste zuerst</option>
+				<option value="title"{{ if eq .Sort "title" }} selected="selected"{{ end }}>Nach Titel</option>
+			</select>
+		</div>
+		<div class="group-horiz">
+			<select name="repeats">
+				<option value="">Alle Events</option>
+				<option value="yes"{{ if eq .Repeats "yes" }} selected="selected"{{ end }}>Wiederkehrend</option>
+				<option value="no"{{ if eq .Repeats "no" }} selected="selected"{{ end }}>Einmalig</option>
+			</select>
+			<label><input type="checkbox" name="free"{{ if .Free }} checked{{ end }}> Freie Plätze</label>
+			<label><input type="checkbox" name="mine"{{ if .Mine }} checked{{ end }}> Von mir erstellt</label>
+			<label><input type="checkbox" name="registered"{{ if .Registered }} checked{{ end }}> Angemeldet</label>
+		</div>
+		<input type="submit" value="Suchen">
+	</form>
+	{{ Render "EventPage" . }}
+	</main>
+</body>
+</html>
+{{ end }}
+
+{{ define "EventPage" }}
 {{ range .Events }}
 	<div class="event-entry">
 		<h3><a href="/event?id={{ .ID }}">{{ .Title }}</a></h3>
@@ -220,13 +419,19 @@ const HtmlEventListing = `
 		<p>Teilnehmer: {{ .NumberOfParticipants }}</p>
 		<p style="text-overflow: ellipsis; overflow: hidden; white-space: nowrap;">{{ .Description }}</p>
 	</div>
+{{ else }}
+	<p class="text-center">Keine Events gefunden.</p>
+{{ end }}
+{{ if .More }}
+	<p class="text-center" id="more-events"><a href="{{ .More }}" hx-get="{{ .More }}" hx-target="#more-events" hx-swap="outerHTML">Mehr laden</a></p>
 {{ end }}
-	</main>
-</body>
-</html>
 {{ end }}
 `
 
+type CreateData struct {
+	Csrf CsrfID
+}
+
 const HtmlCreate = `
 {{ define "Create" }}
 <!DOCTYPE html>
@@ -289,6 +494,7 @@ window.onload = () => {
 	<main>
 	<h2>Event erstellen</h2>
 	<form hx-post="/create" hx-target="body" hx-swap="innerHTML" id="form_event_create" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
 		<label for="title">Titel:</label>
 		<input type="text" name="title" id="title" required>
 		<label for="description">Beschreibung:</label>
@@ -334,9 +540,10 @@ type EventDetails struct {
 	EventInfo
 	Participants []Participant
 	Discussion   []Comment
-	Csrf         string // @todo: CsrfID (the other place(s) as well!)
+	Csrf         CsrfID
 	SubID        EventRegistrationID
 	Participant
+	CanDelete    bool
 }
 
 func (e EventDetails) HasNotSignedUp() bool {
@@ -357,13 +564,13 @@ func (p Participant) AcceptMessage() string {
 }
 
 type UserRegister struct {
-	Csrf string
+	Csrf CsrfID
 	ID EventID
 }
 
 type UserDeregister struct {
 	Participant
-	Csrf string
+	Csrf CsrfID
 	SubID EventRegistrationID
 }
 
@@ -392,6 +599,13 @@ const HtmlEventView = `
 		<p>({{ .RepeatsText }})</p>
 {{ end }}
 		<p>Anzahl Teilnehmer: {{ .NumberOfParticipants }}</p>
+{{ if .CanDelete }}
+		<form action="/event/delete" method="post">
+			<input type="hidden" name="csrf" value="{{ .Csrf }}">
+			<input type="hidden" name="id" value="{{ .ID }}">
+			<input type="submit" value="Event löschen">
+		</form>
+{{ end }}
 	</div>
 {{ if .HasNotSignedUp }}
 {{ block "UserRegister" . }}
@@ -455,3 +669,647 @@ const HtmlEventRegistration = `
 </div>
 {{ end }}
 `
+
+type (
+	ProfileData struct {
+		User        User
+		Passkeys    []Passkey
+		TotpEnabled bool
+		Csrf        CsrfID
+	}
+	SecondFactorData struct {
+		Csrf         CsrfID
+		Failed       bool
+		AttemptsLeft int
+	}
+	TotpEnrollData struct {
+		ProvisioningUri template.URL
+		QRCode          template.HTML
+		Secret          string
+		Csrf            CsrfID
+	}
+	TotpRecoveryCodesData struct {
+		Codes []string
+		Csrf  CsrfID
+	}
+)
+
+const HtmlProfile = `
+{{ define "Profile" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Profil &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+	<script src="/js/passkeys.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Profil</h2>
+	<p class="text-center">{{ .User.Name }} &lt;{{ .User.Email }}&gt;</p>
+	<form action="/email/change" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<label for="email">Neue Email:</label>
+		<input type="email" name="email" id="email" required>
+		<input type="submit" value="Email ändern">
+	</form>
+	<h3>Passkeys</h3>
+{{ range .Passkeys }}
+	<div class="passkey-entry group-horiz">
+		<p style="flex: 3;">{{ .Name }} (erstellt {{ .CreatedAt.Format "02.01.2006" }}{{ if .LastUsedAt.Valid }}, zuletzt verwendet {{ .LastUsedAt.Time.Format "02.01.2006" }}{{ end }})</p>
+		<form hx-post="/passkey/delete" style="flex: 1;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="id" value="{{ .ID }}">
+			<input type="submit" value="Entfernen">
+		</form>
+	</div>
+{{ else }}
+	<p class="text-center">Noch keine Passkeys registriert.</p>
+{{ end }}
+	<form onsubmit="event.preventDefault(); registerPasskey(this.elements.name.value);" class="list">
+		<label for="name">Name des Passkeys:</label>
+		<input type="text" name="name" id="name" maxlength="64" placeholder="z.B. Laptop" required>
+		<input type="submit" value="Passkey hinzufügen">
+		<p id="passkey-error"></p>
+	</form>
+	<h3>Sitzungen</h3>
+	<p class="text-center"><a href="/sessions">Angemeldete Geräte verwalten</a></p>
+	<p class="text-center"><a href="/account/activity">Kontoaktivität anzeigen</a></p>
+	<h3>Papierkorb</h3>
+	<p class="text-center"><a href="/trash">Gelöschte Events und Anmeldungen wiederherstellen</a></p>
+	<h3>API-Tokens</h3>
+	<p class="text-center"><a href="/tokens">Tokens für Skripte und Integrationen verwalten</a></p>
+	<h3>Zwei-Faktor-Authentifizierung</h3>
+{{ if .TotpEnabled }}
+	<p class="text-center">Beim Login per Email wird ein Code aus deiner Authenticator-App verlangt.</p>
+	<form action="/totp/disable" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<label for="code">Aktueller Code oder Wiederherstellungscode:</label>
+		<input type="text" name="code" id="code" autocomplete="one-time-code" required>
+		<input type="submit" value="Deaktivieren">
+	</form>
+{{ else }}
+	<form action="/totp/enroll" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<input type="submit" value="Einrichten">
+	</form>
+{{ end }}
+	<h3>Deine Daten</h3>
+	<p class="text-center"><a href="/account/export" download>Alle Daten als JSON herunterladen</a></p>
+	<form action="/account/delete" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<p>Dein Konto und deine Events werden gelöscht, deine Anmeldungen zurückgezogen. Das kann nicht rückgängig gemacht werden.</p>
+		<label for="confirm">Zur Bestätigung deine Email:</label>
+		<input type="email" name="confirm" id="confirm" autocomplete="off" required>
+		<input type="submit" value="Konto löschen">
+	</form>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+type (
+	SessionsData struct {
+		Sessions []SessionEntry
+		Csrf     CsrfID
+	}
+	SessionEntry struct {
+		Handle   string
+		Created  time.Time
+		LastSeen time.Time
+		Client   ClientInfo
+		Current  bool
+		Pending  bool // still waiting for the login link, code or second factor
+	}
+)
+
+const HtmlSessions = `
+{{ define "Sessions" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Sitzungen &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Sitzungen</h2>
+{{ range .Sessions }}
+	<div class="session-entry group-horiz">
+		<p style="flex: 3;">
+			{{ if .Current }}<strong>Diese Sitzung</strong><br>{{ end }}
+			{{ if .Pending }}Login ausstehend<br>{{ end }}
+			{{ .Client.UserAgent }}<br>
+			IP-Adresse: {{ .Client.IP }}<br>
+			Angemeldet am {{ .Created.Format "02.01.2006 um 15:04" }}, zuletzt aktiv am {{ .LastSeen.Format "02.01.2006 um 15:04" }}
+		</p>
+{{ if not .Current }}
+		<form action="/sessions/revoke" method="post" style="flex: 1;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="session" value="{{ .Handle }}">
+			<input type="submit" value="Abmelden">
+		</form>
+{{ end }}
+	</div>
+{{ end }}
+	<form action="/sessions/revoke-others" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<input type="submit" value="Alle anderen Sitzungen abmelden">
+	</form>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+type (
+	ApiTokensData struct {
+		Tokens []ApiToken
+		Csrf   CsrfID
+	}
+	ApiTokenCreatedData struct {
+		Token  ApiToken
+		Secret string
+		Csrf   CsrfID
+	}
+)
+
+const HtmlApiTokens = `
+{{ define "ApiTokens" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>API-Tokens &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>API-Tokens</h2>
+	<p>Mit einem Token können Skripte in deinem Namen auf Events zugreifen. Sende es im Header <code>Authorization: Bearer &lt;Token&gt;</code> mit.</p>
+{{ range .Tokens }}
+	<div class="token-entry group-horiz">
+		<p style="flex: 3;">{{ .Name }} ({{ if eq .Scope "read" }}nur lesen{{ else }}lesen und schreiben{{ end }}, erstellt {{ .CreatedAt.Format "02.01.2006" }}{{ if .LastUsedAt.Valid }}, zuletzt verwendet {{ .LastUsedAt.Time.Format "02.01.2006" }}{{ end }})</p>
+		<form action="/tokens/revoke" method="post" style="flex: 1;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="id" value="{{ .ID }}">
+			<input type="submit" value="Widerrufen">
+		</form>
+	</div>
+{{ else }}
+	<p class="text-center">Noch keine Tokens erstellt.</p>
+{{ end }}
+	<form action="/tokens/create" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<label for="name">Name des Tokens:</label>
+		<input type="text" name="name" id="name" maxlength="64" placeholder="z.B. Teilnehmerliste exportieren" required>
+		<label for="scope">Berechtigung:</label>
+		<select name="scope" id="scope">
+			<option value="read" selected="selected">Nur lesen</option>
+			<option value="read-write">Lesen und schreiben</option>
+		</select>
+		<input type="submit" value="Token erstellen">
+	</form>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlApiTokenCreated = `
+{{ define "ApiTokenCreated" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>API-Token erstellt &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Token &laquo;{{ .Token.Name }}&raquo; erstellt</h2>
+	<p>Kopiere das Token jetzt, es wird nur dieses eine Mal angezeigt.</p>
+	<pre class="text-center">{{ .Secret }}</pre>
+	<p class="text-center"><a href="/tokens">Zurück zu den Tokens</a></p>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+type AdminUsersData struct {
+	Users []User
+	Roles []Role
+	Self  UserID
+	Csrf  CsrfID
+}
+
+const HtmlAdminUsers = `
+{{ define "AdminUsers" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Benutzer &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Benutzer</h2>
+	<p class="text-center"><a href="/admin/audit">Audit-Log</a></p>
+{{ range $user := .Users }}
+	<div class="user-entry group-horiz">
+		<p style="flex: 3;"><a href="/admin/audit?user={{ $user.Email }}">{{ $user.Name }} &lt;{{ $user.Email }}&gt;</a>{{ if not $user.IsActive }} (nicht bestätigt){{ end }}{{ if $user.IsDisabled }} (gesperrt){{ end }}</p>
+{{ if eq $user.ID $.Self }}
+		<p style="flex: 2;">{{ $user.Role }}</p>
+{{ else }}
+{{ if ne $user.Role "admin" }}
+		<form action="/admin/impersonate" method="post" style="flex: 1;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="id" value="{{ $user.ID }}">
+			<input type="submit" value="Ansehen als">
+		</form>
+{{ end }}
+		<form action="/admin/users/role" method="post" class="group-horiz" style="flex: 2;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="id" value="{{ $user.ID }}">
+			<select name="role">
+{{ range $.Roles }}
+				<option value="{{ . }}"{{ if eq . $user.Role }} selected="selected"{{ end }}>{{ . }}</option>
+{{ end }}
+			</select>
+			<input type="submit" value="Speichern">
+		</form>
+{{ end }}
+	</div>
+{{ end }}
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+type ImpersonationData struct {
+	User    User
+	Expires time.Time
+	Csrf    CsrfID
+}
+
+const HtmlImpersonationBanner = `
+{{ define "ImpersonationBanner" }}
+<form action="/impersonation/stop" method="post" class="impersonation group-horiz">
+	<input type="hidden" name="csrf" value="{{ .Csrf }}">
+	<p>Du siehst die Seite als {{ .User.Name }} &lt;{{ .User.Email }}&gt;, nur lesend, bis {{ .Expires.Format "15:04" }}.</p>
+	<input type="submit" value="Ansicht beenden">
+</form>
+{{ end }}
+`
+
+type (
+	// AuditLogData is shared by the audit log of admins, and the activity
+	// page of users. Only admins get to filter.
+	AuditLogData struct {
+		Admin   bool
+		Entries []AuditRow
+		Actions []AuditAction
+		User    string
+		Action  AuditAction
+		Next    AuditEntryID // zero if there are no older entries
+		Csrf    CsrfID
+	}
+	AuditRow struct {
+		AuditEntry
+		UserEmail  string
+		ActorEmail string
+	}
+)
+
+const HtmlAuditLog = `
+{{ define "AuditLog" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>{{ if .Admin }}Audit-Log{{ else }}Kontoaktivität{{ end }} &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+{{ if .Admin }}
+	<h2>Audit-Log</h2>
+	<form action="/admin/audit" method="get" class="group-horiz">
+		<input type="email" name="user" value="{{ .User }}" placeholder="Email">
+		<select name="action">
+			<option value="">Alle Ereignisse</option>
+{{ range .Actions }}
+			<option value="{{ . }}"{{ if eq . $.Action }} selected="selected"{{ end }}>{{ .Label }}</option>
+{{ end }}
+		</select>
+		<input type="submit" value="Filtern">
+	</form>
+{{ else }}
+	<h2>Kontoaktivität</h2>
+{{ end }}
+{{ range .Entries }}
+	<div class="audit-entry">
+		<p><strong>{{ .Action.Label }}</strong>{{ if .Detail }} ({{ .Detail }}){{ end }}, {{ .CreatedAt.Local.Format "02.01.2006 15:04" }}</p>
+{{ if $.Admin }}
+		<p>Konto: {{ if .UserEmail }}{{ .UserEmail }}{{ else }}unbekannt{{ end }}{{ if .ActorEmail }}, durch {{ .ActorEmail }}{{ end }}</p>
+{{ end }}
+		<p>{{ if .IP }}{{ .IP }}{{ else }}Unbekannte Adresse{{ end }}, {{ if .UserAgent }}{{ .UserAgent }}{{ else }}unbekannter Browser{{ end }}</p>
+	</div>
+{{ else }}
+	<p class="text-center">Keine Einträge.</p>
+{{ end }}
+{{ if .Next }}
+	<p class="text-center"><a href="?{{ if .Admin }}user={{ .User }}&amp;action={{ .Action }}&amp;{{ end }}before={{ .Next }}">Ältere Einträge</a></p>
+{{ end }}
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+type EmailChangeData struct {
+	Email  string
+	Token  string
+	Undone bool
+	Csrf   CsrfID
+}
+
+const HtmlEmailChangeSent = `
+{{ define "EmailChangeSent" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Email ändern &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main class="text-center">
+		<h2>Bestätigung gesendet</h2>
+		<p>Wir haben einen Link an {{ .Email }} gesendet. Deine Email wird geändert, sobald du ihn innert 24 Stunden öffnest.</p>
+		<p><a href="/profile">Zurück zum Profil</a></p>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlEmailChangeConfirm = `
+{{ define "EmailChangeConfirm" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Email bestätigen &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<h2>Neue Email bestätigen</h2>
+	<p class="text-center">Ab jetzt meldest du dich mit {{ .Email }} an. Deine bisherige Adresse erhält einen Link, mit dem die Änderung rückgängig gemacht werden kann.</p>
+	<form action="/email/confirm" method="post" class="list">
+		<input type="hidden" name="token" value="{{ .Token }}">
+		<input type="submit" value="Email ändern">
+	</form>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlEmailChangeUndo = `
+{{ define "EmailChangeUndo" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Änderung rückgängig machen &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<h2>Änderung rückgängig machen</h2>
+	<p class="text-center">Dein Konto wird wieder auf {{ .Email }} umgestellt, und alle Geräte werden abgemeldet.</p>
+	<form action="/email/undo" method="post" class="list">
+		<input type="hidden" name="token" value="{{ .Token }}">
+		<input type="submit" value="Rückgängig machen">
+	</form>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlEmailChangeDone = `
+{{ define "EmailChangeDone" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Email geändert &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<main class="text-center">
+{{ if .Undone }}
+		<h2>Änderung rückgängig gemacht</h2>
+		<p>Dein Konto verwendet wieder {{ .Email }}. Alle Geräte wurden abgemeldet.</p>
+{{ else }}
+		<h2>Email geändert</h2>
+		<p>Du meldest dich ab jetzt mit {{ .Email }} an.</p>
+{{ end }}
+		<p><a href="/">Zur Anmeldung</a></p>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlAccountDeleted = `
+{{ define "AccountDeleted" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Konto gelöscht &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<main class="text-center">
+		<h2>Konto gelöscht</h2>
+		<p>Dein Konto wurde gelöscht und alle Geräte wurden abgemeldet.</p>
+		<p><a href="/">Zur Startseite</a></p>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlSecondFactor = `
+{{ define "SecondFactor" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Zweiter Faktor &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+</head>
+<body>
+	<h2>Zweiter Faktor</h2>
+{{ if .Failed }}
+	<p class="text-center">Falscher Code, noch {{ .AttemptsLeft }} Versuche.</p>
+{{ end }}
+	<form action="/auth/second-factor" method="post" class="list">
+		<input type="hidden" name="csrf" id="csrf" value="{{ .Csrf }}">
+		<label for="code">Code aus der Authenticator-App oder Wiederherstellungscode:</label>
+		<input type="text" name="code" id="code" autocomplete="one-time-code" autofocus required>
+		<input type="submit" value="Bestätigen">
+	</form>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlTotpEnroll = `
+{{ define "TotpEnroll" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Zwei-Faktor-Authentifizierung &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Zwei-Faktor-Authentifizierung einrichten</h2>
+	<p>Scanne den QR-Code mit deiner Authenticator-App, öffne den <a href="{{ .ProvisioningUri }}">Einrichtungslink</a> oder gib den folgenden Schlüssel ein:</p>
+	<p class="text-center">{{ .QRCode }}</p>
+	<pre class="text-center">{{ .Secret }}</pre>
+	<form action="/totp/confirm" method="post" class="list">
+		<input type="hidden" name="csrf" value="{{ .Csrf }}">
+		<label for="code">Angezeigter Code:</label>
+		<input type="text" name="code" id="code" inputmode="numeric" autocomplete="one-time-code" required>
+		<input type="submit" value="Aktivieren">
+	</form>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+const HtmlTotpRecoveryCodes = `
+{{ define "TotpRecoveryCodes" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Wiederherstellungscodes &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Wiederherstellungscodes</h2>
+	<p>Zwei-Faktor-Authentifizierung ist aktiv. Bewahre diese Codes sicher auf, jeder kann einmal anstelle eines Codes aus der App verwendet werden. Sie werden nur jetzt angezeigt.</p>
+	<pre class="text-center">{{ range .Codes }}{{ . }}
+{{ end }}</pre>
+	<p class="text-center"><a href="/profile">Zurück zum Profil</a></p>
+	</main>
+</body>
+</html>
+{{ end }}
+`
+
+type TrashData struct {
+	Events        []DeletedEvent
+	Registrations []DeletedEventRegistration
+	All           bool // moderators see everyone's deleted items
+	Retention     time.Duration
+	Csrf          CsrfID
+}
+
+// PurgeDate is when an item deleted at deletedAt is removed for good.
+func (d TrashData) PurgeDate(deletedAt time.Time) time.Time {
+	return deletedAt.Add(d.Retention)
+}
+
+const HtmlTrash = `
+{{ define "Trash" }}
+<!DOCTYPE html>
+<html lang="de">
+<head>
+	<meta charset="utf-8">
+	<title>Papierkorb &mdash; Organizer</title>
+	<meta name="viewport" content="width=device-width, initial-scale=1.0">
+	<link rel="stylesheet" href="/styles.css" title="Default Style">
+	<script src="/js/htmx.js"></script>
+</head>
+<body>
+	{{ Render "TitleBar" . }}
+	<main>
+	<h2>Papierkorb</h2>
+	<p>{{ if .All }}Gelöschte Events und zurückgezogene Anmeldungen aller Benutzer.{{ else }}Deine gelöschten Events und zurückgezogenen Anmeldungen.{{ end }} Sie können wiederhergestellt werden, bis sie endgültig gelöscht werden.</p>
+	<h3>Events</h3>
+{{ range .Events }}
+	<div class="trash-entry group-horiz">
+		<p style="flex: 3;">{{ .Title }} (gelöscht {{ .DeletedAt.Format "02.01.2006" }}, endgültig ab {{ ($.PurgeDate .DeletedAt).Format "02.01.2006" }})</p>
+		<form action="/trash/restore" method="post" style="flex: 1;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="event" value="{{ .ID }}">
+			<input type="submit" value="Wiederherstellen">
+		</form>
+	</div>
+{{ else }}
+	<p class="text-center">Keine gelöschten Events.</p>
+{{ end }}
+	<h3>Anmeldungen</h3>
+{{ range .Registrations }}
+	<div class="trash-entry group-horiz">
+		<p style="flex: 3;"><a href="/event?id={{ .Event }}">{{ .EventTitle }}</a> (zurückgezogen {{ .DeletedAt.Format "02.01.2006" }}, endgültig ab {{ ($.PurgeDate .DeletedAt).Format "02.01.2006" }})</p>
+		<form action="/trash/restore" method="post" style="flex: 1;">
+			<input type="hidden" name="csrf" value="{{ $.Csrf }}">
+			<input type="hidden" name="registration" value="{{ .ID }}">
+			<input type="submit" value="Wiederherstellen">
+		</form>
+	</div>
+{{ else }}
+	<p class="text-center">Keine zurückgezogenen Anmeldungen.</p>
+{{ end }}
+	</main>
+</body>
+</html>
+{{ end }}
+`
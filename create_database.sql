@@ -6,6 +6,8 @@ use organizer;
 
 create table if not exists migrations (
 	version int primary key auto_increment,
+	name varchar(64) not null default '',
+	checksum char(64) default null,
 	created_at datetime not null default current_timestamp
 );
 
@@ -1,26 +1,102 @@
 package organizer
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
-	"log"
+	"net"
+	"os"
+	"strings"
 	"time"
 )
 
 type (
+	// Repository methods give up once ctx is done, failing with an error
+	// that wraps ctx.Err().
+	//
+	// Users, events and registrations are soft-deleted. Every method treats
+	// deleted rows as missing, except for the trash methods, which only see
+	// deleted rows.
 	Repository interface {
+		SessionStore
 		Prepare(db *sql.DB) error
-		User(id UserID) (User, error)
-		UserByEmail(email string) (User, error)
-		Event(id EventID) (Event, error)
-		CreateEvent(event Event) (Event, error)
-		RegisterEvent(reg EventRegistration) (EventRegistration, error)
-		DeregisterEvent(id EventRegistrationID) error
-		Events() ([]Event, error)
-		EventRegistration(id EventRegistrationID) (EventRegistration, error)
-		EventRegistrations(eventID EventID) ([]EventRegistration, error)
+		User(ctx context.Context, id UserID) (User, error)
+		UserByEmail(ctx context.Context, email string) (User, error)
+		CreateUser(ctx context.Context, user User) (User, error)
+		ActivateUser(ctx context.Context, id UserID) error
+		Users(ctx context.Context) ([]User, error)
+		SetUserRole(ctx context.Context, id UserID, role Role) error
+		// SetUserDisabled locks the user out, or lets them back in. Their
+		// sessions are left alone, they have to be revoked separately.
+		SetUserDisabled(ctx context.Context, id UserID, disabled bool) error
+		Event(ctx context.Context, id EventID) (Event, error)
+		CreateEvent(ctx context.Context, event Event) (Event, error)
+		RegisterEvent(ctx context.Context, reg EventRegistration) (EventRegistration, error)
+		DeregisterEvent(ctx context.Context, id EventRegistrationID) error
+		// Events lists the events matching query, see EventQuery.
+		Events(ctx context.Context, query EventQuery) ([]Event, error)
+		EventRegistration(ctx context.Context, id EventRegistrationID) (EventRegistration, error)
+		EventRegistrations(ctx context.Context, eventID EventID) ([]EventRegistration, error)
+		Passkeys(ctx context.Context, user UserID) ([]Passkey, error)
+		PasskeyByCredentialID(ctx context.Context, credentialID []byte) (Passkey, error)
+		CreatePasskey(ctx context.Context, passkey Passkey) (Passkey, error)
+		UpdatePasskeySignCount(ctx context.Context, id PasskeyID, signCount uint32) error
+		DeletePasskey(ctx context.Context, id PasskeyID, user UserID) error
+		TotpSecret(ctx context.Context, user UserID) (TotpSecret, error)
+		SaveTotpSecret(ctx context.Context, secret TotpSecret) error
+		ConfirmTotpSecret(ctx context.Context, user UserID) error
+		// UseTotpStep records step as the last used time step, it reports
+		// false if the same or a later step has been used before.
+		UseTotpStep(ctx context.Context, user UserID, step int64) (bool, error)
+		DeleteTotpSecret(ctx context.Context, user UserID) error
+		SetRecoveryCodes(ctx context.Context, user UserID, hashes [][]byte) error
+		UseRecoveryCode(ctx context.Context, user UserID, hash []byte) (bool, error)
+		ApiTokens(ctx context.Context, user UserID) ([]ApiToken, error)
+		ApiTokenByHash(ctx context.Context, hash TokenHash) (ApiToken, error)
+		CreateApiToken(ctx context.Context, token ApiToken) (ApiToken, error)
+		TouchApiToken(ctx context.Context, id ApiTokenID) error
+		DeleteApiToken(ctx context.Context, id ApiTokenID, user UserID) error
+		CreateEmailChange(ctx context.Context, change EmailChange) (EmailChange, error)
+		EmailChangeByConfirmHash(ctx context.Context, hash TokenHash) (EmailChange, error)
+		EmailChangeByUndoHash(ctx context.Context, hash TokenHash) (EmailChange, error)
+		// ConfirmEmailChange switches the user over to the new address,
+		// unless the change has been confirmed or undone before, or the
+		// user's address has changed in the meantime.
+		ConfirmEmailChange(ctx context.Context, change EmailChange, undoHash TokenHash) error
+		// UndoEmailChange restores the old address, and cancels all changes
+		// of the user that came after.
+		UndoEmailChange(ctx context.Context, change EmailChange) error
+		EventsCreatedBy(ctx context.Context, user UserID) ([]Event, error)
+		EventRegistrationsOfUser(ctx context.Context, user UserID) ([]EventRegistration, error)
+		EmailChanges(ctx context.Context, user UserID) ([]EmailChange, error)
+		// DeleteUser anonymizes the user and soft-deletes their events and
+		// registrations, so that participant counts of other events stay
+		// correct. Credentials are deleted for good.
+		DeleteUser(ctx context.Context, id UserID) error
+		// The audit log is append-only, there is no way to change or remove
+		// entries through the repository.
+		AppendAuditEntry(ctx context.Context, entry AuditEntry) error
+		// AuditEntries returns the newest entries matching filter first.
+		AuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+		DeleteEvent(ctx context.Context, id EventID) error
+		// DeletedEvents lists the deleted events created by user, or by
+		// anyone if user is zero, the most recently deleted first. Events of
+		// deleted users are left out, they can't be restored.
+		DeletedEvents(ctx context.Context, user UserID) ([]DeletedEvent, error)
+		// RestoreEvent fails with sql.ErrNoRows unless the event is deleted
+		// and was created by user, any user if zero.
+		RestoreEvent(ctx context.Context, id EventID, user UserID) error
+		// DeletedEventRegistrations lists the withdrawn registrations of
+		// user, or of anyone if user is zero, as long as their event still
+		// exists.
+		DeletedEventRegistrations(ctx context.Context, user UserID) ([]DeletedEventRegistration, error)
+		RestoreEventRegistration(ctx context.Context, id EventRegistrationID, user UserID) error
+		// PurgeDeleted removes events and registrations for good that have
+		// been deleted before deletedBefore. Deleted users are kept, they
+		// are anonymized already and the audit log still refers to them.
+		PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int64, error)
 	}
 	UserID int
 	User   struct {
@@ -29,7 +105,13 @@ type (
 		Display sql.NullString
 		Email   string
 		Icon    sql.NullString
+		// ActivatedAt is null until the user has verified their email.
+		ActivatedAt sql.NullTime
+		Role        Role
+		// DisabledAt is set while an admin has locked the user out.
+		DisabledAt sql.NullTime
 	}
+	Role string
 	EventID int
 	Event struct {
 		ID EventID
@@ -48,9 +130,146 @@ type (
 		Event EventID
 		Message sql.NullString
 	}
+	DeletedEvent struct {
+		Event
+		DeletedAt time.Time
+	}
+	DeletedEventRegistration struct {
+		EventRegistration
+		EventTitle string
+		DeletedAt  time.Time
+	}
 	TimeScale string
+	PasskeyID int
+	Passkey   struct {
+		ID           PasskeyID
+		User         UserID
+		Name         string
+		CredentialID []byte
+		PublicKey    []byte
+		SignCount    uint32
+		CreatedAt    time.Time
+		LastUsedAt   sql.NullTime
+	}
+	TotpSecret struct {
+		User        UserID
+		Secret      []byte
+		ConfirmedAt sql.NullTime
+		LastStep    int64
+	}
+	ApiTokenID    int
+	ApiTokenScope string
+	ApiToken      struct {
+		ID         ApiTokenID
+		User       UserID
+		Name       string
+		Hash       TokenHash
+		Scope      ApiTokenScope
+		CreatedAt  time.Time
+		LastUsedAt sql.NullTime
+	}
+	// EmailChange records every change of a user's address, so that an
+	// account can be recovered after it has been taken over. Only the hashes
+	// of the tokens are stored.
+	EmailChangeID int
+	EmailChange   struct {
+		ID          EmailChangeID
+		User        UserID
+		OldEmail    string
+		NewEmail    string
+		ConfirmHash TokenHash
+		UndoHash    TokenHash // zero until the change is confirmed
+		RequestedAt time.Time
+		ConfirmedAt sql.NullTime
+		UndoneAt    sql.NullTime
+	}
+	AuditEntryID int64
+	AuditAction  string
+	// AuditEntry records a security relevant event. User is the account the
+	// event concerns, Actor whoever caused it, if that wasn't the user
+	// themself. Both are zero if unknown.
+	AuditEntry struct {
+		ID        AuditEntryID
+		User      UserID
+		Actor     UserID
+		Action    AuditAction
+		Detail    string
+		IP        string
+		UserAgent string
+		CreatedAt time.Time
+	}
+	// AuditFilter narrows down the audit log. Zero fields match everything.
+	// Before is used to page through the log.
+	AuditFilter struct {
+		User   UserID
+		Action AuditAction
+		Before AuditEntryID
+		Limit  int
+	}
+	// EventQuery selects a page of events. The zero value lists all of
+	// them, the oldest first.
+	EventQuery struct {
+		// Search keeps the events whose title or description contains the
+		// text, ignoring case. It's a plain substring match, there are no
+		// full-text indexes behind it.
+		Search string
+		// Repeating keeps only the events that repeat, or only those that
+		// don't, if valid.
+		Repeating sql.NullBool
+		// HasFreeSpots leaves out events that have reached their maximum
+		// number of participants.
+		HasFreeSpots bool
+		// CreatedBy and RegisteredBy keep the events created by, or with a
+		// registration of, the user, unless zero.
+		CreatedBy    UserID
+		RegisteredBy UserID
+		Sort         EventSort
+		// After continues the listing after the last event of the previous
+		// page, unless zero.
+		After EventCursor
+		// Limit is the size of a page, zero means no limit.
+		Limit int
+	}
+	EventSort string
+	// EventCursor is the position of an event in a listing. The title is
+	// only needed when sorting by title.
+	EventCursor struct {
+		ID    EventID
+		Title string
+	}
 )
 
+const (
+	SortOldest EventSort = "oldest"
+	SortNewest EventSort = "newest"
+	SortTitle  EventSort = "title"
+)
+
+// ValidEventSort accepts the empty string as SortOldest, the order events
+// used to be listed in.
+func ValidEventSort(sort string) (EventSort, bool) {
+	switch EventSort(sort) {
+	case "", SortOldest:
+		return SortOldest, true
+	case SortNewest, SortTitle:
+		return EventSort(sort), true
+	}
+	return "", false
+}
+
+// CursorOf returns the position of event in a listing sorted like q.
+func (q EventQuery) CursorOf(event Event) EventCursor {
+	c := EventCursor{ID: event.ID}
+	if q.Sort == SortTitle {
+		c.Title = event.Title
+	}
+	return c
+}
+
+func (c EventCursor) IsZero() bool {
+	return c.ID == 0
+}
+
 const (
 	RepeatsNever TimeScale = "never"
 	RepeatsDaily TimeScale = "daily"
@@ -60,7 +279,14 @@ const (
 )
 
 func (t *TimeScale) Scan(src any) error {
-	*t = TimeScale(src.([]byte))
+	switch src := src.(type) {
+	case []byte:
+		*t = TimeScale(src)
+	case string:
+		*t = TimeScale(src)
+	default:
+		return fmt.Errorf("cannot scan %T into TimeScale", src)
+	}
 	return nil
 }
 
@@ -81,31 +307,98 @@ func ValidScale(scale string) (TimeScale, bool) {
 	}
 }
 
+// Dialect is the flavour of SQL spoken by a database.
+type Dialect string
+
+const (
+	DialectMySQL    Dialect = "mysql"
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+// rebind replaces the ? placeholders of query by the numbered ones Postgres
+// expects. Queries must not contain question marks otherwise.
+func rebind(dialect Dialect, query string) string {
+	if dialect != DialectPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
 type SqlConnection struct {
 	Driver      string
 	User        string
 	Password    string
 	SocketPath  string
 	Database    string
+	// Host is the host[:port] of the server, if not connecting through a
+	// socket. Defaults to localhost.
+	Host        string
+	// SSLMode is passed on to Postgres, the other drivers ignore it.
+	SSLMode     string
 	MaxConns    int
 	MaxLifetime time.Duration
 	UseSocket   bool
+	// QueryTimeout is how long a single query or transaction may take,
+	// defaults to DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+const DefaultQueryTimeout = 5 * time.Second
+
+func (s SqlConnection) Dialect() Dialect {
+	switch s.Driver {
+	case "sqlite":
+		return DialectSQLite
+	case "postgres":
+		return DialectPostgres
+	}
+	return DialectMySQL
 }
 
 func (s SqlConnection) String() string {
+	if s.Driver == "sqlite" {
+		// Database is the path of the database file. Writers wait for
+		// each other instead of failing right away.
+		return fmt.Sprintf(
+			"file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite&_txlock=immediate",
+			s.Database,
+		)
+	}
+	if s.Driver == "postgres" {
+		return s.postgresString()
+	}
 	// [username[:password]@][protocol[(address)]]/dbname[?param1=value1&...&paramN=valueN]
-	// username:password@unix(socketPath)/dbname?charset=utf8
+	// username:password@unix(socketPath)/dbname?charset=utf8&parseTime=true
 	var connStr string
 	if s.UseSocket {
 		connStr = fmt.Sprintf(
-			"%s@unix(%s)/%s?charset=utf8",
+			"%s@unix(%s)/%s?charset=utf8&parseTime=true",
 			s.User,
 			s.SocketPath,
 			s.Database,
 		)
+	} else if s.Host != "" {
+		connStr = fmt.Sprintf(
+			"%s:%s@tcp(%s)/%s?charset=utf8&parseTime=true",
+			s.User,
+			s.Password,
+			s.Host,
+			s.Database,
+		)
 	} else {
 		connStr = fmt.Sprintf(
-			"%s:%s@/%s?charset=utf8",
+			"%s:%s@/%s?charset=utf8&parseTime=true",
 			s.User,
 			s.Password,
 			s.Database,
@@ -114,6 +407,146 @@ func (s SqlConnection) String() string {
 	return connStr
 }
 
+// postgresString builds a key/value connection string. For sockets, host is
+// the directory the socket is in, e.g. /run/postgresql.
+func (s SqlConnection) postgresString() string {
+	quote := func(v string) string {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		return "'" + strings.ReplaceAll(v, "'", `\'`) + "'"
+	}
+	host, sslMode := s.Host, s.SSLMode
+	if s.UseSocket {
+		host = s.SocketPath
+		if sslMode == "" {
+			sslMode = "disable"
+		}
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	port := ""
+	if !s.UseSocket {
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+	}
+	params := []string{
+		"host=" + quote(host),
+		"user=" + quote(s.User),
+		"dbname=" + quote(s.Database),
+	}
+	if port != "" {
+		params = append(params, "port="+quote(port))
+	}
+	if s.Password != "" {
+		params = append(params, "password="+quote(s.Password))
+	}
+	if sslMode != "" {
+		params = append(params, "sslmode="+quote(sslMode))
+	}
+	return strings.Join(params, " ")
+}
+
+// SqlConnectionFromEnv configures the database the way the commands in cmd/
+// expect it: the local MariaDB through its socket, unless SQLITE_PATH or
+// POSTGRES_DB select another backend. DB_QUERY_TIMEOUT overrides the
+// DefaultQueryTimeout.
+func SqlConnectionFromEnv() (SqlConnection, error) {
+	cfg := SqlConnection{
+		Driver:      "mysql",
+		User:        "organizer",
+		SocketPath:  "/run/mysqld/mysqld.sock",
+		Database:    "organizer",
+		MaxConns:    50,
+		MaxLifetime: 3 * time.Minute,
+		UseSocket:   true,
+	}
+	if path, ok := os.LookupEnv("SQLITE_PATH"); ok {
+		cfg = SqlConnection{
+			Driver:      "sqlite",
+			Database:    path,
+			MaxConns:    10,
+			MaxLifetime: 3 * time.Minute,
+		}
+	}
+	if dbname, ok := os.LookupEnv("POSTGRES_DB"); ok {
+		cfg = SqlConnection{
+			Driver:      "postgres",
+			User:        "organizer",
+			SocketPath:  "/run/postgresql",
+			Database:    dbname,
+			MaxConns:    50,
+			MaxLifetime: 3 * time.Minute,
+			UseSocket:   true,
+		}
+	}
+	if timeout, ok := os.LookupEnv("DB_QUERY_TIMEOUT"); ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return cfg, fmt.Errorf("DB_QUERY_TIMEOUT: %w", err)
+		}
+		cfg.QueryTimeout = d
+	}
+	return cfg, nil
+}
+
+// OpenDatabase connects to the database and returns a repository for its
+// dialect. The repository isn't prepared yet, that must wait until the
+// database has been migrated.
+func OpenDatabase(ctx context.Context, cfg SqlConnection) (*sql.DB, Repository, error) {
+	var repo Repository
+	base := MariaDB{queryTimeout: cfg.QueryTimeout}
+	switch cfg.Driver {
+	case "mysql":
+		repo = &base
+	case "sqlite":
+		repo = &SQLite{base}
+	case "postgres":
+		repo = &Postgres{base}
+	default:
+		return nil, nil, fmt.Errorf("no backend implemented for database: %s", cfg.Driver)
+	}
+
+	db, err := sql.Open(cfg.Driver, cfg.String())
+	if err != nil {
+		return nil, nil, fmt.Errorf("db dns: %w", err)
+	}
+	db.SetConnMaxLifetime(cfg.MaxLifetime)
+	db.SetMaxOpenConns(cfg.MaxConns)
+	db.SetMaxIdleConns(cfg.MaxConns)
+
+	if err := db.PingContext(ctx); err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("db ping failed: %w", err), db.Close())
+	}
+	return db, repo, nil
+}
+
+func NewUser(name, email string) User {
+	return User{
+		Name: name,
+		Display: sql.NullString{
+			String: name,
+			Valid: true,
+		},
+		Email: email,
+		Role: RoleUser,
+	}
+}
+
+func (u User) IsActive() bool {
+	return u.ActivatedAt.Valid
+}
+
+func (u User) IsDisabled() bool {
+	return u.DisabledAt.Valid
+}
+
+// IsConfirmed reports whether the user has proven that their authenticator
+// app produces valid codes. Unconfirmed secrets are not enforced at login.
+func (t TotpSecret) IsConfirmed() bool {
+	return t.ConfirmedAt.Valid
+}
+
 func NewEvent(by UserID, title, desc string, every int, scale TimeScale, minPart, maxPart int) Event {
 	return Event{
 		CreatedBy: by,
@@ -142,62 +575,28 @@ func NewEventRegistration(by UserID, to EventID, msg string) (reg EventRegistrat
 	return reg
 }
 
-var migrations = []func(*sql.Tx) error{
-	m01_initial,
+var migrations = []migration{
+	{version: 1, name: "initial", mysql: m01_initial},
+	{version: 2, name: "sessions", mysql: m02_sessions},
+	{version: 3, name: "user_activation", mysql: m03_user_activation},
+	{version: 4, name: "passkeys", mysql: m04_passkeys},
+	{version: 5, name: "totp", mysql: m05_totp},
+	{version: 6, name: "login_codes", mysql: m06_login_codes},
+	{version: 7, name: "session_activity", mysql: m07_session_activity},
+	{version: 8, name: "stateless_csrf", mysql: m08_stateless_csrf},
+	{version: 9, name: "api_tokens", mysql: m09_api_tokens},
+	{version: 10, name: "roles", mysql: m10_roles},
+	// Sketched early on, but only finished after m10.
+	{version: 11, name: "email_recovery", mysql: m11_email_recovery},
+	{version: 12, name: "audit_log", mysql: m12_audit_log},
+	{version: 13, name: "token_hashes", mysql: m13_token_hashes},
+	{version: 14, name: "impersonation", mysql: m14_impersonation, sqlite: s14_schema, postgres: p14_schema},
+	{version: 15, name: "user_disabling", mysql: m15_user_disabling, sqlite: s15_user_disabling, postgres: p15_user_disabling},
+	{version: 16, name: "used_challenges", mysql: m16_used_challenges, sqlite: s16_used_challenges, postgres: p16_used_challenges},
 }
 
-var maxVersion = int64(len(migrations))
-
-func migrate(db *sql.DB) error {
-	targetVersion := maxVersion
-	var currentVersion int64
-
-	row := db.QueryRow("select version from migrations order by version desc limit 1;")
-	if err := row.Scan(&currentVersion); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return fmt.Errorf("failed to read migration table: %w", err)
-	}
-
-	if currentVersion < targetVersion {
-		log.Printf("migrating database from version %d to %d", currentVersion, targetVersion)
-	}
-
-	for version := currentVersion; version < targetVersion; version++ {
-		migrateFunc := migrations[version]
-		tx, err := db.Begin()
-		if err != nil {
-			return fmt.Errorf("migration %d: failed to start transaction: %w", version, err)
-		}
-		if err = migrateFunc(tx); err != nil {
-			err = fmt.Errorf("migration %d: failed to migrate: %w", version, err)
-			rerr := tx.Rollback()
-			return errors.Join(err, rerr)
-		}
-		if _, err := tx.Exec("insert into migrations () values ();"); err != nil {
-			err = fmt.Errorf("migration %d: failed to bump version: %w", version, err)
-			rerr := tx.Rollback()
-			return errors.Join(err, rerr)
-		}
-		if err = tx.Commit(); err != nil {
-			log.Printf("migration %d: failed to commit changes", version)
-			return err
-		}
-	}
-	log.Printf("database v%d up to date", targetVersion)
-	return nil
-}
-
-func runSteps(tx *sql.Tx, steps []string) error {
-	for i, sql := range steps {
-		_, err := tx.Exec(sql)
-		if err != nil {
-			return fmt.Errorf("sql step %d failed: %w", i, err)
-		}
-	}
-	return nil
-}
-
-func m01_initial(tx *sql.Tx) error {
-	steps := []string{
+var m01_initial = steps{
+	up: []string{
 		`create table if not exists users (
 			id int primary key auto_increment,
 			name varchar(30) not null,
@@ -231,29 +630,278 @@ func m01_initial(tx *sql.Tx) error {
 			changed_at datetime default null,
 			deleted_at datetime default null
 		);`,
-	}
-	return runSteps(tx, steps)
+	},
+	down: []string{
+		`drop table event_subscriptions;`,
+		`drop table events;`,
+		`drop table users;`,
+	},
 }
 
-func m02_email_recovery(tx *sql.Tx) error {
-	// @todo: find that one blog post again
-	steps := []string{
+var m02_sessions = steps{
+	up: []string{
+		`create table if not exists sessions (
+			id varchar(255) primary key,
+			user_id int not null references users (id),
+			authenticated boolean not null default false,
+			created_at datetime not null,
+			login_token varchar(255) not null default '',
+			login_created_at datetime default null,
+			login_valid boolean not null default false,
+			csrf_token varchar(255) not null default '',
+			csrf_created_at datetime default null,
+			csrf_valid boolean not null default false
+		);`,
+	},
+	down: []string{
+		`drop table sessions;`,
+	},
+}
+
+var m03_user_activation = steps{
+	up: []string{
+		`alter table users add column activated_at datetime default null;`,
+		// users that existed before signups were possible have all been
+		// added by hand, treat them as verified.
+		`update users set activated_at = created_at;`,
+	},
+	down: []string{
+		`alter table users drop column activated_at;`,
+	},
+}
+
+var m04_passkeys = steps{
+	up: []string{
+		`create table if not exists passkeys (
+			id int primary key auto_increment,
+			user_id int not null references users (id),
+			name varchar(64) not null,
+			credential_id varbinary(1023) not null unique,
+			public_key varbinary(1023) not null,
+			sign_count int unsigned not null default 0,
+			created_at datetime not null default current_timestamp,
+			last_used_at datetime default null
+		);`,
+	},
+	down: []string{
+		`drop table passkeys;`,
+	},
+}
+
+var m05_totp = steps{
+	up: []string{
+		`create table if not exists totp_secrets (
+			user_id int primary key references users (id),
+			secret varbinary(64) not null,
+			last_step bigint not null default 0,
+			created_at datetime not null default current_timestamp,
+			confirmed_at datetime default null
+		);`,
+		`create table if not exists recovery_codes (
+			id int primary key auto_increment,
+			user_id int not null references users (id),
+			code_hash varbinary(64) not null,
+			created_at datetime not null default current_timestamp,
+			used_at datetime default null
+		);`,
+		`alter table sessions
+			add column second_factor_pending boolean not null default false,
+			add column second_factor_attempts int not null default 0;`,
+	},
+	down: []string{
+		`alter table sessions
+			drop column second_factor_pending,
+			drop column second_factor_attempts;`,
+		`drop table recovery_codes;`,
+		`drop table totp_secrets;`,
+	},
+}
+
+var m06_login_codes = steps{
+	up: []string{
+		`alter table sessions
+			add column login_code varchar(16) not null default '',
+			add column login_code_created_at datetime default null,
+			add column login_code_valid boolean not null default false,
+			add column login_code_attempts int not null default 0;`,
+		`create index sessions_login_token on sessions (login_token);`,
+	},
+	down: []string{
+		`drop index sessions_login_token on sessions;`,
+		`alter table sessions
+			drop column login_code,
+			drop column login_code_created_at,
+			drop column login_code_valid,
+			drop column login_code_attempts;`,
+	},
+}
+
+var m07_session_activity = steps{
+	up: []string{
+		`alter table sessions
+			add column last_seen_at datetime not null default current_timestamp,
+			add column ip varchar(45) not null default '',
+			add column user_agent varchar(255) not null default '';`,
+		`create index sessions_user_id on sessions (user_id);`,
+	},
+	down: []string{
+		`drop index sessions_user_id on sessions;`,
+		`alter table sessions
+			drop column last_seen_at,
+			drop column ip,
+			drop column user_agent;`,
+	},
+}
+
+var m08_stateless_csrf = steps{
+	up: []string{
+		`alter table sessions
+			drop column csrf_token,
+			drop column csrf_created_at,
+			drop column csrf_valid;`,
+	},
+	down: []string{
+		`alter table sessions
+			add column csrf_token varchar(255) not null default '',
+			add column csrf_created_at datetime default null,
+			add column csrf_valid boolean not null default false;`,
+	},
+}
+
+var m09_api_tokens = steps{
+	up: []string{
+		`create table if not exists api_tokens (
+			id int primary key auto_increment,
+			user_id int not null references users (id),
+			name varchar(64) not null,
+			token_hash binary(32) not null unique,
+			scope varchar(16) not null,
+			created_at datetime not null default current_timestamp,
+			last_used_at datetime default null
+		);`,
+	},
+	down: []string{
+		`drop table api_tokens;`,
+	},
+}
+
+var m10_roles = steps{
+	up: []string{
+		`alter table users add column role varchar(16) not null default 'user';`,
+		// Until now, everyone could create events.
+		`update users set role = 'organizer';`,
+	},
+	down: []string{
+		`alter table users drop column role;`,
+	},
+}
+
+var m11_email_recovery = steps{
+	up: []string{
 		`create table if not exists email_changes (
 			id int primary key auto_increment,
-			email varchar(255) not null unique,
-			changed_from_id int references email_changes (id),
-			changed_to_id int references email_changes (id) default null,
-			confirm_token text(50),
-			undo_token text(50),
+			user_id int not null references users (id),
+			old_email varchar(255) not null,
+			new_email varchar(255) not null,
+			confirm_token_hash binary(32) not null unique,
+			undo_token_hash binary(32) default null unique,
+			requested_at datetime not null default current_timestamp,
+			confirmed_at datetime default null,
+			undone_at datetime default null
 		);`,
-		//`insert into email_changes (email, changed_from_id, confirm_token, undo_token)
-		//select users.email, null, null, null from users;`,
-		`alter table users change email email_id int not null references email_changes (id);`,
-	}
-	return runSteps(tx, steps)
+		`create index email_changes_user_id on email_changes (user_id);`,
+	},
+	down: []string{
+		`drop table email_changes;`,
+	},
 }
 
-func m03_trust(tx *sql.Tx) error {
-	steps := []string{}
-	return runSteps(tx, steps)
+var m12_audit_log = steps{
+	up: []string{
+		`create table if not exists audit_log (
+			id bigint primary key auto_increment,
+			user_id int default null references users (id),
+			actor_id int default null references users (id),
+			action varchar(32) not null,
+			detail varchar(255) not null default '',
+			ip varchar(45) not null default '',
+			user_agent varchar(255) not null default '',
+			created_at datetime not null default current_timestamp
+		);`,
+		`create index audit_log_user_id on audit_log (user_id, id);`,
+		`create index audit_log_action on audit_log (action, id);`,
+	},
+	down: []string{
+		`drop table audit_log;`,
+	},
+}
+
+// m13_token_hashes replaces the tokens of sessions by their hashes. Running
+// sessions and logins stay valid, the hashes are computed from the stored
+// tokens. The other way around that's impossible, so reverting it ends all
+// sessions.
+var m13_token_hashes = steps{
+	up: []string{
+		`alter table sessions
+			add column id_hash binary(32) default null,
+			add column login_token_hash binary(32) default null,
+			add column login_code_hash binary(32) default null;`,
+		`update sessions set
+			id_hash = unhex(sha2(id, 256)),
+			login_token_hash = if(login_token = '', null, unhex(sha2(login_token, 256))),
+			login_code_hash = if(login_code = '', null, unhex(sha2(login_code, 256)));`,
+		`alter table sessions
+			drop primary key,
+			drop column id,
+			drop column login_token,
+			drop column login_code,
+			modify column id_hash binary(32) not null,
+			add primary key (id_hash),
+			add index sessions_login_token_hash (login_token_hash);`,
+	},
+	down: []string{
+		`delete from sessions;`,
+		`alter table sessions
+			drop primary key,
+			drop column id_hash,
+			drop column login_token_hash,
+			drop column login_code_hash,
+			add column id varchar(255) not null,
+			add column login_token varchar(255) not null default '',
+			add column login_code varchar(16) not null default '',
+			add primary key (id),
+			add index sessions_login_token (login_token);`,
+	},
+}
+
+var m14_impersonation = steps{
+	up: []string{
+		`alter table sessions add column impersonator_id int default null references users (id);`,
+	},
+	down: []string{
+		`alter table sessions drop column impersonator_id;`,
+	},
+}
+
+var m15_user_disabling = steps{
+	up: []string{
+		`alter table users add column disabled_at datetime default null;`,
+	},
+	down: []string{
+		`alter table users drop column disabled_at;`,
+	},
+}
+
+// m16_used_challenges remembers the passkey login challenges that have been
+// answered, until they expire.
+var m16_used_challenges = steps{
+	up: []string{
+		`create table if not exists used_challenges (
+			challenge_hash binary(32) primary key,
+			expires_at datetime not null
+		);`,
+	},
+	down: []string{
+		`drop table used_challenges;`,
+	},
 }
@@ -1,11 +1,15 @@
 package organizer
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type (
@@ -23,6 +27,9 @@ type (
 
 func (h HandlerWithError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := h(w, r); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			err = Timeout(err)
+		}
 		if err, ok := err.(ErrorResponder); ok {
 			if err.RespondError(w, r) {
 				return
@@ -141,3 +148,66 @@ func (e ErrUnauthorized) RespondError(w http.ResponseWriter, r *http.Request) bo
 	http.Error(w, "unauthorized", http.StatusUnauthorized)
 	return true
 }
+
+type ErrForbidden struct{}
+
+func Forbidden() error {
+	return ErrForbidden{}
+}
+
+func (e ErrForbidden) Error() string {
+	return "forbidden"
+}
+
+func (e ErrForbidden) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return true
+}
+
+type ErrTooManyRequests struct {
+	retryAfter time.Duration
+}
+
+func TooManyRequests(retryAfter time.Duration) error {
+	return ErrTooManyRequests{retryAfter}
+}
+
+func (e ErrTooManyRequests) Error() string {
+	return fmt.Sprintf("too many requests, retry after %s", e.retryAfter)
+}
+
+func (e ErrTooManyRequests) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	seconds := int(math.Ceil(e.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("too many requests, retry in %d seconds", seconds), http.StatusTooManyRequests)
+	return true
+}
+
+// ErrTimeout is returned when the database didn't answer within the query
+// timeout, or the client has gone away before it did.
+type ErrTimeout struct {
+	err error
+}
+
+func Timeout(err error) error {
+	return ErrTimeout{err}
+}
+
+func (e ErrTimeout) Error() string {
+	return fmt.Sprintf("timeout: %s", e.err)
+}
+
+func (e ErrTimeout) Unwrap() error {
+	return e.err
+}
+
+func (e ErrTimeout) RespondError(w http.ResponseWriter, r *http.Request) bool {
+	slog.Warn(e.Error(), "path", r.URL.EscapedPath(), "method", r.Method)
+	if errors.Is(e.err, context.DeadlineExceeded) {
+		http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+		return true
+	}
+	// Most likely nobody is listening anymore.
+	http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	return true
+}
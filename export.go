@@ -0,0 +1,245 @@
+package organizer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The data export holds everything stored about a user, in a shape that
+// doesn't leak internals: secrets and token hashes are left out, null
+// columns become null in json.
+
+type (
+	DataExport struct {
+		ExportedAt    time.Time                 `json:"exported_at"`
+		Profile       ExportProfile             `json:"profile"`
+		Passkeys      []ExportPasskey           `json:"passkeys"`
+		TotpEnabled   bool                      `json:"totp_enabled"`
+		ApiTokens     []ExportApiToken          `json:"api_tokens"`
+		Sessions      []ExportSession           `json:"sessions"`
+		EmailChanges  []ExportEmailChange       `json:"email_changes"`
+		Events        []ExportEvent             `json:"events"`
+		Registrations []ExportEventRegistration `json:"registrations"`
+		AuditLog      []ExportAuditEntry        `json:"audit_log"`
+	}
+	ExportProfile struct {
+		ID          UserID     `json:"id"`
+		Name        string     `json:"name"`
+		Display     *string    `json:"display"`
+		Email       string     `json:"email"`
+		Icon        *string    `json:"icon"`
+		Role        Role       `json:"role"`
+		ActivatedAt *time.Time `json:"activated_at"`
+	}
+	ExportPasskey struct {
+		Name       string     `json:"name"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+	}
+	ExportApiToken struct {
+		Name       string        `json:"name"`
+		Scope      ApiTokenScope `json:"scope"`
+		CreatedAt  time.Time     `json:"created_at"`
+		LastUsedAt *time.Time    `json:"last_used_at"`
+	}
+	ExportSession struct {
+		Created   time.Time `json:"created_at"`
+		LastSeen  time.Time `json:"last_seen_at"`
+		IP        string    `json:"ip"`
+		UserAgent string    `json:"user_agent"`
+	}
+	ExportEmailChange struct {
+		OldEmail    string     `json:"old_email"`
+		NewEmail    string     `json:"new_email"`
+		RequestedAt time.Time  `json:"requested_at"`
+		ConfirmedAt *time.Time `json:"confirmed_at"`
+		UndoneAt    *time.Time `json:"undone_at"`
+	}
+	ExportEvent struct {
+		ID              EventID   `json:"id"`
+		Title           string    `json:"title"`
+		Description     string    `json:"description"`
+		RepeatsEvery    int       `json:"repeats_every"`
+		RepeatsScale    TimeScale `json:"repeats_scale"`
+		MinParticipants *int64    `json:"min_participants"`
+		MaxParticipants *int64    `json:"max_participants"`
+	}
+	ExportEventRegistration struct {
+		Event      EventID `json:"event_id"`
+		EventTitle string  `json:"event_title"`
+		Message    *string `json:"message"`
+	}
+	ExportAuditEntry struct {
+		Action    AuditAction `json:"action"`
+		Detail    string      `json:"detail"`
+		IP        string      `json:"ip"`
+		UserAgent string      `json:"user_agent"`
+		CreatedAt time.Time   `json:"created_at"`
+	}
+)
+
+// ExportUserData collects the data export of a user.
+func ExportUserData(ctx context.Context, repo Repository, auth *Authenticator, id UserID) (DataExport, error) {
+	export := DataExport{ExportedAt: time.Now().UTC()}
+
+	user, err := repo.User(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.Profile = ExportProfile{
+		ID:          user.ID,
+		Name:        user.Name,
+		Display:     nullString(user.Display),
+		Email:       user.Email,
+		Icon:        nullString(user.Icon),
+		Role:        user.Role,
+		ActivatedAt: nullTimePtr(user.ActivatedAt),
+	}
+
+	passkeys, err := repo.Passkeys(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.Passkeys = make([]ExportPasskey, 0, len(passkeys))
+	for _, p := range passkeys {
+		export.Passkeys = append(export.Passkeys, ExportPasskey{
+			Name:       p.Name,
+			CreatedAt:  p.CreatedAt,
+			LastUsedAt: nullTimePtr(p.LastUsedAt),
+		})
+	}
+
+	totp, err := repo.TotpSecret(ctx, id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return export, err
+	}
+	export.TotpEnabled = totp.IsConfirmed()
+
+	tokens, err := repo.ApiTokens(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.ApiTokens = make([]ExportApiToken, 0, len(tokens))
+	for _, t := range tokens {
+		export.ApiTokens = append(export.ApiTokens, ExportApiToken{
+			Name:       t.Name,
+			Scope:      t.Scope,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: nullTimePtr(t.LastUsedAt),
+		})
+	}
+
+	sessions, err := auth.SessionsOfUser(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.Sessions = make([]ExportSession, 0, len(sessions))
+	for _, s := range sessions {
+		client := s.Client()
+		export.Sessions = append(export.Sessions, ExportSession{
+			Created:   s.Created,
+			LastSeen:  s.LastSeen(),
+			IP:        client.IP,
+			UserAgent: client.UserAgent,
+		})
+	}
+
+	changes, err := repo.EmailChanges(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.EmailChanges = make([]ExportEmailChange, 0, len(changes))
+	for _, c := range changes {
+		export.EmailChanges = append(export.EmailChanges, ExportEmailChange{
+			OldEmail:    c.OldEmail,
+			NewEmail:    c.NewEmail,
+			RequestedAt: c.RequestedAt,
+			ConfirmedAt: nullTimePtr(c.ConfirmedAt),
+			UndoneAt:    nullTimePtr(c.UndoneAt),
+		})
+	}
+
+	events, err := repo.EventsCreatedBy(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.Events = make([]ExportEvent, 0, len(events))
+	for _, e := range events {
+		export.Events = append(export.Events, ExportEvent{
+			ID:              e.ID,
+			Title:           e.Title,
+			Description:     e.Description,
+			RepeatsEvery:    e.RepeatsEvery,
+			RepeatsScale:    e.RepeatsScale,
+			MinParticipants: nullInt(e.MinParticipants),
+			MaxParticipants: nullInt(e.MaxParticipants),
+		})
+	}
+
+	regs, err := repo.EventRegistrationsOfUser(ctx, id)
+	if err != nil {
+		return export, err
+	}
+	export.Registrations = make([]ExportEventRegistration, 0, len(regs))
+	for _, reg := range regs {
+		entry := ExportEventRegistration{
+			Event:   reg.Event,
+			Message: nullString(reg.Message),
+		}
+		// Registrations for events that were deleted meanwhile are kept,
+		// just without a title.
+		if event, err := repo.Event(ctx, reg.Event); err == nil {
+			entry.EventTitle = event.Title
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return export, err
+		}
+		export.Registrations = append(export.Registrations, entry)
+	}
+
+	export.AuditLog = []ExportAuditEntry{}
+	filter := AuditFilter{User: id, Limit: 500}
+	for {
+		entries, err := repo.AuditEntries(ctx, filter)
+		if err != nil {
+			return export, err
+		}
+		for _, e := range entries {
+			export.AuditLog = append(export.AuditLog, ExportAuditEntry{
+				Action:    e.Action,
+				Detail:    e.Detail,
+				IP:        e.IP,
+				UserAgent: e.UserAgent,
+				CreatedAt: e.CreatedAt,
+			})
+		}
+		if len(entries) < filter.Limit {
+			break
+		}
+		filter.Before = entries[len(entries)-1].ID
+	}
+
+	return export, nil
+}
+
+func nullString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullInt(i sql.NullInt64) *int64 {
+	if !i.Valid {
+		return nil
+	}
+	return &i.Int64
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,78 @@
+// Glue between the browser's WebAuthn api and the /passkey endpoints.
+// Binary fields are exchanged as unpadded base64url strings.
+
+function b64urlToBuf(str) {
+	const b64 = str.replace(/-/g, '+').replace(/_/g, '/');
+	const bin = atob(b64 + '='.repeat((4 - b64.length % 4) % 4));
+	return Uint8Array.from(bin, c => c.charCodeAt(0)).buffer;
+}
+
+function bufToB64url(buf) {
+	const bin = String.fromCharCode(...new Uint8Array(buf));
+	return btoa(bin).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+async function postJson(url, body) {
+	const resp = await fetch(url, {
+		method: 'POST',
+		headers: {'Content-Type': 'application/json'},
+		body: JSON.stringify(body),
+	});
+	if (!resp.ok) {
+		throw new Error(await resp.text());
+	}
+	if (resp.status === 204) {
+		return null;
+	}
+	return resp.json();
+}
+
+function showPasskeyError(err) {
+	const el = document.getElementById('passkey-error');
+	if (el) {
+		el.textContent = err.message;
+	}
+}
+
+async function registerPasskey(name) {
+	try {
+		const begin = await postJson('/passkey/register/begin', {});
+		const opts = begin.publicKey;
+		opts.challenge = b64urlToBuf(opts.challenge);
+		opts.user.id = b64urlToBuf(opts.user.id);
+		opts.excludeCredentials = opts.excludeCredentials.map(c => ({...c, id: b64urlToBuf(c.id)}));
+		const cred = await navigator.credentials.create({publicKey: opts});
+		await postJson('/passkey/register/finish', {
+			name: name,
+			id: bufToB64url(cred.rawId),
+			response: {
+				clientDataJSON: bufToB64url(cred.response.clientDataJSON),
+				attestationObject: bufToB64url(cred.response.attestationObject),
+			},
+		});
+		window.location.reload();
+	} catch (err) {
+		showPasskeyError(err);
+	}
+}
+
+async function loginWithPasskey() {
+	try {
+		const begin = await postJson('/passkey/login/begin', {});
+		const opts = begin.publicKey;
+		opts.challenge = b64urlToBuf(opts.challenge);
+		const cred = await navigator.credentials.get({publicKey: opts});
+		await postJson('/passkey/login/finish', {
+			id: bufToB64url(cred.rawId),
+			response: {
+				clientDataJSON: bufToB64url(cred.response.clientDataJSON),
+				authenticatorData: bufToB64url(cred.response.authenticatorData),
+				signature: bufToB64url(cred.response.signature),
+				userHandle: cred.response.userHandle ? bufToB64url(cred.response.userHandle) : '',
+			},
+		});
+		window.location = '/events';
+	} catch (err) {
+		showPasskeyError(err);
+	}
+}
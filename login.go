@@ -1,15 +1,34 @@
 package organizer
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/big"
 	"net/http"
+	"sync"
 	"time"
 )
 
 type (
+	// TokenHash is what gets stored of a token. Whoever can read the store
+	// learns nothing they could log in with.
+	TokenHash [sha256.Size]byte
+	// Token is a secret handed out to the user. Its Value is only known
+	// right after it has been created, stores keep nothing but the Hash.
 	Token struct {
 		Value   string
+		Hash    TokenHash
 		Created time.Time
 		Valid   bool
 	}
@@ -17,29 +36,94 @@ type (
 	LoginToken struct {
 		Token
 	}
-	CsrfID    string
-	CsrfToken struct {
+	// LoginCode is a short numeric alternative to the LoginToken, meant to be
+	// typed in by hand on the device that requested the login.
+	LoginCode struct {
 		Token
+		Attempts int
 	}
+	// CsrfID is a stateless token, see Authenticator.CsrfToken. There is
+	// nothing to store, so there is nothing to hash either.
+	CsrfID    string
 	SessionID string
 	Session   struct {
 		Token
 		User          UserID
 		authenticated bool
-		csrf          CsrfToken
 		login         LoginToken
+		loginCode     LoginCode
 		auth          *Authenticator
+
+		secondFactorPending  bool
+		secondFactorAttempts int
+
+		client   ClientInfo
+		lastSeen time.Time
+
+		// impersonator is the admin that started the session to view the
+		// site as User, zero for ordinary sessions.
+		impersonator UserID
+	}
+	// ClientInfo describes the device a session is used from.
+	ClientInfo struct {
+		IP        string
+		UserAgent string
 	}
 )
 
 func NewToken(value string) Token {
 	return Token{
 		Value:   value,
+		Hash:    HashToken(value),
 		Created: time.Now(),
 		Valid:   true,
 	}
 }
 
+// HashToken doesn't need to be slow, unlike password hashes: tokens are
+// random and long enough that they can't be guessed.
+func HashToken(value string) TokenHash {
+	return sha256.Sum256([]byte(value))
+}
+
+// Equal compares in constant time.
+func (h TokenHash) Equal(other TokenHash) bool {
+	return subtle.ConstantTimeCompare(h[:], other[:]) == 1
+}
+
+func (h TokenHash) IsZero() bool {
+	return h == TokenHash{}
+}
+
+// Value stores the zero hash as null, for tokens that haven't been issued.
+func (h TokenHash) Value() (driver.Value, error) {
+	if h.IsZero() {
+		return nil, nil
+	}
+	return h[:], nil
+}
+
+func (h *TokenHash) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*h = TokenHash{}
+		return nil
+	case []byte:
+		if len(src) != len(h) {
+			return fmt.Errorf("token hash: expected %d bytes, got %d", len(h), len(src))
+		}
+		copy(h[:], src)
+		return nil
+	}
+	return fmt.Errorf("token hash: cannot scan %T", src)
+}
+
+// Matches reports whether value is the token. The hash of value is
+// compared, so that the time taken doesn't depend on the token.
+func (t Token) Matches(value string) bool {
+	return !t.Hash.IsZero() && t.Hash.Equal(HashToken(value))
+}
+
 func (t Token) HasExpired(limit time.Duration) bool {
 	now := time.Now()
 	return t.Expires(limit).Compare(now) <= 0
@@ -49,24 +133,206 @@ func (t Token) Expires(limit time.Duration) time.Time {
 	return t.Created.Add(limit)
 }
 
+// SessionStore persists sessions together with their pending login
+// tokens. Sessions and logins are identified by the hashes of their tokens,
+// the token values are never handed to the store. Lookups of unknown
+// sessions must fail with sql.ErrNoRows. Implementations must be safe for
+// concurrent use.
+type SessionStore interface {
+	Session(ctx context.Context, id TokenHash) (Session, error)
+	SaveSession(ctx context.Context, session Session) error
+	DeleteSession(ctx context.Context, id TokenHash) error
+	// SessionByLogin finds the session with the given pending login token.
+	SessionByLogin(ctx context.Context, login TokenHash) (Session, error)
+	// ConsumeLogin saves a session that has just redeemed its login, but
+	// only if that login is still valid in the store. It reports whether the
+	// session was saved, so that a login can't be redeemed twice, not even
+	// by two instances sharing the store.
+	ConsumeLogin(ctx context.Context, session Session, login TokenHash) (bool, error)
+	SessionsByUser(ctx context.Context, user UserID) ([]Session, error)
+	// DeleteExpiredSessions removes all sessions created before
+	// createdBefore, as well as unauthenticated sessions whose login was
+	// requested before loginBefore.
+	DeleteExpiredSessions(ctx context.Context, createdBefore, loginBefore time.Time) (int64, error)
+	// UseChallenge records that a challenge has been answered. It reports
+	// false if it had been before.
+	UseChallenge(ctx context.Context, challenge TokenHash, expires time.Time) (bool, error)
+	// DeleteExpiredChallenges forgets the challenges that expired before
+	// before, they can't be answered anymore anyway.
+	DeleteExpiredChallenges(ctx context.Context, before time.Time) (int64, error)
+}
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost
+// when the process exits and cannot be shared between server instances.
+type MemorySessionStore struct {
+	mu         sync.Mutex
+	sessions   map[TokenHash]Session
+	byUser     map[UserID]map[TokenHash]struct{}
+	challenges map[TokenHash]time.Time
+}
+
+var _ SessionStore = (*MemorySessionStore)(nil)
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:   map[TokenHash]Session{},
+		byUser:     map[UserID]map[TokenHash]struct{}{},
+		challenges: map[TokenHash]time.Time{},
+	}
+}
+
+func (m *MemorySessionStore) Session(ctx context.Context, id TokenHash) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return Session{}, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+func (m *MemorySessionStore) SaveSession(ctx context.Context, session Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session.auth = nil
+	id := session.Hash
+	if old, ok := m.sessions[id]; ok && old.User != session.User {
+		m.unindex(old)
+	}
+	m.sessions[id] = session
+	ids, ok := m.byUser[session.User]
+	if !ok {
+		ids = map[TokenHash]struct{}{}
+		m.byUser[session.User] = ids
+	}
+	ids[id] = struct{}{}
+	return nil
+}
+
+func (m *MemorySessionStore) SessionsByUser(ctx context.Context, user UserID) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := []Session{}
+	for id := range m.byUser[user] {
+		sessions = append(sessions, m.sessions[id])
+	}
+	return sessions, nil
+}
+
+// unindex must be called with m.mu held.
+func (m *MemorySessionStore) unindex(session Session) {
+	ids := m.byUser[session.User]
+	delete(ids, session.Hash)
+	if len(ids) == 0 {
+		delete(m.byUser, session.User)
+	}
+}
+
+func (m *MemorySessionStore) SessionByLogin(ctx context.Context, login TokenHash) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, session := range m.sessions {
+		if !session.login.Hash.IsZero() && session.login.Hash.Equal(login) {
+			return session, nil
+		}
+	}
+	return Session{}, sql.ErrNoRows
+}
+
+func (m *MemorySessionStore) ConsumeLogin(ctx context.Context, session Session, login TokenHash) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.sessions[session.Hash]
+	if !ok || !old.login.Valid || !old.login.Hash.Equal(login) {
+		return false, nil
+	}
+	session.auth = nil
+	m.sessions[session.Hash] = session
+	return true, nil
+}
+
+func (m *MemorySessionStore) DeleteSession(ctx context.Context, id TokenHash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[id]; ok {
+		m.unindex(session)
+		delete(m.sessions, id)
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) DeleteExpiredSessions(ctx context.Context, createdBefore, loginBefore time.Time) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, session := range m.sessions {
+		abandoned := !session.authenticated &&
+			!session.login.Created.IsZero() &&
+			session.login.Created.Before(loginBefore)
+		if session.Created.Before(createdBefore) || abandoned {
+			m.unindex(session)
+			delete(m.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemorySessionStore) UseChallenge(ctx context.Context, challenge TokenHash, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.challenges[challenge]; ok {
+		return false, nil
+	}
+	m.challenges[challenge] = expires
+	return true, nil
+}
+
+func (m *MemorySessionStore) DeleteExpiredChallenges(ctx context.Context, before time.Time) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for challenge, expires := range m.challenges {
+		if expires.Before(before) {
+			delete(m.challenges, challenge)
+			n++
+		}
+	}
+	return n, nil
+}
+
 type (
 	Authenticator struct {
-		sessions                map[SessionID]*Session
+		// sessionLocks serialize read-modify-write cycles on the same
+		// session, the store only guarantees atomicity of single calls.
+		sessionLocks            [64]sync.Mutex
+		store                   SessionStore
+		secret                  []byte
 		tokenLength             int
 		loginTokenExpiryLimit   time.Duration
 		sessionTokenExpiryLimit time.Duration
 		csrfTokenExpiryLimit    time.Duration
+		loginCodeExpiryLimit    time.Duration
+		loginCodeAttempts       int
+		secondFactorAttempts    int
+		oidc                    *OidcProvider
+		// impersonationExpiryLimit is kept short, admins shouldn't forget
+		// they are looking through someone else's eyes.
+		impersonationExpiryLimit time.Duration
 	}
 	AuthOpt func(*Authenticator)
 )
 
 func NewAuthenticator(opts ...AuthOpt) *Authenticator {
 	auth := &Authenticator{
-		sessions:                map[SessionID]*Session{},
-		tokenLength:             50,
-		loginTokenExpiryLimit:   10 * time.Minute,
-		sessionTokenExpiryLimit: time.Hour * 24 * 7,
-		csrfTokenExpiryLimit:    10 * time.Minute,
+		store:                    NewMemorySessionStore(),
+		secret:                   randomSecret(),
+		tokenLength:              50,
+		loginTokenExpiryLimit:    10 * time.Minute,
+		sessionTokenExpiryLimit:  time.Hour * 24 * 7,
+		csrfTokenExpiryLimit:     12 * time.Hour,
+		loginCodeExpiryLimit:     5 * time.Minute,
+		loginCodeAttempts:        5,
+		secondFactorAttempts:     5,
+		impersonationExpiryLimit: time.Hour,
 	}
 	for _, opt := range opts {
 		opt(auth)
@@ -74,6 +340,22 @@ func NewAuthenticator(opts ...AuthOpt) *Authenticator {
 	return auth
 }
 
+func WithSessionStore(store SessionStore) AuthOpt {
+	return func(a *Authenticator) {
+		a.store = store
+	}
+}
+
+// WithSecret sets the key used to sign stateless tokens, like csrf tokens
+// and the challenges of passkey ceremonies. Instances sharing a session
+// store should share the secret too. The random key used by default is only
+// good for tests, tokens signed with it stop working on restart.
+func WithSecret(secret []byte) AuthOpt {
+	return func(a *Authenticator) {
+		a.secret = secret
+	}
+}
+
 func WithTokenLength(length int) AuthOpt {
 	return func(a *Authenticator) {
 		a.tokenLength = length
@@ -98,53 +380,424 @@ func WithCsrfTokenExpiryLimit(d time.Duration) AuthOpt {
 	}
 }
 
-func (a *Authenticator) SessionFromRequest(r *http.Request) (*Session, bool) {
+func WithLoginCodeExpiryLimit(d time.Duration) AuthOpt {
+	return func(a *Authenticator) {
+		a.loginCodeExpiryLimit = d
+	}
+}
+
+// WithLoginCodeAttempts sets how many wrong login codes may be entered
+// before the code stops working.
+func WithLoginCodeAttempts(n int) AuthOpt {
+	return func(a *Authenticator) {
+		a.loginCodeAttempts = n
+	}
+}
+
+// WithSecondFactorAttempts sets how many wrong second factor codes may be
+// entered before the session is thrown away.
+func WithSecondFactorAttempts(n int) AuthOpt {
+	return func(a *Authenticator) {
+		a.secondFactorAttempts = n
+	}
+}
+
+func WithImpersonationExpiryLimit(d time.Duration) AuthOpt {
+	return func(a *Authenticator) {
+		a.impersonationExpiryLimit = d
+	}
+}
+
+// WithOidcProvider lets users log in with an OpenID Connect provider, in
+// addition to login links.
+func WithOidcProvider(p *OidcProvider) AuthOpt {
+	return func(a *Authenticator) {
+		a.oidc = p
+	}
+}
+
+// SessionFromRequest looks up the session of the cookie sent along with r.
+// Like SessionByID, it only fails if the store does, a missing or expired
+// session is reported as not ok.
+func (a *Authenticator) SessionFromRequest(r *http.Request) (*Session, bool, error) {
 	sessionCookie, err := r.Cookie("session")
 	if err != nil {
-		return nil, false
+		return nil, false, nil
 	}
-	id := SessionID(sessionCookie.Value)
-	session, ok := a.SessionByID(id)
-	return session, ok
+	return a.SessionByID(r.Context(), SessionID(sessionCookie.Value))
 }
 
-func (a *Authenticator) SessionByID(id SessionID) (*Session, bool) {
-	t, ok := a.sessions[id]
-	if !ok {
-		return nil, false
+func (a *Authenticator) SessionByID(ctx context.Context, id SessionID) (*Session, bool, error) {
+	hash := HashToken(string(id))
+	t, err := a.store.Session(ctx, hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("load session: %w", err)
 	}
 	if t.HasExpired(a.sessionTokenExpiryLimit) {
-		delete(a.sessions, id)
-		return nil, false
+		if err := a.store.DeleteSession(ctx, hash); err != nil {
+			return nil, false, fmt.Errorf("delete expired session: %w", err)
+		}
+		return nil, false, nil
 	}
-	return t, true
+	t.auth = a
+	return &t, true, nil
 }
 
-func (a *Authenticator) CreateSession(u UserID) (*Session, error) {
+// SessionByLogin finds the session that is waiting for login to be
+// redeemed, so that the login can be approved from a different device.
+func (a *Authenticator) SessionByLogin(ctx context.Context, login LoginID) (*Session, bool, error) {
+	t, err := a.store.SessionByLogin(ctx, HashToken(string(login)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("load session by login: %w", err)
+	}
+	t.auth = a
+	if !t.IsLoginRequest(login) {
+		return nil, false, nil
+	}
+	return &t, true, nil
+}
+
+func (a *Authenticator) CreateSession(ctx context.Context, u UserID, client ClientInfo) (*Session, error) {
 	tokenStr, err := randomToken(a.tokenLength)
 	if err != nil {
 		return nil, err
 	}
-	token := a.createSessionWithID(u, SessionID(tokenStr))
-	return token, nil
+	return a.createSessionWithID(ctx, u, SessionID(tokenStr), client)
 }
 
-func (a *Authenticator) createSessionWithID(u UserID, sessionID SessionID) *Session {
+func (a *Authenticator) createSessionWithID(ctx context.Context, u UserID, sessionID SessionID, client ClientInfo) (*Session, error) {
 	token := &Session{
 		Token:         NewToken(string(sessionID)),
 		User:          u,
 		authenticated: false,
 		auth:          a,
+		client:        client,
+	}
+	token.lastSeen = token.Created
+	if err := token.save(ctx); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// CreateAuthenticatedSession starts a session for a user that has already
+// proven their identity by other means than a login link.
+func (a *Authenticator) CreateAuthenticatedSession(ctx context.Context, u UserID, client ClientInfo) (*Session, error) {
+	session, err := a.CreateSession(ctx, u, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.Authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Impersonate starts an authenticated session for user u on behalf of
+// admin, so that they can view the site as u does.
+func (a *Authenticator) Impersonate(ctx context.Context, u, admin UserID, client ClientInfo) (*Session, error) {
+	session, err := a.CreateSession(ctx, u, client)
+	if err != nil {
+		return nil, err
+	}
+	_, err = session.update(ctx, func(s *Session) bool {
+		s.authenticated = true
+		s.impersonator = admin
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// TokenSession stands in for a session on requests authenticated with a
+// personal api token. It is never stored, so it can't be used to hold login
+// or second factor state.
+func (a *Authenticator) TokenSession(u UserID) *Session {
+	return &Session{
+		Token:         Token{Created: time.Now(), Valid: true},
+		User:          u,
+		authenticated: true,
+		auth:          a,
+	}
+}
+
+// SessionsOfUser lists all sessions of a user that haven't expired yet,
+// including ones that are still waiting for their login.
+func (a *Authenticator) SessionsOfUser(ctx context.Context, u UserID) ([]*Session, error) {
+	stored, err := a.store.SessionsByUser(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*Session, 0, len(stored))
+	for i := range stored {
+		if stored[i].HasExpired(a.sessionTokenExpiryLimit) {
+			continue
+		}
+		stored[i].auth = a
+		sessions = append(sessions, &stored[i])
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends the session of user u identified by handle, see
+// Session.Handle. It reports false if there is no such session.
+func (a *Authenticator) RevokeSession(ctx context.Context, u UserID, handle string) (bool, error) {
+	sessions, err := a.SessionsOfUser(ctx, u)
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		if hmac.Equal([]byte(session.Handle()), []byte(handle)) {
+			return true, session.Delete(ctx)
+		}
+	}
+	return false, nil
+}
+
+// RevokeAllSessions ends all sessions of user u, e.g. after the account has
+// been taken over.
+func (a *Authenticator) RevokeAllSessions(ctx context.Context, u UserID) error {
+	sessions, err := a.SessionsOfUser(ctx, u)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := session.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeOtherSessions ends all sessions of the user except current.
+func (a *Authenticator) RevokeOtherSessions(ctx context.Context, current *Session) error {
+	sessions, err := a.SessionsOfUser(ctx, current.User)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Hash == current.Hash {
+			continue
+		}
+		if err := session.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewChallenge creates a random challenge that is only valid for the given
+// purpose and expires after the login token expiry limit. Challenges are
+// signed instead of stored, so that they can also be handed out to visitors
+// without a session.
+func (a *Authenticator) NewChallenge(purpose string) ([]byte, error) {
+	challenge := make([]byte, 32+8, 32+8+sha256.Size)
+	if _, err := rand.Read(challenge[:32]); err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(a.loginTokenExpiryLimit).Unix()
+	binary.BigEndian.PutUint64(challenge[32:], uint64(expires))
+	return append(challenge, a.sign(purpose, challenge)...), nil
+}
+
+// VerifyChallenge reports whether challenge was created by NewChallenge for
+// the same purpose and has not expired yet.
+func (a *Authenticator) VerifyChallenge(challenge []byte, purpose string) bool {
+	if len(challenge) != 32+8+sha256.Size {
+		return false
+	}
+	payload, mac := challenge[:32+8], challenge[32+8:]
+	if !hmac.Equal(mac, a.sign(purpose, payload)) {
+		return false
+	}
+	expires := int64(binary.BigEndian.Uint64(payload[32:]))
+	return time.Now().Unix() < expires
+}
+
+// ConsumeChallenge is like VerifyChallenge, but accepts every challenge only
+// once. Use it wherever a replayed response would be as good as the
+// original, a signed challenge alone can be answered until it expires.
+func (a *Authenticator) ConsumeChallenge(ctx context.Context, challenge []byte, purpose string) (bool, error) {
+	if !a.VerifyChallenge(challenge, purpose) {
+		return false, nil
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(challenge[32:32+8])), 0)
+	return a.store.UseChallenge(ctx, HashToken(string(challenge)), expires)
+}
+
+// CsrfToken creates a token bound to the session with the given hash.
+// Tokens aren't stored, they are valid until they expire or the session
+// ends.
+func (a *Authenticator) CsrfToken(session TokenHash) CsrfID {
+	payload := make([]byte, 8, 8+sha256.Size)
+	expires := time.Now().Add(a.csrfTokenExpiryLimit).Unix()
+	binary.BigEndian.PutUint64(payload, uint64(expires))
+	mac := a.sign("csrf", append(session[:], payload...))
+	return CsrfID(base64.RawURLEncoding.EncodeToString(append(payload, mac...)))
+}
+
+func (a *Authenticator) VerifyCsrf(session TokenHash, token CsrfID) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(string(token))
+	if err != nil || len(raw) != 8+sha256.Size {
+		return false
+	}
+	payload, mac := raw[:8], raw[8:]
+	if !hmac.Equal(mac, a.sign("csrf", append(session[:], payload...))) {
+		return false
+	}
+	expires := int64(binary.BigEndian.Uint64(payload))
+	return time.Now().Unix() < expires
+}
+
+func (a *Authenticator) sign(purpose string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (a *Authenticator) lockFor(id TokenHash) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(id[:])
+	return &a.sessionLocks[h.Sum32()%uint32(len(a.sessionLocks))]
+}
+
+// Sweep evicts expired sessions, sessions of login requests that have never
+// been completed, and used challenges that have expired.
+func (a *Authenticator) Sweep(ctx context.Context) (int64, error) {
+	now := time.Now()
+	sessions, err := a.store.DeleteExpiredSessions(
+		ctx,
+		now.Add(-a.sessionTokenExpiryLimit),
+		now.Add(-a.loginTokenExpiryLimit),
+	)
+	if err != nil {
+		return sessions, err
+	}
+	challenges, err := a.store.DeleteExpiredChallenges(ctx, now)
+	return sessions + challenges, err
+}
+
+// RunSweeper calls Sweep every interval until ctx is cancelled.
+func (a *Authenticator) RunSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := a.Sweep(ctx)
+			if err != nil {
+				slog.Error("failed to sweep expired sessions", "error", err)
+			} else if n > 0 {
+				slog.Info("swept expired sessions and challenges", "count", n)
+			}
+		}
 	}
-	a.sessions[sessionID] = token
-	return token
+}
+
+// Handle identifies the session without revealing its id, which would be
+// enough to take over the session.
+func (s *Session) Handle() string {
+	mac := s.auth.sign("session-handle", s.Hash[:])
+	return base64.RawURLEncoding.EncodeToString(mac[:16])
+}
+
+func (s *Session) Client() ClientInfo {
+	return s.client
+}
+
+func (s *Session) LastSeen() time.Time {
+	return s.lastSeen
+}
+
+// Touch records activity on the session. To spare the store a write on
+// every request, the time of last activity is only kept to the minute.
+func (s *Session) Touch(ctx context.Context, client ClientInfo) error {
+	if time.Since(s.lastSeen) < time.Minute && client == s.client {
+		return nil
+	}
+	_, err := s.update(ctx, func(s *Session) bool {
+		s.lastSeen = time.Now()
+		s.client = client
+		return true
+	})
+	return err
 }
 
 func (s *Session) IsAuthenticated() bool {
-	return s.authenticated && s.Valid && !s.HasExpired(s.auth.sessionTokenExpiryLimit)
+	if s.impersonator != 0 && s.HasExpired(s.auth.impersonationExpiryLimit) {
+		return false
+	}
+	return s.authenticated && !s.secondFactorPending && s.Valid && !s.HasExpired(s.auth.sessionTokenExpiryLimit)
+}
+
+// Impersonator returns the admin viewing the site through this session, or
+// zero.
+func (s *Session) Impersonator() UserID {
+	return s.impersonator
+}
+
+// HasPendingSecondFactor reports whether the first factor has succeeded, but
+// the session is still waiting for a second factor code.
+func (s *Session) HasPendingSecondFactor() bool {
+	return s.authenticated && s.secondFactorPending && s.Valid && !s.HasExpired(s.auth.sessionTokenExpiryLimit)
 }
 
-func (s *Session) RequestLogin() (LoginToken, error) {
+// RequireSecondFactor must be called before InvalidateLogin, so that there
+// is no moment where the session counts as authenticated. Sessions that are
+// already past the first factor are left alone.
+func (s *Session) RequireSecondFactor(ctx context.Context) error {
+	_, err := s.update(ctx, func(s *Session) bool {
+		if s.authenticated {
+			return false
+		}
+		s.secondFactorPending = true
+		s.secondFactorAttempts = 0
+		return true
+	})
+	return err
+}
+
+func (s *Session) CompleteSecondFactor(ctx context.Context) error {
+	_, err := s.update(ctx, func(s *Session) bool {
+		if !s.secondFactorPending {
+			return false
+		}
+		s.secondFactorPending = false
+		return true
+	})
+	return err
+}
+
+// FailSecondFactor counts a wrong code. Once the attempts are used up the
+// session is deleted, and the login has to be started over.
+func (s *Session) FailSecondFactor(ctx context.Context) (attemptsLeft int, err error) {
+	_, err = s.update(ctx, func(s *Session) bool {
+		s.secondFactorAttempts++
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	attemptsLeft = s.auth.secondFactorAttempts - s.secondFactorAttempts
+	if attemptsLeft <= 0 {
+		return 0, s.Delete(ctx)
+	}
+	return attemptsLeft, nil
+}
+
+func (s *Session) RequestLogin(ctx context.Context) (LoginToken, error) {
 	tokenStr, err := randomToken(s.auth.tokenLength)
 	if err != nil {
 		return LoginToken{}, err
@@ -152,8 +805,14 @@ func (s *Session) RequestLogin() (LoginToken, error) {
 	token := LoginToken{
 		Token: NewToken(tokenStr),
 	}
-	s.login = token
-	s.authenticated = false
+	_, err = s.update(ctx, func(s *Session) bool {
+		s.login = token
+		s.authenticated = false
+		return true
+	})
+	if err != nil {
+		return LoginToken{}, err
+	}
 	return token, nil
 }
 
@@ -161,52 +820,175 @@ func (s *Session) HasValidLoginRequest() bool {
 	return s.login.Valid && !s.login.HasExpired(s.auth.loginTokenExpiryLimit)
 }
 
-func (s *Session) InvalidateLogin(login LoginID) bool {
-	if !s.login.Valid {
-		return false
+// IsLoginRequest reports whether login is the pending login of this session.
+func (s *Session) IsLoginRequest(login LoginID) bool {
+	return s.HasValidLoginRequest() && s.login.Matches(string(login))
+}
+
+// RequestLoginCode must be called after RequestLogin, the code is valid for
+// the same login request.
+func (s *Session) RequestLoginCode(ctx context.Context) (LoginCode, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return LoginCode{}, err
 	}
-	if s.login.HasExpired(s.auth.loginTokenExpiryLimit) {
-		return false
+	code := LoginCode{
+		Token: NewToken(fmt.Sprintf("%06d", n.Int64())),
 	}
-	if string(login) != s.login.Value {
-		return false
+	_, err = s.update(ctx, func(s *Session) bool {
+		s.loginCode = code
+		return true
+	})
+	if err != nil {
+		return LoginCode{}, err
 	}
-	s.login.Valid = false
-	s.authenticated = true
-	return true
+	return code, nil
 }
 
-func (s *Session) RequestCsrf() (CsrfToken, error) {
-	//if s.csrf.Valid && !s.crsf.HasExpired(s.auth.csrfTokenExpiryLimit) {
-	//	return s.csrf
-	//}
-	tokenStr, err := randomToken(s.auth.tokenLength)
+// InvalidateLoginCode redeems the login using the numeric code instead of
+// the login token. Every wrong guess uses up an attempt, once all attempts
+// are used up the code stops working, but the login link stays valid. If
+// secondFactor is set, a right code leaves the session waiting for the
+// second factor.
+func (s *Session) InvalidateLoginCode(ctx context.Context, code string, secondFactor bool) (bool, error) {
+	ok, err := s.update(ctx, func(s *Session) bool {
+		if !s.loginCode.Valid || !s.HasValidLoginRequest() {
+			return false
+		}
+		if s.loginCode.HasExpired(s.auth.loginCodeExpiryLimit) {
+			return false
+		}
+		if !s.loginCode.Matches(code) {
+			s.loginCode.Attempts++
+			if s.loginCode.Attempts >= s.auth.loginCodeAttempts {
+				s.loginCode.Valid = false
+			}
+			return true
+		}
+		s.loginCode.Valid = false
+		s.login.Valid = false
+		s.authenticated = true
+		if secondFactor {
+			s.secondFactorPending = true
+			s.secondFactorAttempts = 0
+		}
+		return true
+	})
 	if err != nil {
-		return CsrfToken{}, err
-	}
-	token := CsrfToken{
-		Token: NewToken(tokenStr),
+		return false, fmt.Errorf("redeem login code: %w", err)
 	}
-	s.csrf = token
-	return token, nil
+	return ok && s.authenticated, nil
 }
 
-func (s *Session) InvalidateCsrf(csrf CsrfID) bool {
-	if !s.csrf.Valid {
-		return false
+func (s *Session) InvalidateLogin(ctx context.Context, login LoginID) (bool, error) {
+	ok, err := s.update(ctx, func(s *Session) bool {
+		if !s.login.Valid {
+			return false
+		}
+		if s.login.HasExpired(s.auth.loginTokenExpiryLimit) {
+			return false
+		}
+		if !s.login.Matches(string(login)) {
+			return false
+		}
+		s.login.Valid = false
+		s.loginCode.Valid = false
+		s.authenticated = true
+		return true
+	})
+	if err != nil {
+		return false, fmt.Errorf("redeem login: %w", err)
 	}
-	if s.csrf.HasExpired(s.auth.csrfTokenExpiryLimit) {
-		return false
+	return ok, nil
+}
+
+// Authenticate marks the session as logged in, for logins that don't go
+// through a login token. Like with InvalidateLogin, RequireSecondFactor must
+// be called before, if needed.
+func (s *Session) Authenticate(ctx context.Context) error {
+	_, err := s.update(ctx, func(s *Session) bool {
+		s.authenticated = true
+		return true
+	})
+	return err
+}
+
+// CsrfToken returns a token to embed in the forms of the session. Any number
+// of tokens is valid at the same time, so that forms keep working when
+// several pages are open.
+func (s *Session) CsrfToken() CsrfID {
+	return s.auth.CsrfToken(s.Hash)
+}
+
+func (s *Session) VerifyCsrf(token CsrfID) bool {
+	return s.auth.VerifyCsrf(s.Hash, token)
+}
+
+func (s *Session) Delete(ctx context.Context) error {
+	lock := s.auth.lockFor(s.Hash)
+	lock.Lock()
+	defer lock.Unlock()
+	return s.auth.store.DeleteSession(ctx, s.Hash)
+}
+
+// stored is the session as it is handed to the store, without any token
+// values.
+func (s *Session) stored() Session {
+	stored := *s
+	stored.Token.Value = ""
+	stored.login.Value = ""
+	stored.loginCode.Value = ""
+	return stored
+}
+
+func (s *Session) save(ctx context.Context) error {
+	return s.auth.store.SaveSession(ctx, s.stored())
+}
+
+// update applies fn to the latest stored state of the session and saves it
+// if fn reports a change. Concurrent updates of the same session are
+// serialized. If fn redeems the login, the store only accepts the change if
+// nobody else has redeemed it in the meantime, the lock alone doesn't help
+// against other instances sharing the store.
+func (s *Session) update(ctx context.Context, fn func(*Session) bool) (bool, error) {
+	lock := s.auth.lockFor(s.Hash)
+	lock.Lock()
+	defer lock.Unlock()
+	fresh, err := s.auth.store.Session(ctx, s.Hash)
+	if err != nil {
+		return false, err
 	}
-	if string(csrf) != s.csrf.Value {
-		return false
+	fresh.auth = s.auth
+	login := fresh.login
+	changed := fn(&fresh)
+	switch {
+	case !changed:
+	case login.Valid && !fresh.login.Valid:
+		consumed, err := s.auth.store.ConsumeLogin(ctx, fresh.stored(), login.Hash)
+		if err != nil {
+			return false, err
+		}
+		if !consumed {
+			return false, nil
+		}
+	default:
+		if err := fresh.save(ctx); err != nil {
+			return false, err
+		}
 	}
-	s.csrf.Valid = false
-	return true
+	// The store doesn't know the value, but whoever holds s might still
+	// need it for the cookie.
+	fresh.Value = s.Value
+	*s = fresh
+	return changed, nil
 }
 
-func (s *Session) Delete() {
-	delete(s.auth.sessions, SessionID(s.Token.Value))
+func randomSecret() []byte {
+	bs := make([]byte, 32)
+	if _, err := rand.Read(bs); err != nil {
+		panic(err)
+	}
+	return bs
 }
 
 func randomToken(length int) (string, error) {
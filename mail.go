@@ -4,13 +4,29 @@ import (
 	"bytes"
 	"fmt"
 	"gopkg.in/gomail.v2"
+	"slices"
+	"sync"
 	"text/template"
 )
 
-var tmplLoginLink = template.Must(template.New("LoginLink").Parse(loginLinkBody))
+var (
+	tmplLoginLink        = template.Must(template.New("LoginLink").Parse(loginLinkBody))
+	tmplVerificationLink = template.Must(template.New("VerificationLink").Parse(verificationLinkBody))
+	tmplSignupLink       = template.Must(template.New("SignupLink").Parse(signupLinkBody))
+	tmplEmailChange      = template.Must(template.New("EmailChange").Parse(emailChangeBody))
+	tmplEmailChanged     = template.Must(template.New("EmailChanged").Parse(emailChangedBody))
+)
 
 type (
-	Mailer struct {
+	Mailer interface {
+		SendLoginLink(email string, login LoginMail) error
+		SendVerificationLink(email string, login LoginMail) error
+		SendSignupLink(email string, link SignupLink) error
+		SendEmailChange(email string, change EmailChangeMail) error
+		SendEmailChanged(email string, change EmailChangeMail) error
+	}
+	// SmtpMailer delivers mails through an SMTP server.
+	SmtpMailer struct {
 		Dialer     *gomail.Dialer
 		ThisSender string
 	}
@@ -34,22 +50,57 @@ func (tl TokenLink) String() string {
 	return fmt.Sprintf("%sauth?token=%s", tl.Where, tl.Token)
 }
 
-func NewMailer(cfg MailConfig) *Mailer {
+// LoginMail offers two ways to redeem a login: the link, or the code that
+// can be typed into the browser that requested the login.
+type LoginMail struct {
+	Link TokenLink
+	Code string
+}
+
+type SignupLink struct {
+	Where Url
+}
+
+func (sl SignupLink) String() string {
+	return fmt.Sprintf("%ssignup", sl.Where)
+}
+
+// EmailChangeLink points to either the confirmation or the undo of an email
+// change.
+type EmailChangeLink struct {
+	Token  string
+	Where  Url
+	Action string // confirm or undo
+}
+
+func (l EmailChangeLink) String() string {
+	return fmt.Sprintf("%semail/%s?token=%s", l.Where, l.Action, l.Token)
+}
+
+type EmailChangeMail struct {
+	Link     EmailChangeLink
+	OldEmail string
+	NewEmail string
+}
+
+var _ Mailer = (*SmtpMailer)(nil)
+
+func NewMailer(cfg MailConfig) *SmtpMailer {
 	d := gomail.NewDialer(cfg.Host, cfg.Port, cfg.Username, cfg.Password)
-	return &Mailer{
+	return &SmtpMailer{
 		Dialer:     d,
 		ThisSender: cfg.ThisSender,
 	}
 }
 
-func (m *Mailer) SendLoginLink(email string, token TokenLink) error {
+func (m *SmtpMailer) SendLoginLink(email string, login LoginMail) error {
 	msg := gomail.NewMessage()
 	msg.SetHeader("From", m.ThisSender)
 	msg.SetHeader("To", email)
 	msg.SetHeader("Subject", "Login to organizer")
 
 	buf := &bytes.Buffer{}
-	tmplLoginLink.Execute(buf, token)
+	tmplLoginLink.Execute(buf, login)
 
 	msg.SetBody("text/plain", buf.String())
 
@@ -60,13 +111,185 @@ func (m *Mailer) SendLoginLink(email string, token TokenLink) error {
 	return nil
 }
 
+func (m *SmtpMailer) SendVerificationLink(email string, login LoginMail) error {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", m.ThisSender)
+	msg.SetHeader("To", email)
+	msg.SetHeader("Subject", "Verify your organizer account")
+
+	buf := &bytes.Buffer{}
+	tmplVerificationLink.Execute(buf, login)
+
+	msg.SetBody("text/plain", buf.String())
+
+	return m.Dialer.DialAndSend(msg)
+}
+
+// SendSignupLink is sent instead of a login link when somebody tries to
+// login with an address that has no account.
+func (m *SmtpMailer) SendSignupLink(email string, link SignupLink) error {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", m.ThisSender)
+	msg.SetHeader("To", email)
+	msg.SetHeader("Subject", "Login to organizer")
+
+	buf := &bytes.Buffer{}
+	tmplSignupLink.Execute(buf, link)
+
+	msg.SetBody("text/plain", buf.String())
+
+	return m.Dialer.DialAndSend(msg)
+}
+
+// SendEmailChange asks the new address to confirm that it belongs to the
+// user.
+func (m *SmtpMailer) SendEmailChange(email string, change EmailChangeMail) error {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", m.ThisSender)
+	msg.SetHeader("To", email)
+	msg.SetHeader("Subject", "Confirm your new organizer email")
+
+	buf := &bytes.Buffer{}
+	tmplEmailChange.Execute(buf, change)
+
+	msg.SetBody("text/plain", buf.String())
+
+	return m.Dialer.DialAndSend(msg)
+}
+
+// SendEmailChanged tells the old address about the change, with a link to
+// undo it.
+func (m *SmtpMailer) SendEmailChanged(email string, change EmailChangeMail) error {
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", m.ThisSender)
+	msg.SetHeader("To", email)
+	msg.SetHeader("Subject", "Your organizer email has been changed")
+
+	buf := &bytes.Buffer{}
+	tmplEmailChanged.Execute(buf, change)
+
+	msg.SetBody("text/plain", buf.String())
+
+	return m.Dialer.DialAndSend(msg)
+}
+
+// MemoryMailer keeps mails instead of sending them, so that tests can follow
+// the links in them.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []SentMail
+}
+
+// SentMail is a mail kept by MemoryMailer. Kind is the name of its template,
+// Data what it was rendered from: a LoginMail, SignupLink or EmailChangeMail.
+type SentMail struct {
+	To   string
+	Kind string
+	Body string
+	Data any
+}
+
+var _ Mailer = (*MemoryMailer)(nil)
+
+func (m *MemoryMailer) SendLoginLink(email string, login LoginMail) error {
+	return m.keep(email, tmplLoginLink, login)
+}
+
+func (m *MemoryMailer) SendVerificationLink(email string, login LoginMail) error {
+	return m.keep(email, tmplVerificationLink, login)
+}
+
+func (m *MemoryMailer) SendSignupLink(email string, link SignupLink) error {
+	return m.keep(email, tmplSignupLink, link)
+}
+
+func (m *MemoryMailer) SendEmailChange(email string, change EmailChangeMail) error {
+	return m.keep(email, tmplEmailChange, change)
+}
+
+func (m *MemoryMailer) SendEmailChanged(email string, change EmailChangeMail) error {
+	return m.keep(email, tmplEmailChanged, change)
+}
+
+func (m *MemoryMailer) keep(email string, tmpl *template.Template, data any) error {
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, SentMail{
+		To:   email,
+		Kind: tmpl.Name(),
+		Body: buf.String(),
+		Data: data,
+	})
+	return nil
+}
+
+// Sent returns all mails sent so far, oldest first.
+func (m *MemoryMailer) Sent() []SentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.sent)
+}
+
 const loginLinkBody = `
 Login requested
 
 Somebody has requested to login using your email.
 If that wasn't you, you can ignore this email.
 
-Use the following link {{.}} to sign in.
+Use the following link {{.Link}} to sign in.
+
+Alternatively, enter the code {{.Code}} in the browser you requested the
+login from. The code expires after 5 minutes.
 
 This link is single-use only and will expire after 10 minutes.
 `
+
+const verificationLinkBody = `
+Verify your account
+
+Somebody has signed up to organizer using your email.
+If that wasn't you, you can ignore this email.
+
+Use the following link {{.Link}} to activate your account and sign in.
+
+Alternatively, enter the code {{.Code}} in the browser you signed up from.
+The code expires after 5 minutes.
+
+This link is single-use only and will expire after 10 minutes.
+`
+
+const signupLinkBody = `
+Login requested
+
+Somebody has requested to login using your email, but there is no account
+registered to this address.
+If that wasn't you, you can ignore this email.
+
+You can create an account at {{.}}.
+`
+
+const emailChangeBody = `
+Confirm your new email
+
+Somebody has requested to change the email of their organizer account
+from {{.OldEmail}} to this address.
+If that wasn't you, you can ignore this email.
+
+Use the following link {{.Link}} to confirm the change.
+
+This link is single-use only and will expire after 24 hours.
+`
+
+const emailChangedBody = `
+Your email has been changed
+
+The email of your organizer account has been changed from this address to
+{{.NewEmail}}.
+
+If that wasn't you, use the following link {{.Link}} within the next 14 days
+to restore this address. All devices will be logged out.
+`
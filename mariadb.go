@@ -1,16 +1,28 @@
 package organizer
 
 import (
+	"context"
 	"errors"
 	"database/sql"
+	"math"
+	"strings"
+	"time"
 )
 
 type MariaDB struct {
 	db       *sql.DB
+	dialect  Dialect
+	// queryTimeout bounds every call, unless the caller's context ends
+	// earlier. Zero means DefaultQueryTimeout.
+	queryTimeout time.Duration
 	StmtUser *sql.Stmt
 	StmtUserByEmail *sql.Stmt
+	StmtCreateUser *sql.Stmt
+	StmtActivateUser *sql.Stmt
 	StmtEvent *sql.Stmt
-	StmtEvents *sql.Stmt
+	StmtEventsOldest *sql.Stmt
+	StmtEventsNewest *sql.Stmt
+	StmtEventsByTitle *sql.Stmt
 	StmtCreateEvent *sql.Stmt
 	StmtRegisterEvent *sql.Stmt
 	StmtReregisterEvent *sql.Stmt
@@ -18,16 +30,71 @@ type MariaDB struct {
 	StmtEventRegistrations *sql.Stmt
 	StmtEventRegistration *sql.Stmt
 	StmtEventRegistration2 *sql.Stmt
+	StmtSession *sql.Stmt
+	StmtSessionByLogin *sql.Stmt
+	StmtSessionsByUser *sql.Stmt
+	StmtSaveSession *sql.Stmt
+	StmtConsumeLogin *sql.Stmt
+	StmtDeleteSession *sql.Stmt
+	StmtDeleteExpiredSessions *sql.Stmt
+	StmtUseChallenge *sql.Stmt
+	StmtDeleteExpiredChallenges *sql.Stmt
+	StmtPasskeys *sql.Stmt
+	StmtPasskeyByCredentialID *sql.Stmt
+	StmtCreatePasskey *sql.Stmt
+	StmtUpdatePasskeySignCount *sql.Stmt
+	StmtDeletePasskey *sql.Stmt
+	StmtTotpSecret *sql.Stmt
+	StmtSaveTotpSecret *sql.Stmt
+	StmtConfirmTotpSecret *sql.Stmt
+	StmtUseTotpStep *sql.Stmt
+	StmtDeleteTotpSecret *sql.Stmt
+	StmtDeleteRecoveryCodes *sql.Stmt
+	StmtCreateRecoveryCode *sql.Stmt
+	StmtUseRecoveryCode *sql.Stmt
+	StmtUsers *sql.Stmt
+	StmtSetUserRole *sql.Stmt
+	StmtSetUserDisabled *sql.Stmt
+	StmtApiTokens *sql.Stmt
+	StmtApiTokenByHash *sql.Stmt
+	StmtCreateApiToken *sql.Stmt
+	StmtTouchApiToken *sql.Stmt
+	StmtDeleteApiToken *sql.Stmt
+	StmtCreateEmailChange *sql.Stmt
+	StmtEmailChangeByConfirmHash *sql.Stmt
+	StmtEmailChangeByUndoHash *sql.Stmt
+	StmtConfirmEmailChange *sql.Stmt
+	StmtUndoEmailChanges *sql.Stmt
+	StmtChangeUserEmail *sql.Stmt
+	StmtRestoreUserEmail *sql.Stmt
+	StmtEventsCreatedBy *sql.Stmt
+	StmtEventRegistrationsOfUser *sql.Stmt
+	StmtEmailChanges *sql.Stmt
+	StmtAnonymizeUser *sql.Stmt
+	StmtDeleteEventsCreatedBy *sql.Stmt
+	StmtDeleteRegistrationsOfUser *sql.Stmt
+	StmtDeletePasskeys *sql.Stmt
+	StmtDeleteApiTokens *sql.Stmt
+	StmtDeleteEmailChanges *sql.Stmt
+	StmtAppendAuditEntry *sql.Stmt
+	StmtAuditEntries *sql.Stmt
+	StmtEventExists *sql.Stmt
+	StmtDeleteEvent *sql.Stmt
+	StmtDeletedEvents *sql.Stmt
+	StmtRestoreEvent *sql.Stmt
+	StmtDeletedEventRegistrations *sql.Stmt
+	StmtRestoreEventRegistration *sql.Stmt
+	StmtPurgeEventRegistrations *sql.Stmt
+	StmtPurgeEvents *sql.Stmt
 }
 
 var _ Repository = (*MariaDB)(nil)
 
-// @todo: how to handle rows marked as deleted?
 func (m *MariaDB) Prepare(db *sql.DB) error {
 	m.db = db
 
 	{
-		stmt, err := db.Prepare("select id, name, display, email, icon from users where id = ? limit 1;")
+		stmt, err := m.prepare(db, "select id, name, display, email, icon, activated_at, role, disabled_at from users where id = ? and deleted_at is null limit 1;")
 		if err != nil {
 			return err
 		}
@@ -35,7 +102,7 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 	}
 
 	{
-		stmt, err := db.Prepare("select id, name, display, email, icon from users where email = ? limit 1;")
+		stmt, err := m.prepare(db, "select id, name, display, email, icon, activated_at, role, disabled_at from users where email = ? and deleted_at is null limit 1;")
 		if err != nil {
 			return err
 		}
@@ -43,7 +110,29 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 	}
 
 	{
-		stmt, err := db.Prepare(
+		stmt, err := m.prepare(db, m.returningID("insert into users (name, display, email, icon, role) values (?, ?, ?, ?, ?);"))
+		if err != nil {
+			return err
+		}
+		m.StmtCreateUser = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`update users
+			set
+				activated_at = current_timestamp,
+				changed_at = current_timestamp
+			where
+				id = ? and activated_at is null and deleted_at is null;`)
+		if err != nil {
+			return err
+		}
+		m.StmtActivateUser = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
 			`select
 				events.id,
 				events.created_by,
@@ -64,18 +153,21 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 					count(*) as number_of_participants
 				from
 					event_subscriptions
-					group by event_id)
+				where
+					deleted_at is null
+				group by event_id)
 			as event_counts on events.id = event_counts.event_id
-			where events.id = ? limit 1;`)
+			where events.id = ? and events.deleted_at is null limit 1;`)
 		if err != nil {
 			return err
 		}
 		m.StmtEvent = stmt
 	}
 
-	{
-		stmt, err := db.Prepare(
-			`select
+	// The listings only differ in how they are sorted, and so in where the
+	// next page starts.
+	listEvents := func(after, order string) string {
+		return `select
 				events.id,
 				events.created_by,
 				events.title,
@@ -84,10 +176,7 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 				events.repeats_scale,
 				events.min_part_num,
 				events.max_part_num,
-				case when number_of_participants is NULL
-					then 0
-					else number_of_participants
-				end as number_of_participants
+				coalesce(event_counts.number_of_participants, 0) as number_of_participants
 			from events
 			left join
 				(select
@@ -98,15 +187,49 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 				where
 					deleted_at is null
 				group by event_id)
-			as event_counts on events.id = event_counts.event_id;`)
+			as event_counts on events.id = event_counts.event_id
+			where
+				events.deleted_at is null
+				and (? = '' or lower(events.title) like ? escape '!' or lower(events.description) like ? escape '!')
+				and (? = '' or (? = 'yes') = (events.repeats_scale <> 'never'))
+				and (? = 0 or events.max_part_num is null or coalesce(event_counts.number_of_participants, 0) < events.max_part_num)
+				and (? = 0 or events.created_by = ?)
+				and (? = 0 or exists (
+					select 1 from event_subscriptions
+					where event_id = events.id and user_id = ? and deleted_at is null))
+				and (? = 0 or ` + after + `)
+			order by ` + order + `
+			limit ?;`
+	}
+
+	{
+		stmt, err := m.prepare(db, listEvents("events.id > ?", "events.id"))
+		if err != nil {
+			return err
+		}
+		m.StmtEventsOldest = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, listEvents("events.id < ?", "events.id desc"))
+		if err != nil {
+			return err
+		}
+		m.StmtEventsNewest = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, listEvents(
+			"events.title > ? or (events.title = ? and events.id > ?)",
+			"events.title, events.id"))
 		if err != nil {
 			return err
 		}
-		m.StmtEvents = stmt
+		m.StmtEventsByTitle = stmt
 	}
 
 	{
-		stmt, err := db.Prepare(
+		stmt, err := m.prepare(db, m.returningID(
 			`insert into events (
 				created_by,
 				title,
@@ -115,7 +238,7 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 				repeats_scale,
 				min_part_num,
 				max_part_num
-			) values (?, ?, ?, ?, ?, ?, ?);`)
+			) values (?, ?, ?, ?, ?, ?, ?);`))
 		if err != nil {
 			return err
 		}
@@ -123,20 +246,19 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 	}
 
 	{
-		stmt, err := db.Prepare("insert into event_subscriptions (user_id, event_id, message) values (?, ?, ?);")
+		stmt, err := m.prepare(db, m.returningID("insert into event_subscriptions (user_id, event_id, message) values (?, ?, ?);"))
 		if err != nil {
 			return err
 		}
 		m.StmtRegisterEvent = stmt
 	}
 
-	// @todo: not sure if this is the best way to do it
 	{
-		stmt, err := db.Prepare(
+		stmt, err := m.prepare(db,
 			`update event_subscriptions
 			set
 				message = ?,
-				changed_at = (select @now := current_timestamp()),
+				changed_at = current_timestamp,
 				deleted_at = null
 			where
 				id = ?;`)
@@ -147,13 +269,13 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 	}
 
 	{
-		stmt, err := db.Prepare(
+		stmt, err := m.prepare(db,
 			`update event_subscriptions
 			set
-				changed_at = (select @now := current_timestamp()),
-				deleted_at = @now
+				changed_at = current_timestamp,
+				deleted_at = current_timestamp
 			where
-				id = ?;`)
+				id = ? and deleted_at is null;`)
 		if err != nil {
 			return err
 		}
@@ -161,15 +283,18 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 	}
 
 	{
-		stmt, err := db.Prepare("select id, user_id, event_id, message from event_subscriptions where id = ? limit 1;")
+		stmt, err := m.prepare(db, "select id, user_id, event_id, message from event_subscriptions where id = ? and deleted_at is null limit 1;")
 		if err != nil {
 			return err
 		}
 		m.StmtEventRegistration = stmt
 	}
 
+	// Unlike all other lookups, this one includes deleted registrations:
+	// there is at most one per user and event, so registering again revives
+	// the old one.
 	{
-		stmt, err := db.Prepare("select id, user_id, event_id, message from event_subscriptions where user_id = ? and event_id = ? limit 1;")
+		stmt, err := m.prepare(db, "select id, user_id, event_id, message from event_subscriptions where user_id = ? and event_id = ? limit 1;")
 		if err != nil {
 			return err
 		}
@@ -177,142 +302,1726 @@ func (m *MariaDB) Prepare(db *sql.DB) error {
 	}
 
 	{
-		stmt, err := db.Prepare("select id, user_id, event_id, message from event_subscriptions where event_id = ? and deleted_at is null;")
+		stmt, err := m.prepare(db, "select id, user_id, event_id, message from event_subscriptions where event_id = ? and deleted_at is null;")
 		if err != nil {
 			return err
 		}
 		m.StmtEventRegistrations = stmt
 	}
 
-	return nil
-}
+	{
+		stmt, err := m.prepare(db,
+			`select
+				id_hash,
+				user_id,
+				authenticated,
+				created_at,
+				login_token_hash,
+				login_created_at,
+				login_valid,
+				second_factor_pending,
+				second_factor_attempts,
+				login_code_hash,
+				login_code_created_at,
+				login_code_valid,
+				login_code_attempts,
+				last_seen_at,
+				ip,
+				user_agent,
+				impersonator_id
+			from sessions
+			where id_hash = ? limit 1;`)
+		if err != nil {
+			return err
+		}
+		m.StmtSession = stmt
+	}
 
-func (m *MariaDB) User(id UserID) (u User, err error) {
-	row := m.StmtUser.QueryRow(id)
-	err = row.Scan(&u.ID, &u.Name, &u.Display, &u.Email, &u.Icon)
-	return u, err
-}
+	{
+		stmt, err := m.prepare(db,
+			`select
+				id_hash,
+				user_id,
+				authenticated,
+				created_at,
+				login_token_hash,
+				login_created_at,
+				login_valid,
+				second_factor_pending,
+				second_factor_attempts,
+				login_code_hash,
+				login_code_created_at,
+				login_code_valid,
+				login_code_attempts,
+				last_seen_at,
+				ip,
+				user_agent,
+				impersonator_id
+			from sessions
+			where login_token_hash = ? limit 1;`)
+		if err != nil {
+			return err
+		}
+		m.StmtSessionByLogin = stmt
+	}
 
-func (m *MariaDB) UserByEmail(email string) (u User, err error) {
-	row := m.StmtUserByEmail.QueryRow(email)
-	err = row.Scan(&u.ID, &u.Name, &u.Display, &u.Email, &u.Icon)
-	return u, err
-}
+	{
+		stmt, err := m.prepare(db,
+			`select
+				id_hash,
+				user_id,
+				authenticated,
+				created_at,
+				login_token_hash,
+				login_created_at,
+				login_valid,
+				second_factor_pending,
+				second_factor_attempts,
+				login_code_hash,
+				login_code_created_at,
+				login_code_valid,
+				login_code_attempts,
+				last_seen_at,
+				ip,
+				user_agent,
+				impersonator_id
+			from sessions
+			where user_id = ?
+			order by last_seen_at desc;`)
+		if err != nil {
+			return err
+		}
+		m.StmtSessionsByUser = stmt
+	}
 
-func (m *MariaDB) CreateEvent(event Event) (Event, error) {
-	res, err := m.StmtCreateEvent.Exec(
-		event.CreatedBy,
-		event.Title,
-		event.Description,
-		event.RepeatsEvery,
-		event.RepeatsScale,
-		event.MinParticipants,
-		event.MaxParticipants,
-	)
-	if err != nil {
-		return event, err
+	{
+		query := `insert into sessions (
+				id_hash,
+				user_id,
+				authenticated,
+				created_at,
+				login_token_hash,
+				login_created_at,
+				login_valid,
+				second_factor_pending,
+				second_factor_attempts,
+				login_code_hash,
+				login_code_created_at,
+				login_code_valid,
+				login_code_attempts,
+				last_seen_at,
+				ip,
+				user_agent,
+				impersonator_id
+			) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+				user_id = values(user_id),
+				authenticated = values(authenticated),
+				login_token_hash = values(login_token_hash),
+				login_created_at = values(login_created_at),
+				login_valid = values(login_valid),
+				second_factor_pending = values(second_factor_pending),
+				second_factor_attempts = values(second_factor_attempts),
+				login_code_hash = values(login_code_hash),
+				login_code_created_at = values(login_code_created_at),
+				login_code_valid = values(login_code_valid),
+				login_code_attempts = values(login_code_attempts),
+				last_seen_at = values(last_seen_at),
+				ip = values(ip),
+				user_agent = values(user_agent),
+				impersonator_id = values(impersonator_id);`
+		if m.dialect != DialectMySQL {
+			query = standardSaveSession
+		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtSaveSession = stmt
 	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		return event, err
+
+	{
+		stmt, err := m.prepare(db,
+			`update sessions set
+				user_id = ?,
+				authenticated = ?,
+				login_valid = ?,
+				second_factor_pending = ?,
+				second_factor_attempts = ?,
+				login_code_valid = ?,
+				login_code_attempts = ?,
+				last_seen_at = ?,
+				ip = ?,
+				user_agent = ?,
+				impersonator_id = ?
+			where id_hash = ? and login_token_hash = ? and login_valid = true;`)
+		if err != nil {
+			return err
+		}
+		m.StmtConsumeLogin = stmt
 	}
-	event.ID = EventID(id)
-	return event, nil
-}
 
-func (m *MariaDB) Event(id EventID) (e Event, err error) {
-	row := m.StmtEvent.QueryRow(id)
-	err = row.Scan(&e.ID, &e.CreatedBy, &e.Title, &e.Description, &e.RepeatsEvery, &e.RepeatsScale, &e.MinParticipants, &e.MaxParticipants, &e.NumberOfParticipants)
-	return e, err
-}
+	{
+		stmt, err := m.prepare(db, "delete from sessions where id_hash = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteSession = stmt
+	}
 
-func (m *MariaDB) RegisterEvent(reg EventRegistration) (freg EventRegistration, ferr error) {
-	tx, err := m.db.Begin()
-	if err != nil {
-		return reg, err
+	{
+		query := `delete from sessions
+			where
+				created_at < ?
+				or (authenticated = false and login_created_at < ?);`
+		if m.dialect == DialectSQLite {
+			query = sqliteDeleteExpiredSessions
+		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteExpiredSessions = stmt
 	}
-	defer func() {
-		if ferr != nil {
-			ferr = errors.Join(ferr, tx.Rollback())
+
+	{
+		query := "insert ignore into used_challenges (challenge_hash, expires_at) values (?, ?);"
+		if m.dialect != DialectMySQL {
+			query = "insert into used_challenges (challenge_hash, expires_at) values (?, ?) on conflict do nothing;"
 		}
-	}()
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtUseChallenge = stmt
+	}
 
-	createNew := false
-	var oldMessage string
-	row := tx.Stmt(m.StmtEventRegistration2).QueryRow(reg.User, reg.Event)
-	err = row.Scan(&reg.ID, &reg.User, &reg.Event, &oldMessage)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			createNew = true
-		} else {
-			return reg, err
+	{
+		query := "delete from used_challenges where expires_at < ?;"
+		if m.dialect == DialectSQLite {
+			query = sqliteDeleteExpiredChallenges
 		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteExpiredChallenges = stmt
 	}
 
-	if createNew {
-		res, err := tx.Stmt(m.StmtRegisterEvent).Exec(reg.User, reg.Event, reg.Message)
+	{
+		stmt, err := m.prepare(db, "select id, user_id, name, credential_id, public_key, sign_count, created_at, last_used_at from passkeys where user_id = ? order by created_at;")
 		if err != nil {
-			return reg, err
+			return err
 		}
-		id, err := res.LastInsertId()
+		m.StmtPasskeys = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, name, credential_id, public_key, sign_count, created_at, last_used_at from passkeys where credential_id = ? limit 1;")
 		if err != nil {
-			return reg, err
+			return err
 		}
-		reg.ID = EventRegistrationID(id)
-	} else {
-		_, err := tx.Stmt(m.StmtReregisterEvent).Exec(reg.Message, reg.ID)
+		m.StmtPasskeyByCredentialID = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, m.returningID("insert into passkeys (user_id, name, credential_id, public_key, sign_count) values (?, ?, ?, ?, ?);"))
 		if err != nil {
-			return reg, err
+			return err
 		}
+		m.StmtCreatePasskey = stmt
 	}
 
-	err = tx.Commit()
-	return reg, err
-}
+	{
+		stmt, err := m.prepare(db, "update passkeys set sign_count = ?, last_used_at = current_timestamp where id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtUpdatePasskeySignCount = stmt
+	}
 
-func (m *MariaDB) DeregisterEvent(id EventRegistrationID) error {
-	_, err := m.StmtDeregisterEvent.Exec(id)
-	if err != nil {
-		return err
+	{
+		stmt, err := m.prepare(db, "delete from passkeys where id = ? and user_id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeletePasskey = stmt
 	}
-	return nil
-}
 
-func (m *MariaDB) EventRegistration(id EventRegistrationID) (e EventRegistration, err error) {
-	row := m.StmtEventRegistration.QueryRow(id)
-	err = row.Scan(&e.ID, &e.User, &e.Event, &e.Message)
-	return e, err
-}
+	{
+		stmt, err := m.prepare(db, "select user_id, secret, confirmed_at, last_step from totp_secrets where user_id = ? limit 1;")
+		if err != nil {
+			return err
+		}
+		m.StmtTotpSecret = stmt
+	}
 
-func (m *MariaDB) EventRegistrations(eventID EventID) ([]EventRegistration, error) {
-	rows, err := m.StmtEventRegistrations.Query(eventID)
-	if err != nil {
-		return nil, err
+	{
+		query := `insert into totp_secrets (user_id, secret) values (?, ?)
+			on duplicate key update
+				secret = values(secret),
+				last_step = 0,
+				created_at = current_timestamp,
+				confirmed_at = null;`
+		if m.dialect != DialectMySQL {
+			query = standardSaveTotpSecret
+		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtSaveTotpSecret = stmt
 	}
-	regs := []EventRegistration{}
-	for rows.Next() {
-		reg := EventRegistration{}
-		if err := rows.Scan(&reg.ID, &reg.User, &reg.Event, &reg.Message); err != nil {
-			return regs, err
+
+	{
+		stmt, err := m.prepare(db, "update totp_secrets set confirmed_at = current_timestamp where user_id = ?;")
+		if err != nil {
+			return err
 		}
-		regs = append(regs, reg)
+		m.StmtConfirmTotpSecret = stmt
 	}
-	return regs, nil
-}
 
-func (m *MariaDB) Events() ([]Event, error) {
-	rows, err := m.StmtEvents.Query()
-	if err != nil {
-		return nil, err
+	{
+		stmt, err := m.prepare(db, "update totp_secrets set last_step = ? where user_id = ? and last_step < ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtUseTotpStep = stmt
 	}
-	events := []Event{}
-	for rows.Next() {
-		e := Event{}
-		err := rows.Scan(&e.ID, &e.CreatedBy, &e.Title, &e.Description, &e.RepeatsEvery, &e.RepeatsScale, &e.MinParticipants, &e.MaxParticipants, &e.NumberOfParticipants)
+
+	{
+		stmt, err := m.prepare(db, "delete from totp_secrets where user_id = ?;")
 		if err != nil {
-			return events, err
+			return err
 		}
-		events = append(events, e)
+		m.StmtDeleteTotpSecret = stmt
 	}
-	return events, nil
-}
+
+	{
+		stmt, err := m.prepare(db, "delete from recovery_codes where user_id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteRecoveryCodes = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "insert into recovery_codes (user_id, code_hash) values (?, ?);")
+		if err != nil {
+			return err
+		}
+		m.StmtCreateRecoveryCode = stmt
+	}
+
+	{
+		query := "update recovery_codes set used_at = current_timestamp where user_id = ? and code_hash = ? and used_at is null limit 1;"
+		if m.dialect != DialectMySQL {
+			query = standardUseRecoveryCode
+		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtUseRecoveryCode = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, name, display, email, icon, activated_at, role, disabled_at from users where deleted_at is null order by name;")
+		if err != nil {
+			return err
+		}
+		m.StmtUsers = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update users set role = ? where id = ? and deleted_at is null;")
+		if err != nil {
+			return err
+		}
+		m.StmtSetUserRole = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update users set disabled_at = ?, changed_at = current_timestamp where id = ? and deleted_at is null;")
+		if err != nil {
+			return err
+		}
+		m.StmtSetUserDisabled = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, name, token_hash, scope, created_at, last_used_at from api_tokens where user_id = ? order by created_at;")
+		if err != nil {
+			return err
+		}
+		m.StmtApiTokens = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, name, token_hash, scope, created_at, last_used_at from api_tokens where token_hash = ? limit 1;")
+		if err != nil {
+			return err
+		}
+		m.StmtApiTokenByHash = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, m.returningID("insert into api_tokens (user_id, name, token_hash, scope) values (?, ?, ?, ?);"))
+		if err != nil {
+			return err
+		}
+		m.StmtCreateApiToken = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update api_tokens set last_used_at = current_timestamp where id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtTouchApiToken = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "delete from api_tokens where id = ? and user_id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteApiToken = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, m.returningID("insert into email_changes (user_id, old_email, new_email, confirm_token_hash) values (?, ?, ?, ?);"))
+		if err != nil {
+			return err
+		}
+		m.StmtCreateEmailChange = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, old_email, new_email, confirm_token_hash, undo_token_hash, requested_at, confirmed_at, undone_at from email_changes where confirm_token_hash = ? limit 1;")
+		if err != nil {
+			return err
+		}
+		m.StmtEmailChangeByConfirmHash = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, old_email, new_email, confirm_token_hash, undo_token_hash, requested_at, confirmed_at, undone_at from email_changes where undo_token_hash = ? limit 1;")
+		if err != nil {
+			return err
+		}
+		m.StmtEmailChangeByUndoHash = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update email_changes set confirmed_at = current_timestamp, undo_token_hash = ? where id = ? and confirmed_at is null and undone_at is null;")
+		if err != nil {
+			return err
+		}
+		m.StmtConfirmEmailChange = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update email_changes set undone_at = current_timestamp where user_id = ? and id >= ? and undone_at is null;")
+		if err != nil {
+			return err
+		}
+		m.StmtUndoEmailChanges = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update users set email = ? where id = ? and email = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtChangeUserEmail = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "update users set email = ? where id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtRestoreUserEmail = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`select
+				id,
+				created_by,
+				title,
+				description,
+				repeats_every,
+				repeats_scale,
+				min_part_num,
+				max_part_num
+			from events
+			where created_by = ? and deleted_at is null;`)
+		if err != nil {
+			return err
+		}
+		m.StmtEventsCreatedBy = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, event_id, message from event_subscriptions where user_id = ? and deleted_at is null;")
+		if err != nil {
+			return err
+		}
+		m.StmtEventRegistrationsOfUser = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id, user_id, old_email, new_email, confirm_token_hash, undo_token_hash, requested_at, confirmed_at, undone_at from email_changes where user_id = ? order by id;")
+		if err != nil {
+			return err
+		}
+		m.StmtEmailChanges = stmt
+	}
+
+	{
+		// The address must stay unique, and must not be one anybody could
+		// receive mail at.
+		stmt, err := m.prepare(db,
+			`update users
+			set
+				name = 'deleted',
+				display = '',
+				email = concat('deleted-', id, '@invalid'),
+				icon = null,
+				role = 'user',
+				changed_at = current_timestamp,
+				deleted_at = current_timestamp
+			where
+				id = ? and deleted_at is null;`)
+		if err != nil {
+			return err
+		}
+		m.StmtAnonymizeUser = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`update events
+			set
+				changed_at = current_timestamp,
+				deleted_at = current_timestamp
+			where
+				created_by = ? and deleted_at is null;`)
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteEventsCreatedBy = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`update event_subscriptions
+			set
+				message = null,
+				changed_at = current_timestamp,
+				deleted_at = current_timestamp
+			where
+				user_id = ?;`)
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteRegistrationsOfUser = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "delete from passkeys where user_id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeletePasskeys = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "delete from api_tokens where user_id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteApiTokens = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "delete from email_changes where user_id = ?;")
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteEmailChanges = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "insert into audit_log (user_id, actor_id, action, detail, ip, user_agent) values (?, ?, ?, ?, ?, ?);")
+		if err != nil {
+			return err
+		}
+		m.StmtAppendAuditEntry = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`select id, user_id, actor_id, action, detail, ip, user_agent, created_at
+			from audit_log
+			where
+				(? = 0 or user_id = ?)
+				and (? = '' or action = ?)
+				and (? = 0 or id < ?)
+			order by id desc
+			limit ?;`)
+		if err != nil {
+			return err
+		}
+		m.StmtAuditEntries = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db, "select id from events where id = ? and deleted_at is null;")
+		if err != nil {
+			return err
+		}
+		m.StmtEventExists = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`update events
+			set
+				changed_at = current_timestamp,
+				deleted_at = current_timestamp
+			where
+				id = ? and deleted_at is null;`)
+		if err != nil {
+			return err
+		}
+		m.StmtDeleteEvent = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`select
+				events.id,
+				events.created_by,
+				events.title,
+				events.description,
+				events.repeats_every,
+				events.repeats_scale,
+				events.min_part_num,
+				events.max_part_num,
+				events.deleted_at
+			from events
+			join users on users.id = events.created_by
+			where
+				events.deleted_at is not null
+				and users.deleted_at is null
+				and (? = 0 or events.created_by = ?)
+			order by events.deleted_at desc, events.id desc;`)
+		if err != nil {
+			return err
+		}
+		m.StmtDeletedEvents = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`update events
+			set
+				changed_at = current_timestamp,
+				deleted_at = null
+			where
+				id = ? and deleted_at is not null
+				and (? = 0 or created_by = ?)
+				and created_by in (select id from users where deleted_at is null);`)
+		if err != nil {
+			return err
+		}
+		m.StmtRestoreEvent = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`select
+				event_subscriptions.id,
+				event_subscriptions.user_id,
+				event_subscriptions.event_id,
+				event_subscriptions.message,
+				events.title,
+				event_subscriptions.deleted_at
+			from event_subscriptions
+			join events on events.id = event_subscriptions.event_id
+			join users on users.id = event_subscriptions.user_id
+			where
+				event_subscriptions.deleted_at is not null
+				and events.deleted_at is null
+				and users.deleted_at is null
+				and (? = 0 or event_subscriptions.user_id = ?)
+			order by event_subscriptions.deleted_at desc, event_subscriptions.id desc;`)
+		if err != nil {
+			return err
+		}
+		m.StmtDeletedEventRegistrations = stmt
+	}
+
+	{
+		stmt, err := m.prepare(db,
+			`update event_subscriptions
+			set
+				changed_at = current_timestamp,
+				deleted_at = null
+			where
+				id = ? and deleted_at is not null
+				and (? = 0 or user_id = ?)
+				and event_id in (select id from events where deleted_at is null)
+				and user_id in (select id from users where deleted_at is null);`)
+		if err != nil {
+			return err
+		}
+		m.StmtRestoreEventRegistration = stmt
+	}
+
+	{
+		query := `delete from event_subscriptions
+			where
+				deleted_at < ?
+				or event_id in (select id from events where deleted_at < ?);`
+		if m.dialect == DialectSQLite {
+			query = sqlitePurgeEventRegistrations
+		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtPurgeEventRegistrations = stmt
+	}
+
+	{
+		query := "delete from events where deleted_at < ?;"
+		if m.dialect == DialectSQLite {
+			query = sqlitePurgeEvents
+		}
+		stmt, err := m.prepare(db, query)
+		if err != nil {
+			return err
+		}
+		m.StmtPurgeEvents = stmt
+	}
+
+	return nil
+}
+
+func (m *MariaDB) User(ctx context.Context, id UserID) (u User, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtUser.QueryRowContext(ctx, id)
+	err = row.Scan(&u.ID, &u.Name, &u.Display, &u.Email, &u.Icon, &u.ActivatedAt, &u.Role, &u.DisabledAt)
+	return u, err
+}
+
+func (m *MariaDB) UserByEmail(ctx context.Context, email string) (u User, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtUserByEmail.QueryRowContext(ctx, email)
+	err = row.Scan(&u.ID, &u.Name, &u.Display, &u.Email, &u.Icon, &u.ActivatedAt, &u.Role, &u.DisabledAt)
+	return u, err
+}
+
+func (m *MariaDB) CreateUser(ctx context.Context, user User) (User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	id, err := m.insertID(ctx, m.StmtCreateUser, user.Name, user.Display, user.Email, user.Icon, user.Role)
+	if err != nil {
+		return user, err
+	}
+	user.ID = UserID(id)
+	return user, nil
+}
+
+func (m *MariaDB) Users(ctx context.Context) ([]User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtUsers.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []User{}
+	for rows.Next() {
+		u := User{}
+		if err := rows.Scan(&u.ID, &u.Name, &u.Display, &u.Email, &u.Icon, &u.ActivatedAt, &u.Role, &u.DisabledAt); err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (m *MariaDB) SetUserRole(ctx context.Context, id UserID, role Role) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtSetUserRole.ExecContext(ctx, role, id)
+	return err
+}
+
+func (m *MariaDB) SetUserDisabled(ctx context.Context, id UserID, disabled bool) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	var disabledAt time.Time
+	if disabled {
+		disabledAt = time.Now()
+	}
+	_, err := m.StmtSetUserDisabled.ExecContext(ctx, nullTime(disabledAt), id)
+	return err
+}
+
+func (m *MariaDB) ActivateUser(ctx context.Context, id UserID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtActivateUser.ExecContext(ctx, id)
+	return err
+}
+
+func (m *MariaDB) CreateEvent(ctx context.Context, event Event) (Event, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	id, err := m.insertID(ctx, m.StmtCreateEvent,
+		event.CreatedBy,
+		event.Title,
+		event.Description,
+		event.RepeatsEvery,
+		event.RepeatsScale,
+		event.MinParticipants,
+		event.MaxParticipants,
+	)
+	if err != nil {
+		return event, err
+	}
+	event.ID = EventID(id)
+	return event, nil
+}
+
+func (m *MariaDB) Event(ctx context.Context, id EventID) (e Event, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtEvent.QueryRowContext(ctx, id)
+	err = row.Scan(&e.ID, &e.CreatedBy, &e.Title, &e.Description, &e.RepeatsEvery, &e.RepeatsScale, &e.MinParticipants, &e.MaxParticipants, &e.NumberOfParticipants)
+	return e, err
+}
+
+func (m *MariaDB) RegisterEvent(ctx context.Context, reg EventRegistration) (freg EventRegistration, ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return reg, err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+
+	var eventID EventID
+	err = tx.StmtContext(ctx, m.StmtEventExists).QueryRowContext(ctx, reg.Event).Scan(&eventID)
+	if err != nil {
+		return reg, err
+	}
+
+	createNew := false
+	var oldMessage sql.NullString
+	row := tx.StmtContext(ctx, m.StmtEventRegistration2).QueryRowContext(ctx, reg.User, reg.Event)
+	err = row.Scan(&reg.ID, &reg.User, &reg.Event, &oldMessage)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			createNew = true
+		} else {
+			return reg, err
+		}
+	}
+
+	if createNew {
+		id, err := m.insertID(ctx, tx.StmtContext(ctx, m.StmtRegisterEvent), reg.User, reg.Event, reg.Message)
+		if err != nil {
+			return reg, err
+		}
+		reg.ID = EventRegistrationID(id)
+	} else {
+		_, err := tx.StmtContext(ctx, m.StmtReregisterEvent).ExecContext(ctx, reg.Message, reg.ID)
+		if err != nil {
+			return reg, err
+		}
+	}
+
+	err = tx.Commit()
+	return reg, err
+}
+
+func (m *MariaDB) DeregisterEvent(ctx context.Context, id EventRegistrationID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtDeregisterEvent.ExecContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MariaDB) EventRegistration(ctx context.Context, id EventRegistrationID) (e EventRegistration, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtEventRegistration.QueryRowContext(ctx, id)
+	err = row.Scan(&e.ID, &e.User, &e.Event, &e.Message)
+	return e, err
+}
+
+func (m *MariaDB) EventRegistrations(ctx context.Context, eventID EventID) ([]EventRegistration, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtEventRegistrations.QueryContext(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	regs := []EventRegistration{}
+	for rows.Next() {
+		reg := EventRegistration{}
+		if err := rows.Scan(&reg.ID, &reg.User, &reg.Event, &reg.Message); err != nil {
+			return regs, err
+		}
+		regs = append(regs, reg)
+	}
+	return regs, rows.Err()
+}
+
+func (m *MariaDB) Events(ctx context.Context, q EventQuery) ([]Event, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	search := ""
+	if q.Search != "" {
+		search = "%" + likeEscaper.Replace(strings.ToLower(q.Search)) + "%"
+	}
+	repeating := ""
+	if q.Repeating.Valid {
+		repeating = "no"
+		if q.Repeating.Bool {
+			repeating = "yes"
+		}
+	}
+	hasFreeSpots := 0
+	if q.HasFreeSpots {
+		hasFreeSpots = 1
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	args := []any{
+		q.Search, search, search,
+		repeating, repeating,
+		hasFreeSpots,
+		q.CreatedBy, q.CreatedBy,
+		q.RegisteredBy, q.RegisteredBy,
+	}
+	stmt := m.StmtEventsOldest
+	switch q.Sort {
+	case SortNewest:
+		stmt = m.StmtEventsNewest
+		args = append(args, q.After.ID, q.After.ID)
+	case SortTitle:
+		stmt = m.StmtEventsByTitle
+		args = append(args, q.After.ID, q.After.Title, q.After.Title, q.After.ID)
+	default:
+		args = append(args, q.After.ID, q.After.ID)
+	}
+	args = append(args, limit)
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		e := Event{}
+		err := rows.Scan(&e.ID, &e.CreatedBy, &e.Title, &e.Description, &e.RepeatsEvery, &e.RepeatsScale, &e.MinParticipants, &e.MaxParticipants, &e.NumberOfParticipants)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// likeEscaper escapes the wildcards of a like pattern, with ! as the escape
+// character.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+func (m *MariaDB) Session(ctx context.Context, id TokenHash) (Session, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return scanSession(m.StmtSession.QueryRowContext(ctx, id))
+}
+
+func (m *MariaDB) SessionByLogin(ctx context.Context, login TokenHash) (Session, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return scanSession(m.StmtSessionByLogin.QueryRowContext(ctx, login))
+}
+
+func (m *MariaDB) SessionsByUser(ctx context.Context, user UserID) ([]Session, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtSessionsByUser.QueryContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func scanSession(row interface{ Scan(...any) error }) (s Session, err error) {
+	var (
+		loginCreated, loginCodeCreated sql.NullTime
+		impersonator                   sql.NullInt64
+	)
+	err = row.Scan(
+		&s.Hash,
+		&s.User,
+		&s.authenticated,
+		&s.Created,
+		&s.login.Hash,
+		&loginCreated,
+		&s.login.Valid,
+		&s.secondFactorPending,
+		&s.secondFactorAttempts,
+		&s.loginCode.Hash,
+		&loginCodeCreated,
+		&s.loginCode.Valid,
+		&s.loginCode.Attempts,
+		&s.lastSeen,
+		&s.client.IP,
+		&s.client.UserAgent,
+		&impersonator,
+	)
+	s.Valid = err == nil
+	s.impersonator = UserID(impersonator.Int64)
+	s.login.Created = loginCreated.Time
+	s.loginCode.Created = loginCodeCreated.Time
+	return s, err
+}
+
+func (m *MariaDB) SaveSession(ctx context.Context, s Session) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtSaveSession.ExecContext(ctx,
+		s.Hash,
+		s.User,
+		s.authenticated,
+		s.Created,
+		s.login.Hash,
+		nullTime(s.login.Created),
+		s.login.Valid,
+		s.secondFactorPending,
+		s.secondFactorAttempts,
+		s.loginCode.Hash,
+		nullTime(s.loginCode.Created),
+		s.loginCode.Valid,
+		s.loginCode.Attempts,
+		s.lastSeen,
+		s.client.IP,
+		s.client.UserAgent,
+		nullUser(s.impersonator),
+	)
+	return err
+}
+
+func (m *MariaDB) ConsumeLogin(ctx context.Context, s Session, login TokenHash) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtConsumeLogin.ExecContext(ctx,
+		s.User,
+		s.authenticated,
+		s.login.Valid,
+		s.secondFactorPending,
+		s.secondFactorAttempts,
+		s.loginCode.Valid,
+		s.loginCode.Attempts,
+		s.lastSeen,
+		s.client.IP,
+		s.client.UserAgent,
+		nullUser(s.impersonator),
+		s.Hash,
+		login,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (m *MariaDB) DeleteSession(ctx context.Context, id TokenHash) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtDeleteSession.ExecContext(ctx, id)
+	return err
+}
+
+func (m *MariaDB) DeleteExpiredSessions(ctx context.Context, createdBefore, loginBefore time.Time) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtDeleteExpiredSessions.ExecContext(ctx, createdBefore, loginBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (m *MariaDB) UseChallenge(ctx context.Context, challenge TokenHash, expires time.Time) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtUseChallenge.ExecContext(ctx, challenge, expires)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (m *MariaDB) DeleteExpiredChallenges(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtDeleteExpiredChallenges.ExecContext(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (m *MariaDB) Passkeys(ctx context.Context, user UserID) ([]Passkey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtPasskeys.QueryContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	passkeys := []Passkey{}
+	for rows.Next() {
+		p := Passkey{}
+		if err := rows.Scan(&p.ID, &p.User, &p.Name, &p.CredentialID, &p.PublicKey, &p.SignCount, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return passkeys, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+func (m *MariaDB) PasskeyByCredentialID(ctx context.Context, credentialID []byte) (p Passkey, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtPasskeyByCredentialID.QueryRowContext(ctx, credentialID)
+	err = row.Scan(&p.ID, &p.User, &p.Name, &p.CredentialID, &p.PublicKey, &p.SignCount, &p.CreatedAt, &p.LastUsedAt)
+	return p, err
+}
+
+func (m *MariaDB) CreatePasskey(ctx context.Context, p Passkey) (Passkey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	id, err := m.insertID(ctx, m.StmtCreatePasskey, p.User, p.Name, p.CredentialID, p.PublicKey, p.SignCount)
+	if err != nil {
+		return p, err
+	}
+	p.ID = PasskeyID(id)
+	return p, nil
+}
+
+func (m *MariaDB) UpdatePasskeySignCount(ctx context.Context, id PasskeyID, signCount uint32) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtUpdatePasskeySignCount.ExecContext(ctx, signCount, id)
+	return err
+}
+
+func (m *MariaDB) DeletePasskey(ctx context.Context, id PasskeyID, user UserID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtDeletePasskey.ExecContext(ctx, id, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m *MariaDB) TotpSecret(ctx context.Context, user UserID) (t TotpSecret, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtTotpSecret.QueryRowContext(ctx, user)
+	err = row.Scan(&t.User, &t.Secret, &t.ConfirmedAt, &t.LastStep)
+	return t, err
+}
+
+func (m *MariaDB) SaveTotpSecret(ctx context.Context, t TotpSecret) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtSaveTotpSecret.ExecContext(ctx, t.User, t.Secret)
+	return err
+}
+
+func (m *MariaDB) ConfirmTotpSecret(ctx context.Context, user UserID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtConfirmTotpSecret.ExecContext(ctx, user)
+	return err
+}
+
+func (m *MariaDB) UseTotpStep(ctx context.Context, user UserID, step int64) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtUseTotpStep.ExecContext(ctx, step, user, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (m *MariaDB) DeleteTotpSecret(ctx context.Context, user UserID) (ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+	if _, err := tx.StmtContext(ctx, m.StmtDeleteRecoveryCodes).ExecContext(ctx, user); err != nil {
+		return err
+	}
+	if _, err := tx.StmtContext(ctx, m.StmtDeleteTotpSecret).ExecContext(ctx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MariaDB) SetRecoveryCodes(ctx context.Context, user UserID, hashes [][]byte) (ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+	if _, err := tx.StmtContext(ctx, m.StmtDeleteRecoveryCodes).ExecContext(ctx, user); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.StmtContext(ctx, m.StmtCreateRecoveryCode).ExecContext(ctx, user, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *MariaDB) UseRecoveryCode(ctx context.Context, user UserID, hash []byte) (bool, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtUseRecoveryCode.ExecContext(ctx, user, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (m *MariaDB) ApiTokens(ctx context.Context, user UserID) ([]ApiToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtApiTokens.QueryContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []ApiToken{}
+	for rows.Next() {
+		t := ApiToken{}
+		if err := rows.Scan(&t.ID, &t.User, &t.Name, &t.Hash, &t.Scope, &t.CreatedAt, &t.LastUsedAt); err != nil {
+			return tokens, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (m *MariaDB) ApiTokenByHash(ctx context.Context, hash TokenHash) (t ApiToken, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtApiTokenByHash.QueryRowContext(ctx, hash)
+	err = row.Scan(&t.ID, &t.User, &t.Name, &t.Hash, &t.Scope, &t.CreatedAt, &t.LastUsedAt)
+	return t, err
+}
+
+func (m *MariaDB) CreateApiToken(ctx context.Context, t ApiToken) (ApiToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	id, err := m.insertID(ctx, m.StmtCreateApiToken, t.User, t.Name, t.Hash, t.Scope)
+	if err != nil {
+		return t, err
+	}
+	t.ID = ApiTokenID(id)
+	return t, nil
+}
+
+func (m *MariaDB) TouchApiToken(ctx context.Context, id ApiTokenID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtTouchApiToken.ExecContext(ctx, id)
+	return err
+}
+
+func (m *MariaDB) DeleteApiToken(ctx context.Context, id ApiTokenID, user UserID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	res, err := m.StmtDeleteApiToken.ExecContext(ctx, id, user)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (m *MariaDB) CreateEmailChange(ctx context.Context, c EmailChange) (EmailChange, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	id, err := m.insertID(ctx, m.StmtCreateEmailChange, c.User, c.OldEmail, c.NewEmail, c.ConfirmHash)
+	if err != nil {
+		return c, err
+	}
+	c.ID = EmailChangeID(id)
+	return c, nil
+}
+
+func (m *MariaDB) EmailChangeByConfirmHash(ctx context.Context, hash TokenHash) (c EmailChange, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtEmailChangeByConfirmHash.QueryRowContext(ctx, hash)
+	err = row.Scan(&c.ID, &c.User, &c.OldEmail, &c.NewEmail, &c.ConfirmHash, &c.UndoHash, &c.RequestedAt, &c.ConfirmedAt, &c.UndoneAt)
+	return c, err
+}
+
+func (m *MariaDB) EmailChangeByUndoHash(ctx context.Context, hash TokenHash) (c EmailChange, err error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	row := m.StmtEmailChangeByUndoHash.QueryRowContext(ctx, hash)
+	err = row.Scan(&c.ID, &c.User, &c.OldEmail, &c.NewEmail, &c.ConfirmHash, &c.UndoHash, &c.RequestedAt, &c.ConfirmedAt, &c.UndoneAt)
+	return c, err
+}
+
+func (m *MariaDB) ConfirmEmailChange(ctx context.Context, c EmailChange, undoHash TokenHash) (ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+	if err := execOne(ctx, tx.StmtContext(ctx, m.StmtConfirmEmailChange), undoHash, c.ID); err != nil {
+		return err
+	}
+	if err := execOne(ctx, tx.StmtContext(ctx, m.StmtChangeUserEmail), c.NewEmail, c.User, c.OldEmail); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MariaDB) UndoEmailChange(ctx context.Context, c EmailChange) (ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+	if err := execOne(ctx, tx.StmtContext(ctx, m.StmtUndoEmailChanges), c.User, c.ID); err != nil {
+		return err
+	}
+	// The address may have been changed more than once since, the old one
+	// is restored in any case.
+	if _, err := tx.StmtContext(ctx, m.StmtRestoreUserEmail).ExecContext(ctx, c.OldEmail, c.User); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MariaDB) EventsCreatedBy(ctx context.Context, user UserID) ([]Event, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtEventsCreatedBy.QueryContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		e := Event{}
+		if err := rows.Scan(&e.ID, &e.CreatedBy, &e.Title, &e.Description, &e.RepeatsEvery, &e.RepeatsScale, &e.MinParticipants, &e.MaxParticipants); err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (m *MariaDB) EventRegistrationsOfUser(ctx context.Context, user UserID) ([]EventRegistration, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtEventRegistrationsOfUser.QueryContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	regs := []EventRegistration{}
+	for rows.Next() {
+		reg := EventRegistration{}
+		if err := rows.Scan(&reg.ID, &reg.User, &reg.Event, &reg.Message); err != nil {
+			return regs, err
+		}
+		regs = append(regs, reg)
+	}
+	return regs, rows.Err()
+}
+
+func (m *MariaDB) EmailChanges(ctx context.Context, user UserID) ([]EmailChange, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtEmailChanges.QueryContext(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []EmailChange{}
+	for rows.Next() {
+		c := EmailChange{}
+		if err := rows.Scan(&c.ID, &c.User, &c.OldEmail, &c.NewEmail, &c.ConfirmHash, &c.UndoHash, &c.RequestedAt, &c.ConfirmedAt, &c.UndoneAt); err != nil {
+			return changes, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (m *MariaDB) DeleteUser(ctx context.Context, id UserID) (ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+	if err := execOne(ctx, tx.StmtContext(ctx, m.StmtAnonymizeUser), id); err != nil {
+		return err
+	}
+	stmts := []*sql.Stmt{
+		m.StmtDeleteEventsCreatedBy,
+		m.StmtDeleteRegistrationsOfUser,
+		m.StmtDeletePasskeys,
+		m.StmtDeleteRecoveryCodes,
+		m.StmtDeleteTotpSecret,
+		m.StmtDeleteApiTokens,
+		m.StmtDeleteEmailChanges,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *MariaDB) AppendAuditEntry(ctx context.Context, entry AuditEntry) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	_, err := m.StmtAppendAuditEntry.ExecContext(ctx, nullUser(entry.User), nullUser(entry.Actor), entry.Action, entry.Detail, entry.IP, entry.UserAgent)
+	return err
+}
+
+func (m *MariaDB) AuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtAuditEntries.QueryContext(ctx,
+		filter.User, filter.User,
+		filter.Action, filter.Action,
+		filter.Before, filter.Before,
+		filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			e           AuditEntry
+			user, actor sql.NullInt64
+		)
+		if err := rows.Scan(&e.ID, &user, &actor, &e.Action, &e.Detail, &e.IP, &e.UserAgent, &e.CreatedAt); err != nil {
+			return entries, err
+		}
+		e.User = UserID(user.Int64)
+		e.Actor = UserID(actor.Int64)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (m *MariaDB) DeleteEvent(ctx context.Context, id EventID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return execOne(ctx, m.StmtDeleteEvent, id)
+}
+
+func (m *MariaDB) DeletedEvents(ctx context.Context, user UserID) ([]DeletedEvent, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtDeletedEvents.QueryContext(ctx, user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []DeletedEvent{}
+	for rows.Next() {
+		var e DeletedEvent
+		err := rows.Scan(&e.ID, &e.CreatedBy, &e.Title, &e.Description, &e.RepeatsEvery, &e.RepeatsScale, &e.MinParticipants, &e.MaxParticipants, &e.DeletedAt)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (m *MariaDB) RestoreEvent(ctx context.Context, id EventID, user UserID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return execOne(ctx, m.StmtRestoreEvent, id, user, user)
+}
+
+func (m *MariaDB) DeletedEventRegistrations(ctx context.Context, user UserID) ([]DeletedEventRegistration, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	rows, err := m.StmtDeletedEventRegistrations.QueryContext(ctx, user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	regs := []DeletedEventRegistration{}
+	for rows.Next() {
+		var r DeletedEventRegistration
+		if err := rows.Scan(&r.ID, &r.User, &r.Event, &r.Message, &r.EventTitle, &r.DeletedAt); err != nil {
+			return regs, err
+		}
+		regs = append(regs, r)
+	}
+	return regs, rows.Err()
+}
+
+func (m *MariaDB) RestoreEventRegistration(ctx context.Context, id EventRegistrationID, user UserID) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	return execOne(ctx, m.StmtRestoreEventRegistration, id, user, user)
+}
+
+func (m *MariaDB) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (n int64, ferr error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+
+	// Registrations go first, they refer to the events.
+	purges := []struct {
+		stmt *sql.Stmt
+		args []any
+	}{
+		{m.StmtPurgeEventRegistrations, []any{deletedBefore, deletedBefore}},
+		{m.StmtPurgeEvents, []any{deletedBefore}},
+	}
+	for _, purge := range purges {
+		res, err := tx.StmtContext(ctx, purge.stmt).ExecContext(ctx, purge.args...)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		n += affected
+	}
+	return n, tx.Commit()
+}
+
+// withTimeout derives the context for a single call, transactions count as
+// one call.
+func (m *MariaDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.queryTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// prepare adapts the placeholders of query to the dialect.
+func (m *MariaDB) prepare(db *sql.DB, query string) (*sql.Stmt, error) {
+	return db.Prepare(rebind(m.dialect, query))
+}
+
+// returningID makes an insert return the id of the new row, where the driver
+// doesn't support LastInsertId. The statement must be run with insertID.
+func (m *MariaDB) returningID(query string) string {
+	if m.dialect != DialectPostgres {
+		return query
+	}
+	return strings.TrimSuffix(query, ";") + " returning id;"
+}
+
+// insertID runs an insert prepared with returningID and returns the id of
+// the new row.
+func (m *MariaDB) insertID(ctx context.Context, stmt *sql.Stmt, args ...any) (int64, error) {
+	if m.dialect == DialectPostgres {
+		var id int64
+		err := stmt.QueryRowContext(ctx, args...).Scan(&id)
+		return id, err
+	}
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// execOne fails with sql.ErrNoRows if stmt didn't affect any row.
+func execOne(ctx context.Context, stmt *sql.Stmt, args ...any) error {
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func nullUser(id UserID) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{
+		Time: t,
+		Valid: !t.IsZero(),
+	}
+}
+
+// The statements in standard SQL, for the dialects that don't understand
+// MySQL's syntax.
+
+const standardSaveSession = `insert into sessions (
+		id_hash,
+		user_id,
+		authenticated,
+		created_at,
+		login_token_hash,
+		login_created_at,
+		login_valid,
+		second_factor_pending,
+		second_factor_attempts,
+		login_code_hash,
+		login_code_created_at,
+		login_code_valid,
+		login_code_attempts,
+		last_seen_at,
+		ip,
+		user_agent,
+		impersonator_id
+	) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	on conflict (id_hash) do update set
+		user_id = excluded.user_id,
+		authenticated = excluded.authenticated,
+		login_token_hash = excluded.login_token_hash,
+		login_created_at = excluded.login_created_at,
+		login_valid = excluded.login_valid,
+		second_factor_pending = excluded.second_factor_pending,
+		second_factor_attempts = excluded.second_factor_attempts,
+		login_code_hash = excluded.login_code_hash,
+		login_code_created_at = excluded.login_code_created_at,
+		login_code_valid = excluded.login_code_valid,
+		login_code_attempts = excluded.login_code_attempts,
+		last_seen_at = excluded.last_seen_at,
+		ip = excluded.ip,
+		user_agent = excluded.user_agent,
+		impersonator_id = excluded.impersonator_id;`
+
+const standardSaveTotpSecret = `insert into totp_secrets (user_id, secret) values (?, ?)
+	on conflict (user_id) do update set
+		secret = excluded.secret,
+		last_step = 0,
+		created_at = current_timestamp,
+		confirmed_at = null;`
+
+// Neither SQLite nor Postgres support limit on updates.
+const standardUseRecoveryCode = `update recovery_codes set used_at = current_timestamp
+	where id = (
+		select id from recovery_codes
+		where user_id = ? and code_hash = ? and used_at is null
+		limit 1);`
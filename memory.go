@@ -0,0 +1,803 @@
+package organizer
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepository keeps everything in process memory, it is meant for tests
+// and trying things out. It behaves like the SQL repositories: deleted users,
+// events and registrations are only marked as such, and lookups of missing
+// rows fail with sql.ErrNoRows. Contexts are ignored, nothing in here blocks
+// for long.
+type MemoryRepository struct {
+	*MemorySessionStore
+
+	mu            sync.Mutex
+	users         map[UserID]memoryUser
+	events        map[EventID]memoryEvent
+	registrations map[EventRegistrationID]memoryRegistration
+	passkeys      map[PasskeyID]Passkey
+	totpSecrets   map[UserID]TotpSecret
+	recoveryCodes map[UserID][]memoryRecoveryCode
+	apiTokens     map[ApiTokenID]ApiToken
+	emailChanges  map[EmailChangeID]EmailChange
+	auditLog      []AuditEntry
+	lastID        int
+}
+
+type (
+	memoryUser struct {
+		User
+		softDelete
+	}
+	memoryEvent struct {
+		Event
+		softDelete
+	}
+	memoryRegistration struct {
+		EventRegistration
+		softDelete
+	}
+	// softDelete stands in for the deleted_at column.
+	softDelete struct {
+		deletedAt time.Time
+	}
+	memoryRecoveryCode struct {
+		hash []byte
+		used bool
+	}
+)
+
+var _ Repository = (*MemoryRepository)(nil)
+
+func (d softDelete) deleted() bool {
+	return !d.deletedAt.IsZero()
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		MemorySessionStore: NewMemorySessionStore(),
+		users:              map[UserID]memoryUser{},
+		events:             map[EventID]memoryEvent{},
+		registrations:      map[EventRegistrationID]memoryRegistration{},
+		passkeys:           map[PasskeyID]Passkey{},
+		totpSecrets:        map[UserID]TotpSecret{},
+		recoveryCodes:      map[UserID][]memoryRecoveryCode{},
+		apiTokens:          map[ApiTokenID]ApiToken{},
+		emailChanges:       map[EmailChangeID]EmailChange{},
+	}
+}
+
+// Prepare does nothing, there is no database to prepare for.
+func (m *MemoryRepository) Prepare(db *sql.DB) error {
+	return nil
+}
+
+// nextID must be called with m.mu held. IDs are unique across all tables,
+// which is fine as long as nobody relies on them being dense.
+func (m *MemoryRepository) nextID() int {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *MemoryRepository) User(ctx context.Context, id UserID) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.deleted() {
+		return User{}, sql.ErrNoRows
+	}
+	return u.User, nil
+}
+
+func (m *MemoryRepository) UserByEmail(ctx context.Context, email string) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.userByEmail(email)
+	if !ok || m.users[id].deleted() {
+		return User{}, sql.ErrNoRows
+	}
+	return m.users[id].User, nil
+}
+
+// userByEmail must be called with m.mu held.
+func (m *MemoryRepository) userByEmail(email string) (UserID, bool) {
+	for id, u := range m.users {
+		if u.Email == email {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (m *MemoryRepository) CreateUser(ctx context.Context, user User) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, taken := m.userByEmail(user.Email); taken {
+		return user, fmt.Errorf("duplicate email: %s", user.Email)
+	}
+	user.ID = UserID(m.nextID())
+	user.ActivatedAt = sql.NullTime{}
+	m.users[user.ID] = memoryUser{User: user}
+	return user, nil
+}
+
+func (m *MemoryRepository) ActivateUser(ctx context.Context, id UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if ok && !u.deleted() && !u.ActivatedAt.Valid {
+		u.ActivatedAt = nullTime(time.Now().UTC())
+		m.users[id] = u
+	}
+	return nil
+}
+
+func (m *MemoryRepository) Users(ctx context.Context) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []User{}
+	for _, u := range m.users {
+		if !u.deleted() {
+			users = append(users, u.User)
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), int(a.ID-b.ID))
+	})
+	return users, nil
+}
+
+func (m *MemoryRepository) SetUserRole(ctx context.Context, id UserID, role Role) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[id]; ok && !u.deleted() {
+		u.Role = role
+		m.users[id] = u
+	}
+	return nil
+}
+
+func (m *MemoryRepository) SetUserDisabled(ctx context.Context, id UserID, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[id]; ok && !u.deleted() {
+		u.DisabledAt = sql.NullTime{}
+		if disabled {
+			u.DisabledAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+		m.users[id] = u
+	}
+	return nil
+}
+
+func (m *MemoryRepository) Event(ctx context.Context, id EventID) (Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[id]
+	if !ok || e.deleted() {
+		return Event{}, sql.ErrNoRows
+	}
+	return m.withParticipants(e.Event), nil
+}
+
+// withParticipants must be called with m.mu held.
+func (m *MemoryRepository) withParticipants(e Event) Event {
+	e.NumberOfParticipants = 0
+	for _, reg := range m.registrations {
+		if reg.Event == e.ID && !reg.deleted() {
+			e.NumberOfParticipants++
+		}
+	}
+	return e
+}
+
+func (m *MemoryRepository) CreateEvent(ctx context.Context, event Event) (Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event.ID = EventID(m.nextID())
+	event.NumberOfParticipants = 0
+	m.events[event.ID] = memoryEvent{Event: event}
+	return event, nil
+}
+
+func (m *MemoryRepository) RegisterEvent(ctx context.Context, reg EventRegistration) (EventRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.events[reg.Event]; !ok || e.deleted() {
+		return reg, sql.ErrNoRows
+	}
+	// Like the unique key of the database, there is at most one
+	// registration per user and event, which is revived on reregistering.
+	for id, old := range m.registrations {
+		if old.User == reg.User && old.Event == reg.Event {
+			reg.ID = id
+			m.registrations[id] = memoryRegistration{EventRegistration: reg}
+			return reg, nil
+		}
+	}
+	reg.ID = EventRegistrationID(m.nextID())
+	m.registrations[reg.ID] = memoryRegistration{EventRegistration: reg}
+	return reg, nil
+}
+
+func (m *MemoryRepository) DeregisterEvent(ctx context.Context, id EventRegistrationID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reg, ok := m.registrations[id]; ok && !reg.deleted() {
+		reg.deletedAt = time.Now().UTC()
+		m.registrations[id] = reg
+	}
+	return nil
+}
+
+func (m *MemoryRepository) Events(ctx context.Context, q EventQuery) ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	search := strings.ToLower(q.Search)
+	registered := func(e Event) bool {
+		for _, reg := range m.registrations {
+			if reg.Event == e.ID && reg.User == q.RegisteredBy && !reg.deleted() {
+				return true
+			}
+		}
+		return false
+	}
+	matches := func(e Event) bool {
+		return (search == "" || strings.Contains(strings.ToLower(e.Title), search) || strings.Contains(strings.ToLower(e.Description), search)) &&
+			(!q.Repeating.Valid || q.Repeating.Bool == (e.RepeatsScale != RepeatsNever)) &&
+			(!q.HasFreeSpots || !e.MaxParticipants.Valid || int64(e.NumberOfParticipants) < e.MaxParticipants.Int64) &&
+			(q.CreatedBy == 0 || e.CreatedBy == q.CreatedBy) &&
+			(q.RegisteredBy == 0 || registered(e))
+	}
+	events := m.eventsWhere(func(e memoryEvent) bool { return !e.deleted() }, true)
+	events = slices.DeleteFunc(events, func(e Event) bool { return !matches(e) })
+
+	// after reports whether e comes after the cursor.
+	var after func(e Event) bool
+	switch q.Sort {
+	case SortNewest:
+		slices.Reverse(events)
+		after = func(e Event) bool { return e.ID < q.After.ID }
+	case SortTitle:
+		slices.SortStableFunc(events, func(a, b Event) int { return cmp.Compare(a.Title, b.Title) })
+		after = func(e Event) bool {
+			return cmp.Or(cmp.Compare(e.Title, q.After.Title), cmp.Compare(e.ID, q.After.ID)) > 0
+		}
+	default:
+		after = func(e Event) bool { return e.ID > q.After.ID }
+	}
+	if !q.After.IsZero() {
+		events = slices.DeleteFunc(events, func(e Event) bool { return !after(e) })
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
+
+func (m *MemoryRepository) EventsCreatedBy(ctx context.Context, user UserID) ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.eventsWhere(func(e memoryEvent) bool { return !e.deleted() && e.CreatedBy == user }, false), nil
+}
+
+// eventsWhere must be called with m.mu held.
+func (m *MemoryRepository) eventsWhere(match func(memoryEvent) bool, count bool) []Event {
+	events := []Event{}
+	for _, e := range m.events {
+		if !match(e) {
+			continue
+		}
+		if count {
+			events = append(events, m.withParticipants(e.Event))
+		} else {
+			events = append(events, e.Event)
+		}
+	}
+	slices.SortFunc(events, func(a, b Event) int { return int(a.ID - b.ID) })
+	return events
+}
+
+func (m *MemoryRepository) EventRegistration(ctx context.Context, id EventRegistrationID) (EventRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reg, ok := m.registrations[id]
+	if !ok || reg.deleted() {
+		return EventRegistration{}, sql.ErrNoRows
+	}
+	return reg.EventRegistration, nil
+}
+
+func (m *MemoryRepository) EventRegistrations(ctx context.Context, eventID EventID) ([]EventRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.registrationsWhere(func(reg memoryRegistration) bool { return reg.Event == eventID }), nil
+}
+
+func (m *MemoryRepository) EventRegistrationsOfUser(ctx context.Context, user UserID) ([]EventRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.registrationsWhere(func(reg memoryRegistration) bool { return reg.User == user }), nil
+}
+
+// registrationsWhere must be called with m.mu held.
+func (m *MemoryRepository) registrationsWhere(match func(memoryRegistration) bool) []EventRegistration {
+	regs := []EventRegistration{}
+	for _, reg := range m.registrations {
+		if !reg.deleted() && match(reg) {
+			regs = append(regs, reg.EventRegistration)
+		}
+	}
+	slices.SortFunc(regs, func(a, b EventRegistration) int { return int(a.ID - b.ID) })
+	return regs
+}
+
+func (m *MemoryRepository) Passkeys(ctx context.Context, user UserID) ([]Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	passkeys := []Passkey{}
+	for _, p := range m.passkeys {
+		if p.User == user {
+			passkeys = append(passkeys, p)
+		}
+	}
+	slices.SortFunc(passkeys, func(a, b Passkey) int { return int(a.ID - b.ID) })
+	return passkeys, nil
+}
+
+func (m *MemoryRepository) PasskeyByCredentialID(ctx context.Context, credentialID []byte) (Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.passkeys {
+		if bytes.Equal(p.CredentialID, credentialID) {
+			return p, nil
+		}
+	}
+	return Passkey{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) CreatePasskey(ctx context.Context, p Passkey) (Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.passkeys {
+		if bytes.Equal(other.CredentialID, p.CredentialID) {
+			return p, fmt.Errorf("duplicate credential id")
+		}
+	}
+	p.ID = PasskeyID(m.nextID())
+	p.CreatedAt = time.Now().UTC()
+	m.passkeys[p.ID] = p
+	return p, nil
+}
+
+func (m *MemoryRepository) UpdatePasskeySignCount(ctx context.Context, id PasskeyID, signCount uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.passkeys[id]; ok {
+		p.SignCount = signCount
+		p.LastUsedAt = nullTime(time.Now().UTC())
+		m.passkeys[id] = p
+	}
+	return nil
+}
+
+func (m *MemoryRepository) DeletePasskey(ctx context.Context, id PasskeyID, user UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.passkeys[id]
+	if !ok || p.User != user {
+		return sql.ErrNoRows
+	}
+	delete(m.passkeys, id)
+	return nil
+}
+
+func (m *MemoryRepository) TotpSecret(ctx context.Context, user UserID) (TotpSecret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totpSecrets[user]
+	if !ok {
+		return TotpSecret{}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (m *MemoryRepository) SaveTotpSecret(ctx context.Context, t TotpSecret) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totpSecrets[t.User] = TotpSecret{User: t.User, Secret: t.Secret}
+	return nil
+}
+
+func (m *MemoryRepository) ConfirmTotpSecret(ctx context.Context, user UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.totpSecrets[user]; ok {
+		t.ConfirmedAt = nullTime(time.Now().UTC())
+		m.totpSecrets[user] = t
+	}
+	return nil
+}
+
+func (m *MemoryRepository) UseTotpStep(ctx context.Context, user UserID, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totpSecrets[user]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+	t.LastStep = step
+	m.totpSecrets[user] = t
+	return true, nil
+}
+
+func (m *MemoryRepository) DeleteTotpSecret(ctx context.Context, user UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.recoveryCodes, user)
+	delete(m.totpSecrets, user)
+	return nil
+}
+
+func (m *MemoryRepository) SetRecoveryCodes(ctx context.Context, user UserID, hashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := make([]memoryRecoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		codes = append(codes, memoryRecoveryCode{hash: hash})
+	}
+	m.recoveryCodes[user] = codes
+	return nil
+}
+
+func (m *MemoryRepository) UseRecoveryCode(ctx context.Context, user UserID, hash []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	codes := m.recoveryCodes[user]
+	for i := range codes {
+		if !codes[i].used && bytes.Equal(codes[i].hash, hash) {
+			codes[i].used = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryRepository) ApiTokens(ctx context.Context, user UserID) ([]ApiToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := []ApiToken{}
+	for _, t := range m.apiTokens {
+		if t.User == user {
+			tokens = append(tokens, t)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b ApiToken) int { return int(a.ID - b.ID) })
+	return tokens, nil
+}
+
+func (m *MemoryRepository) ApiTokenByHash(ctx context.Context, hash TokenHash) (ApiToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.apiTokens {
+		if t.Hash.Equal(hash) {
+			return t, nil
+		}
+	}
+	return ApiToken{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) CreateApiToken(ctx context.Context, t ApiToken) (ApiToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.ID = ApiTokenID(m.nextID())
+	t.CreatedAt = time.Now().UTC()
+	m.apiTokens[t.ID] = t
+	return t, nil
+}
+
+func (m *MemoryRepository) TouchApiToken(ctx context.Context, id ApiTokenID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.apiTokens[id]; ok {
+		t.LastUsedAt = nullTime(time.Now().UTC())
+		m.apiTokens[id] = t
+	}
+	return nil
+}
+
+func (m *MemoryRepository) DeleteApiToken(ctx context.Context, id ApiTokenID, user UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.apiTokens[id]
+	if !ok || t.User != user {
+		return sql.ErrNoRows
+	}
+	delete(m.apiTokens, id)
+	return nil
+}
+
+func (m *MemoryRepository) CreateEmailChange(ctx context.Context, c EmailChange) (EmailChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c.ID = EmailChangeID(m.nextID())
+	c.RequestedAt = time.Now().UTC()
+	m.emailChanges[c.ID] = c
+	return c, nil
+}
+
+func (m *MemoryRepository) EmailChangeByConfirmHash(ctx context.Context, hash TokenHash) (EmailChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.emailChanges {
+		if c.ConfirmHash.Equal(hash) {
+			return c, nil
+		}
+	}
+	return EmailChange{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) EmailChangeByUndoHash(ctx context.Context, hash TokenHash) (EmailChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.emailChanges {
+		if !c.UndoHash.IsZero() && c.UndoHash.Equal(hash) {
+			return c, nil
+		}
+	}
+	return EmailChange{}, sql.ErrNoRows
+}
+
+func (m *MemoryRepository) ConfirmEmailChange(ctx context.Context, c EmailChange, undoHash TokenHash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.emailChanges[c.ID]
+	if !ok || stored.ConfirmedAt.Valid || stored.UndoneAt.Valid {
+		return sql.ErrNoRows
+	}
+	u, ok := m.users[c.User]
+	if !ok || u.Email != c.OldEmail {
+		return sql.ErrNoRows
+	}
+	if _, taken := m.userByEmail(c.NewEmail); taken {
+		return fmt.Errorf("duplicate email: %s", c.NewEmail)
+	}
+	stored.ConfirmedAt = nullTime(time.Now().UTC())
+	stored.UndoHash = undoHash
+	m.emailChanges[c.ID] = stored
+	u.Email = c.NewEmail
+	m.users[c.User] = u
+	return nil
+}
+
+func (m *MemoryRepository) UndoEmailChange(ctx context.Context, c EmailChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := nullTime(time.Now().UTC())
+	n := 0
+	for id, other := range m.emailChanges {
+		if other.User == c.User && id >= c.ID && !other.UndoneAt.Valid {
+			other.UndoneAt = now
+			m.emailChanges[id] = other
+			n++
+		}
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	if u, ok := m.users[c.User]; ok {
+		u.Email = c.OldEmail
+		m.users[c.User] = u
+	}
+	return nil
+}
+
+func (m *MemoryRepository) EmailChanges(ctx context.Context, user UserID) ([]EmailChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes := []EmailChange{}
+	for _, c := range m.emailChanges {
+		if c.User == user {
+			changes = append(changes, c)
+		}
+	}
+	slices.SortFunc(changes, func(a, b EmailChange) int { return int(a.ID - b.ID) })
+	return changes, nil
+}
+
+func (m *MemoryRepository) DeleteUser(ctx context.Context, id UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok || u.deleted() {
+		return sql.ErrNoRows
+	}
+	now := time.Now().UTC()
+	m.users[id] = memoryUser{
+		User: User{
+			ID:          id,
+			Name:        "deleted",
+			Display:     sql.NullString{Valid: true},
+			Email:       fmt.Sprintf("deleted-%d@invalid", id),
+			ActivatedAt: u.ActivatedAt,
+			Role:        RoleUser,
+		},
+		softDelete: softDelete{now},
+	}
+	for eid, e := range m.events {
+		if e.CreatedBy == id && !e.deleted() {
+			e.deletedAt = now
+			m.events[eid] = e
+		}
+	}
+	for rid, reg := range m.registrations {
+		if reg.User == id {
+			reg.Message = sql.NullString{}
+			reg.deletedAt = now
+			m.registrations[rid] = reg
+		}
+	}
+	for pid, p := range m.passkeys {
+		if p.User == id {
+			delete(m.passkeys, pid)
+		}
+	}
+	delete(m.recoveryCodes, id)
+	delete(m.totpSecrets, id)
+	for tid, t := range m.apiTokens {
+		if t.User == id {
+			delete(m.apiTokens, tid)
+		}
+	}
+	for cid, c := range m.emailChanges {
+		if c.User == id {
+			delete(m.emailChanges, cid)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRepository) AppendAuditEntry(ctx context.Context, entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ID = AuditEntryID(len(m.auditLog) + 1)
+	entry.CreatedAt = time.Now().UTC()
+	m.auditLog = append(m.auditLog, entry)
+	return nil
+}
+
+func (m *MemoryRepository) AuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []AuditEntry{}
+	for i := len(m.auditLog) - 1; i >= 0 && len(entries) < filter.Limit; i-- {
+		e := m.auditLog[i]
+		if filter.User != 0 && e.User != filter.User {
+			continue
+		}
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		if filter.Before != 0 && e.ID >= filter.Before {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (m *MemoryRepository) DeleteEvent(ctx context.Context, id EventID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[id]
+	if !ok || e.deleted() {
+		return sql.ErrNoRows
+	}
+	e.deletedAt = time.Now().UTC()
+	m.events[id] = e
+	return nil
+}
+
+func (m *MemoryRepository) DeletedEvents(ctx context.Context, user UserID) ([]DeletedEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []DeletedEvent{}
+	for _, e := range m.events {
+		if m.restorableEvent(e, user) {
+			events = append(events, DeletedEvent{Event: e.Event, DeletedAt: e.deletedAt})
+		}
+	}
+	slices.SortFunc(events, func(a, b DeletedEvent) int {
+		return cmp.Or(b.DeletedAt.Compare(a.DeletedAt), int(b.ID-a.ID))
+	})
+	return events, nil
+}
+
+// restorableEvent must be called with m.mu held.
+func (m *MemoryRepository) restorableEvent(e memoryEvent, user UserID) bool {
+	return e.deleted() &&
+		!m.users[e.CreatedBy].deleted() &&
+		(user == 0 || e.CreatedBy == user)
+}
+
+func (m *MemoryRepository) RestoreEvent(ctx context.Context, id EventID, user UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.events[id]
+	if !ok || !m.restorableEvent(e, user) {
+		return sql.ErrNoRows
+	}
+	e.deletedAt = time.Time{}
+	m.events[id] = e
+	return nil
+}
+
+func (m *MemoryRepository) DeletedEventRegistrations(ctx context.Context, user UserID) ([]DeletedEventRegistration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	regs := []DeletedEventRegistration{}
+	for _, reg := range m.registrations {
+		if m.restorableRegistration(reg, user) {
+			regs = append(regs, DeletedEventRegistration{
+				EventRegistration: reg.EventRegistration,
+				EventTitle:        m.events[reg.Event].Title,
+				DeletedAt:         reg.deletedAt,
+			})
+		}
+	}
+	slices.SortFunc(regs, func(a, b DeletedEventRegistration) int {
+		return cmp.Or(b.DeletedAt.Compare(a.DeletedAt), int(b.ID-a.ID))
+	})
+	return regs, nil
+}
+
+// restorableRegistration must be called with m.mu held.
+func (m *MemoryRepository) restorableRegistration(reg memoryRegistration, user UserID) bool {
+	e, ok := m.events[reg.Event]
+	return reg.deleted() &&
+		ok && !e.deleted() &&
+		!m.users[reg.User].deleted() &&
+		(user == 0 || reg.User == user)
+}
+
+func (m *MemoryRepository) RestoreEventRegistration(ctx context.Context, id EventRegistrationID, user UserID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reg, ok := m.registrations[id]
+	if !ok || !m.restorableRegistration(reg, user) {
+		return sql.ErrNoRows
+	}
+	reg.deletedAt = time.Time{}
+	m.registrations[id] = reg
+	return nil
+}
+
+func (m *MemoryRepository) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	purged := func(d softDelete) bool {
+		return d.deleted() && d.deletedAt.Before(deletedBefore)
+	}
+	for id, reg := range m.registrations {
+		if purged(reg.softDelete) || purged(m.events[reg.Event].softDelete) {
+			delete(m.registrations, id)
+			n++
+		}
+	}
+	for id, e := range m.events {
+		if purged(e.softDelete) {
+			delete(m.events, id)
+			n++
+		}
+	}
+	return n, nil
+}
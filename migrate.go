@@ -0,0 +1,294 @@
+package organizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// steps are the statements that apply (up) and revert (down) a migration.
+type steps struct {
+	up, down []string
+}
+
+// checksum identifies the up steps, which are what has been run on a
+// database. It is recorded along with the version, so that a migration
+// changed after the fact doesn't go unnoticed.
+func (s steps) checksum() string {
+	h := sha256.New()
+	for _, step := range s.up {
+		io.WriteString(h, step)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// migration is a named version of the schema, with the steps to get there
+// for each dialect. Empty steps mean there is nothing to do for that
+// dialect: SQLite and Postgres databases are created in one go, alongside
+// m14.
+type migration struct {
+	version                 int64
+	name                    string
+	mysql, sqlite, postgres steps
+}
+
+func (m migration) For(dialect Dialect) steps {
+	switch dialect {
+	case DialectSQLite:
+		return m.sqlite
+	case DialectPostgres:
+		return m.postgres
+	}
+	return m.mysql
+}
+
+// LatestVersion is the version of the newest migration. The statements of
+// the repositories are written against it.
+var LatestVersion = migrations[len(migrations)-1].version
+
+var (
+	ErrMigrationModified = errors.New("migration was modified after it had been applied")
+	ErrUnknownVersion    = errors.New("unknown schema version")
+)
+
+// MigrationStatus describes a migration and whether it has been applied to
+// a database.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Modified is set if the steps of an applied migration no longer match
+	// the checksum recorded when it ran.
+	Modified bool
+}
+
+// MigrateOptions control a call to Migrate.
+type MigrateOptions struct {
+	// Target is the version to migrate to. Migrations up to it are applied,
+	// those above it reverted. Use LatestVersion to apply all of them, zero
+	// to revert all of them.
+	Target int64
+	// DryRun, if set, receives the statements instead of the database. Only
+	// the migrations table itself may be created or upgraded.
+	DryRun io.Writer
+}
+
+// migrate brings the database to the latest version.
+func migrate(db *sql.DB, dialect Dialect) error {
+	return Migrate(context.Background(), db, dialect, MigrateOptions{Target: LatestVersion})
+}
+
+// Migrate applies or reverts migrations until the database is at the target
+// version. Each migration runs in a transaction of its own. It refuses to
+// run if an applied migration has been modified, or if the database is at a
+// version this build doesn't know about.
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect, opts MigrateOptions) error {
+	if opts.Target < 0 || opts.Target > LatestVersion {
+		return fmt.Errorf("%w: %d", ErrUnknownVersion, opts.Target)
+	}
+	if err := prepareMigrationTable(ctx, db, dialect); err != nil {
+		return err
+	}
+	if opts.DryRun == nil {
+		if err := recordChecksums(ctx, db, dialect); err != nil {
+			return err
+		}
+	}
+	status, currentVersion, err := migrationStatus(ctx, db, dialect)
+	if err != nil {
+		return err
+	}
+	if currentVersion > LatestVersion {
+		return fmt.Errorf("%w: database is at version %d, but the latest known is %d", ErrUnknownVersion, currentVersion, LatestVersion)
+	}
+	for _, st := range status {
+		if st.Modified {
+			return fmt.Errorf("%w: %d %s", ErrMigrationModified, st.Version, st.Name)
+		}
+	}
+
+	if currentVersion != opts.Target && opts.DryRun == nil {
+		log.Printf("migrating database from version %d to %d", currentVersion, opts.Target)
+	}
+	for _, m := range migrations {
+		if m.version > currentVersion && m.version <= opts.Target {
+			if err := runMigration(ctx, db, dialect, m, true, opts.DryRun); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= currentVersion && m.version > opts.Target {
+			if err := runMigration(ctx, db, dialect, m, false, opts.DryRun); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.DryRun == nil {
+		log.Printf("database v%d up to date", opts.Target)
+	}
+	return nil
+}
+
+// Migrations reports the status of every known migration. Like a dry run,
+// it may create or upgrade the migrations table.
+func Migrations(ctx context.Context, db *sql.DB, dialect Dialect) ([]MigrationStatus, error) {
+	if err := prepareMigrationTable(ctx, db, dialect); err != nil {
+		return nil, err
+	}
+	status, _, err := migrationStatus(ctx, db, dialect)
+	return status, err
+}
+
+func migrationStatus(ctx context.Context, db *sql.DB, dialect Dialect) (status []MigrationStatus, currentVersion int64, err error) {
+	type applied struct {
+		checksum  sql.NullString
+		appliedAt time.Time
+	}
+	rows, err := db.QueryContext(ctx, "select version, checksum, created_at from migrations;")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read migration table: %w", err)
+	}
+	defer rows.Close()
+	versions := map[int64]applied{}
+	for rows.Next() {
+		var (
+			version int64
+			a       applied
+		)
+		if err := rows.Scan(&version, &a.checksum, &a.appliedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to read migration table: %w", err)
+		}
+		versions[version] = a
+		currentVersion = max(currentVersion, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read migration table: %w", err)
+	}
+
+	for _, m := range migrations {
+		st := MigrationStatus{
+			Version: m.version,
+			Name:    m.name,
+		}
+		if a, ok := versions[m.version]; ok {
+			st.Applied = true
+			st.AppliedAt = a.appliedAt
+			st.Modified = a.checksum.Valid && a.checksum.String != m.For(dialect).checksum()
+		}
+		status = append(status, st)
+	}
+	return status, currentVersion, nil
+}
+
+// prepareMigrationTable creates the table that keeps track of the applied
+// migrations, or adds the name and checksum columns to one that predates
+// them.
+func prepareMigrationTable(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	// For MariaDB, the table is created by create_database.sql.
+	if dialect != DialectMySQL {
+		_, err := db.ExecContext(ctx,
+			`create table if not exists migrations (
+				version integer primary key,
+				name varchar(64) not null default '',
+				checksum char(64) default null,
+				created_at timestamp not null default current_timestamp
+			);`)
+		if err != nil {
+			return fmt.Errorf("failed to create migration table: %w", err)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, "select name, checksum from migrations where 1 = 0;")
+	if err == nil {
+		return rows.Close()
+	}
+	steps := []string{
+		"alter table migrations add column name varchar(64) not null default '';",
+		"alter table migrations add column checksum char(64) default null;",
+	}
+	for _, step := range steps {
+		if _, err := db.ExecContext(ctx, step); err != nil {
+			return fmt.Errorf("failed to upgrade migration table: %w", err)
+		}
+	}
+	return nil
+}
+
+// recordChecksums fills in the name and checksum of migrations that were
+// applied before either was recorded. They are trusted to be unchanged.
+func recordChecksums(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	update := rebind(dialect, "update migrations set name = ?, checksum = ? where version = ? and checksum is null;")
+	for _, m := range migrations {
+		res, err := db.ExecContext(ctx, update, m.name, m.For(dialect).checksum(), m.version)
+		if err != nil {
+			return fmt.Errorf("migration %d: failed to record checksum: %w", m.version, err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			log.Printf("migration %d: recorded checksum", m.version)
+		}
+	}
+	return nil
+}
+
+// runMigration applies (up) or reverts (down) a single migration and
+// updates the migrations table accordingly.
+func runMigration(ctx context.Context, db *sql.DB, dialect Dialect, m migration, up bool, dryRun io.Writer) (ferr error) {
+	s := m.For(dialect)
+	direction, stmts := "up", s.up
+	if !up {
+		direction, stmts = "down", s.down
+	}
+
+	if dryRun != nil {
+		fmt.Fprintf(dryRun, "-- %d %s (%s)\n", m.version, m.name, direction)
+		for _, stmt := range stmts {
+			fmt.Fprintln(dryRun, stmt)
+		}
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("migration %d: failed to start transaction: %w", m.version, err)
+	}
+	defer func() {
+		if ferr != nil {
+			ferr = errors.Join(ferr, tx.Rollback())
+		}
+	}()
+	if err := runSteps(ctx, tx, stmts); err != nil {
+		return fmt.Errorf("migration %d: failed to migrate %s: %w", m.version, direction, err)
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, rebind(dialect, "insert into migrations (version, name, checksum) values (?, ?, ?);"), m.version, m.name, s.checksum())
+	} else {
+		_, err = tx.ExecContext(ctx, rebind(dialect, "delete from migrations where version = ?;"), m.version)
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d: failed to record version: %w", m.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %d: failed to commit changes: %w", m.version, err)
+	}
+	return nil
+}
+
+func runSteps(ctx context.Context, tx *sql.Tx, steps []string) error {
+	for i, sql := range steps {
+		_, err := tx.ExecContext(ctx, sql)
+		if err != nil {
+			return fmt.Errorf("sql step %d failed: %w", i, err)
+		}
+	}
+	return nil
+}
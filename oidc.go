@@ -0,0 +1,445 @@
+package organizer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relying party side of OpenID Connect (https://openid.net/specs/openid-connect-core-1_0.html),
+// limited to the authorization code flow with PKCE (RFC 7636). The provider
+// is configured from its discovery document, id tokens are verified against
+// its published keys.
+
+type (
+	OidcConfig struct {
+		Issuer       string // e.g. https://id.example.com, without trailing slash
+		ClientID     string
+		ClientSecret string
+		// RedirectURL must point to the /oidc/callback route of the service,
+		// and be registered with the provider.
+		RedirectURL string
+		// Name is shown on the login button.
+		Name string
+		// Client is used for all requests to the provider, defaults to
+		// http.DefaultClient.
+		Client *http.Client
+	}
+	OidcProvider struct {
+		config OidcConfig
+
+		mu        sync.Mutex
+		discovery *oidcDiscovery
+		keys      map[string]crypto.PublicKey
+		keysAt    time.Time
+	}
+	oidcDiscovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JwksURI               string `json:"jwks_uri"`
+	}
+	// OidcIdentity is what the provider vouches for about the user.
+	OidcIdentity struct {
+		Subject       string
+		Email         string
+		EmailVerified bool
+		Name          string
+	}
+	// OidcRequest holds the secrets of one authorization request, they must
+	// be kept by the browser until it returns to the callback.
+	OidcRequest struct {
+		State    string
+		Nonce    string
+		Verifier string
+	}
+	oidcClaims struct {
+		Issuer            string       `json:"iss"`
+		Subject           string       `json:"sub"`
+		Audience          oidcAudience `json:"aud"`
+		AuthorizedParty   string       `json:"azp"`
+		Expires           float64      `json:"exp"`
+		IssuedAt          float64      `json:"iat"`
+		Nonce             string       `json:"nonce"`
+		Email             string       `json:"email"`
+		EmailVerified     any          `json:"email_verified"`
+		Name              string       `json:"name"`
+		PreferredUsername string       `json:"preferred_username"`
+	}
+	oidcAudience []string
+	jsonWebKey   struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+)
+
+const (
+	oidcClockSkew = time.Minute
+	// oidcKeysMinAge limits how often an unknown key id makes us fetch the
+	// provider's keys again.
+	oidcKeysMinAge = 5 * time.Minute
+)
+
+var ErrOidc = errors.New("oidc verification failed")
+
+func oidcError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrOidc, fmt.Sprintf(format, args...))
+}
+
+func NewOidcProvider(config OidcConfig) *OidcProvider {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &OidcProvider{config: config}
+}
+
+func (p *OidcProvider) Name() string {
+	return p.config.Name
+}
+
+// NewOidcRequest creates the secrets for a new authorization request.
+func NewOidcRequest() (OidcRequest, error) {
+	var values [3]string
+	for i := range values {
+		bs := make([]byte, 32)
+		if _, err := rand.Read(bs); err != nil {
+			return OidcRequest{}, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(bs)
+	}
+	return OidcRequest{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// AuthorizationURL returns where to send the browser to log in at the
+// provider.
+func (p *OidcProvider) AuthorizationURL(ctx context.Context, req OidcRequest) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", "openid email profile")
+	params.Set("state", req.State)
+	params.Set("nonce", req.Nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange redeems the authorization code the provider has sent the browser
+// back with, and returns the identity from the verified id token.
+func (p *OidcProvider) Exchange(ctx context.Context, req OidcRequest, code string) (OidcIdentity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", req.Verifier)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := p.doJson(httpReq, &tokens); err != nil {
+		return OidcIdentity{}, fmt.Errorf("token request: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return OidcIdentity{}, oidcError("token response: missing id_token")
+	}
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken, time.Now())
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+	if claims.Nonce != req.Nonce {
+		return OidcIdentity{}, oidcError("id token: nonce mismatch")
+	}
+
+	identity := OidcIdentity{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Name:    claims.Name,
+	}
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		// Some providers send it as a string.
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.Name == "" {
+		identity.Name = claims.PreferredUsername
+	}
+	return identity, nil
+}
+
+func (p *OidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &oidcDiscovery{}
+	if err := p.doJson(req, d); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, oidcError("discovery: issuer %s does not match %s", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, oidcError("discovery: missing endpoints")
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key returns the provider's key with id kid, the keys are fetched again
+// when an unknown id shows up, since providers rotate them.
+func (p *OidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysAt) < oidcKeysMinAge {
+		return nil, oidcError("id token: unknown key %s", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.JwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.doJson(req, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped, the provider may
+		// publish more than we can use.
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	p.keys = keys
+	p.keysAt = time.Now()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, oidcError("id token: unknown key %s", kid)
+}
+
+func (p *OidcProvider) verifyIDToken(ctx context.Context, token string, now time.Time) (oidcClaims, error) {
+	var claims oidcClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, oidcError("id token: malformed")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, oidcError("id token: malformed signature")
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return claims, oidcError("id token: invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		// JWS uses the fixed size r || s encoding, not ASN.1.
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return claims, oidcError("id token: invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return claims, oidcError("id token: invalid signature")
+		}
+	default:
+		return claims, oidcError("id token: unsupported key type")
+	}
+
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	if claims.Issuer != p.config.Issuer {
+		return claims, oidcError("id token: unexpected issuer %s", claims.Issuer)
+	}
+	if !claims.Audience.contains(p.config.ClientID) {
+		return claims, oidcError("id token: not issued for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return claims, oidcError("id token: not authorized for this client")
+	}
+	if now.After(time.Unix(int64(claims.Expires), 0).Add(oidcClockSkew)) {
+		return claims, oidcError("id token: expired")
+	}
+	if now.Add(oidcClockSkew).Before(time.Unix(int64(claims.IssuedAt), 0)) {
+		return claims, oidcError("id token: issued in the future")
+	}
+	if claims.Subject == "" {
+		return claims, oidcError("id token: missing subject")
+	}
+	return claims, nil
+}
+
+func (p *OidcProvider) doJson(req *http.Request, v any) error {
+	res, err := p.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusBadRequest {
+		// The provider turned down what the browser brought back, e.g. an
+		// authorization code that was issued for another request.
+		return oidcError("%s %s: rejected: %s", req.Method, req.URL, bytes.TrimSpace(body))
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %s", req.Method, req.URL, res.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func decodeJwtPart(part string, v any) error {
+	bs, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return oidcError("id token: malformed")
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return oidcError("id token: %v", err)
+	}
+	return nil
+}
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a oidcAudience) contains(aud string) bool {
+	for _, s := range a {
+		if s == aud {
+			return true
+		}
+	}
+	return false
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, oidcError("jwks: invalid RSA exponent")
+		}
+		exp := 0
+		for _, b := range e {
+			exp = exp<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, oidcError("jwks: unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, oidcError("jwks: point not on curve")
+		}
+		return pub, nil
+	default:
+		return nil, oidcError("jwks: unsupported key type %s", k.Kty)
+	}
+}
@@ -0,0 +1,260 @@
+package organizer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is an OpenID provider that logs in everyone who asks. The claims
+// of the id tokens it signs can be tampered with by the test.
+type mockIdP struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+	email    string
+	claims   func(claims map[string]any)
+
+	mu       sync.Mutex
+	requests map[string]url.Values // authorization requests by code
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{
+		t:        t,
+		key:      key,
+		clientID: "organizer",
+		secret:   "client secret",
+		requests: map[string]url.Values{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != idp.clientID ||
+		q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code, err := randomToken(16)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.requests[code] = q
+	idp.mu.Unlock()
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if id, secret, ok := r.BasicAuth(); !ok || id != idp.clientID || secret != url.QueryEscape(idp.secret) {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	idp.mu.Lock()
+	req, ok := idp.requests[r.FormValue("code")]
+	delete(idp.requests, r.FormValue("code"))
+	idp.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || r.FormValue("grant_type") != "authorization_code" ||
+		r.FormValue("redirect_uri") != req.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != req.Get("code_challenge") {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            idp.server.URL,
+		"sub":            "subject-" + idp.email,
+		"aud":            idp.clientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          req.Get("nonce"),
+		"email":          idp.email,
+		"email_verified": true,
+		"name":           "Carol",
+	}
+	if idp.claims != nil {
+		idp.claims(claims)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access token",
+		"token_type":   "Bearer",
+		"id_token":     idp.sign(claims),
+	})
+}
+
+func (idp *mockIdP) sign(claims map[string]any) string {
+	encode := func(v any) string {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			idp.t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(bs)
+	}
+	payload := encode(map[string]string{"alg": "RS256", "kid": "key-1", "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login starts a login at the service, and returns where the provider sends
+// the browser back to.
+func (idp *mockIdP) login(b *testBrowser) string {
+	b.t.Helper()
+	status, hdr, _ := b.get("/oidc/login")
+	if status != http.StatusFound {
+		b.t.Fatalf("oidc login: got status %d", status)
+	}
+	status, hdr, body := b.do(http.NewRequest(http.MethodGet, hdr.Get("Location"), nil))
+	if status != http.StatusFound {
+		b.t.Fatalf("authorize: got status %d: %s", status, body)
+	}
+	return hdr.Get("Location")
+}
+
+func newOidcTestService(t *testing.T) (*testService, *mockIdP) {
+	ts := newTestService(t)
+	idp := newMockIdP(t)
+	ts.auth.oidc = NewOidcProvider(OidcConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.secret,
+		RedirectURL:  ts.server.URL + "/oidc/callback",
+		Name:         "Mock",
+		Client:       idp.server.Client(),
+	})
+	return ts, idp
+}
+
+func TestOidcLogin(t *testing.T) {
+	ts, idp := newOidcTestService(t)
+	idp.email = "carol@example.com"
+	b := ts.browser(t)
+
+	status, hdr, _ := b.do(http.NewRequest(http.MethodGet, idp.login(b), nil))
+	if status != http.StatusSeeOther || hdr.Get("Location") != "/" {
+		t.Fatalf("callback: got status %d, location %q", status, hdr.Get("Location"))
+	}
+	if status, _, _ := b.get("/events"); status != http.StatusOK {
+		t.Errorf("events after login: got status %d", status)
+	}
+	user, err := ts.repo.UserByEmail(context.Background(), "carol@example.com")
+	if err != nil || user.Name != "Carol" {
+		t.Errorf("got user %+v, %v", user, err)
+	}
+}
+
+func TestOidcCallbackRejects(t *testing.T) {
+	ts, idp := newOidcTestService(t)
+	for _, test := range []struct {
+		name   string
+		claims func(claims map[string]any)
+		state  string
+		want   int
+	}{
+		{name: "wrong state", state: "forged", want: http.StatusUnauthorized},
+		{name: "wrong nonce", claims: func(c map[string]any) { c["nonce"] = "replayed" }, want: http.StatusUnauthorized},
+		{name: "wrong audience", claims: func(c map[string]any) { c["aud"] = "someone else" }, want: http.StatusUnauthorized},
+		{name: "wrong issuer", claims: func(c map[string]any) { c["iss"] = "https://id.example.com" }, want: http.StatusUnauthorized},
+		{name: "expired", claims: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, want: http.StatusUnauthorized},
+		{name: "unverified email", claims: func(c map[string]any) { c["email_verified"] = false }, want: http.StatusBadRequest},
+		{name: "email with a name", claims: func(c map[string]any) { c["email"] = "Carol <carol@example.com>" }, want: http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			idp.email = "carol@example.com"
+			idp.claims = test.claims
+			b := ts.browser(t)
+			callback, err := url.Parse(idp.login(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.state != "" {
+				q := callback.Query()
+				q.Set("state", test.state)
+				callback.RawQuery = q.Encode()
+			}
+			if status, _, _ := b.do(http.NewRequest(http.MethodGet, callback.String(), nil)); status != test.want {
+				t.Errorf("callback: got status %d, want %d", status, test.want)
+			}
+			if status, _, _ := b.get("/events"); status == http.StatusOK {
+				t.Error("got logged in")
+			}
+		})
+	}
+	if _, err := ts.repo.UserByEmail(context.Background(), "carol@example.com"); err == nil {
+		t.Error("user was created")
+	}
+}
+
+func TestOidcCodeOfOtherRequest(t *testing.T) {
+	ts, idp := newOidcTestService(t)
+	idp.email = "carol@example.com"
+	victim, attacker := ts.browser(t), ts.browser(t)
+
+	// The attacker has stolen the code of the victim, but the verifier the
+	// service sends along is the attacker's own.
+	stolen, err := url.Parse(idp.login(victim))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := url.Parse(idp.login(attacker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := callback.Query()
+	q.Set("code", stolen.Query().Get("code"))
+	callback.RawQuery = q.Encode()
+	if status, _, _ := attacker.do(http.NewRequest(http.MethodGet, callback.String(), nil)); status != http.StatusUnauthorized {
+		t.Errorf("callback: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _, _ := attacker.get("/events"); status == http.StatusOK {
+		t.Error("attacker got logged in")
+	}
+}
@@ -0,0 +1,68 @@
+package organizer
+
+// Roles are ordered, every role includes the permissions of the roles
+// before it.
+const (
+	RoleUser      Role = "user"
+	RoleOrganizer Role = "organizer"
+	RoleAdmin     Role = "admin"
+)
+
+var roles = []Role{RoleUser, RoleOrganizer, RoleAdmin}
+
+type Permission string
+
+const (
+	PermCreateEvents Permission = "create-events"
+	// PermModerate allows changing events and registrations of others.
+	PermModerate    Permission = "moderate"
+	PermManageUsers Permission = "manage-users"
+)
+
+// permissions lists what each role adds to the roles below it.
+var permissions = map[Role][]Permission{
+	RoleUser:      {},
+	RoleOrganizer: {PermCreateEvents},
+	RoleAdmin:     {PermModerate, PermManageUsers},
+}
+
+func ValidRole(role string) (Role, bool) {
+	for _, r := range roles {
+		if string(r) == role {
+			return r, true
+		}
+	}
+	return "", false
+}
+
+func (r Role) rank() int {
+	for i, role := range roles {
+		if role == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// Includes reports whether r is other or a role above it.
+func (r Role) Includes(other Role) bool {
+	return other.rank() >= 0 && r.rank() >= other.rank()
+}
+
+func (r Role) Can(perm Permission) bool {
+	for _, role := range roles {
+		if !r.Includes(role) {
+			break
+		}
+		for _, p := range permissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (u User) Can(perm Permission) bool {
+	return u.Role.Can(perm)
+}
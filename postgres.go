@@ -0,0 +1,176 @@
+package organizer
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// Postgres shares its statements with MariaDB. The placeholders are
+// numbered when preparing them, and inserts return the new id instead of
+// relying on LastInsertId, which the driver doesn't support.
+type Postgres struct {
+	MariaDB
+}
+
+var _ Repository = (*Postgres)(nil)
+
+func (p *Postgres) Prepare(db *sql.DB) error {
+	p.dialect = DialectPostgres
+	return p.MariaDB.Prepare(db)
+}
+
+// p14_schema creates a new Postgres database with the schema as of m14.
+// Postgres is only supported since then, so there is nothing to migrate
+// from.
+var p14_schema = steps{
+	up: []string{
+		`create table if not exists users (
+			id integer primary key generated by default as identity,
+			name varchar(30) not null,
+			display varchar(30) not null,
+			email varchar(255) not null unique,
+			icon varchar(255) default null,
+			role varchar(16) not null default 'user',
+			created_at timestamptz not null default current_timestamp,
+			activated_at timestamptz default null,
+			changed_at timestamptz default null,
+			deleted_at timestamptz default null
+		);`,
+		`create table if not exists events (
+			id integer primary key generated by default as identity,
+			created_by integer not null references users (id),
+			title varchar(255) not null,
+			description varchar(4096) not null,
+			repeats_every integer not null default 0,
+			repeats_scale varchar(8) not null default 'never'
+				check (repeats_scale in ('never', 'daily', 'weekly', 'monthly', 'yearly')),
+			min_part_num integer default null,
+			max_part_num integer default null,
+			created_at timestamptz not null default current_timestamp,
+			changed_at timestamptz default null,
+			deleted_at timestamptz default null
+		);`,
+		`create table if not exists event_subscriptions (
+			id integer primary key generated by default as identity,
+			user_id integer not null references users (id),
+			event_id integer not null references events (id),
+			message varchar(512) default null,
+			created_at timestamptz not null default current_timestamp,
+			changed_at timestamptz default null,
+			deleted_at timestamptz default null,
+			unique (user_id, event_id)
+		);`,
+		`create table if not exists email_changes (
+			id integer primary key generated by default as identity,
+			user_id integer not null references users (id),
+			old_email varchar(255) not null,
+			new_email varchar(255) not null,
+			confirm_token_hash bytea not null unique,
+			undo_token_hash bytea default null unique,
+			requested_at timestamptz not null default current_timestamp,
+			confirmed_at timestamptz default null,
+			undone_at timestamptz default null
+		);`,
+		`create index email_changes_user_id on email_changes (user_id);`,
+		`create table if not exists sessions (
+			id_hash bytea primary key,
+			user_id integer not null references users (id),
+			authenticated boolean not null default false,
+			created_at timestamptz not null,
+			login_token_hash bytea default null,
+			login_created_at timestamptz default null,
+			login_valid boolean not null default false,
+			second_factor_pending boolean not null default false,
+			second_factor_attempts integer not null default 0,
+			login_code_hash bytea default null,
+			login_code_created_at timestamptz default null,
+			login_code_valid boolean not null default false,
+			login_code_attempts integer not null default 0,
+			last_seen_at timestamptz not null default current_timestamp,
+			ip varchar(45) not null default '',
+			user_agent varchar(255) not null default '',
+			impersonator_id integer default null references users (id)
+		);`,
+		`create index sessions_user_id on sessions (user_id);`,
+		`create index sessions_login_token_hash on sessions (login_token_hash);`,
+		`create table if not exists passkeys (
+			id integer primary key generated by default as identity,
+			user_id integer not null references users (id),
+			name varchar(64) not null,
+			credential_id bytea not null unique,
+			public_key bytea not null,
+			sign_count bigint not null default 0 check (sign_count >= 0),
+			created_at timestamptz not null default current_timestamp,
+			last_used_at timestamptz default null
+		);`,
+		`create table if not exists totp_secrets (
+			user_id integer primary key references users (id),
+			secret bytea not null,
+			last_step bigint not null default 0,
+			created_at timestamptz not null default current_timestamp,
+			confirmed_at timestamptz default null
+		);`,
+		`create table if not exists recovery_codes (
+			id integer primary key generated by default as identity,
+			user_id integer not null references users (id),
+			code_hash bytea not null,
+			created_at timestamptz not null default current_timestamp,
+			used_at timestamptz default null
+		);`,
+		`create table if not exists api_tokens (
+			id integer primary key generated by default as identity,
+			user_id integer not null references users (id),
+			name varchar(64) not null,
+			token_hash bytea not null unique,
+			scope varchar(16) not null,
+			created_at timestamptz not null default current_timestamp,
+			last_used_at timestamptz default null
+		);`,
+		`create table if not exists audit_log (
+			id bigint primary key generated by default as identity,
+			user_id integer default null references users (id),
+			actor_id integer default null references users (id),
+			action varchar(32) not null,
+			detail varchar(255) not null default '',
+			ip varchar(45) not null default '',
+			user_agent varchar(255) not null default '',
+			created_at timestamptz not null default current_timestamp
+		);`,
+		`create index audit_log_user_id on audit_log (user_id, id);`,
+		`create index audit_log_action on audit_log (action, id);`,
+	},
+	down: []string{
+		`drop table audit_log;`,
+		`drop table api_tokens;`,
+		`drop table recovery_codes;`,
+		`drop table totp_secrets;`,
+		`drop table passkeys;`,
+		`drop table sessions;`,
+		`drop table email_changes;`,
+		`drop table event_subscriptions;`,
+		`drop table events;`,
+		`drop table users;`,
+	},
+}
+
+var p15_user_disabling = steps{
+	up: []string{
+		`alter table users add column disabled_at timestamptz default null;`,
+	},
+	down: []string{
+		`alter table users drop column disabled_at;`,
+	},
+}
+
+var p16_used_challenges = steps{
+	up: []string{
+		`create table if not exists used_challenges (
+			challenge_hash bytea primary key,
+			expires_at timestamptz not null
+		);`,
+	},
+	down: []string{
+		`drop table used_challenges;`,
+	},
+}
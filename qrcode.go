@@ -0,0 +1,445 @@
+package organizer
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// Just enough of a QR code (ISO/IEC 18004) encoder to show otpauth:// uris
+// to authenticator apps: byte mode and error correction level M only, the
+// smallest version the data fits in, and the mask with the lowest penalty.
+
+type qrCode struct {
+	size     int
+	modules  [][]bool // dark modules, indexed by row, then column
+	function [][]bool // modules that don't carry data, masks leave them be
+}
+
+var errQRTooLong = errors.New("qr code: data too long")
+
+// Codewords per block and number of blocks for error correction level M,
+// indexed by version.
+var (
+	qrEccPerBlock = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	qrEccBlocks   = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+func qrEncode(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 1
+	for ; version <= 40; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrDataCodewords(version) {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, errQRTooLong
+	}
+
+	var bits qrBits
+	bits.append(0b0100, 4) // byte mode
+	if version < 10 {
+		bits.append(len(data), 8)
+	} else {
+		bits.append(len(data), 16)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	q := newQRCode(version)
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrAddEcc(bits.bytes(), version))
+
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // masks are their own inverse
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// SVG draws the code with a quiet zone of four modules around it.
+func (q *qrCode) SVG() template.HTML {
+	var path strings.Builder
+	for y, row := range q.modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+4, y+4)
+			}
+		}
+	}
+	return template.HTML(fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %[1]d %[1]d" width="200" height="200" shape-rendering="crispEdges" role="img" aria-label="QR-Code"><rect width="%[1]d" height="%[1]d" fill="#fff"/><path d="%[2]s" fill="#000"/></svg>`,
+		q.size+8, path.String()))
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	bs := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			bs[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return bs
+}
+
+// qrRawModules is the number of modules left for data and error correction,
+// once the function patterns are drawn.
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrEccPerBlock[version]*qrEccBlocks[version]
+}
+
+// qrAddEcc splits data into blocks, appends the error correction codewords
+// to each and interleaves them.
+func qrAddEcc(data []byte, version int) []byte {
+	numBlocks, eccLen := qrEccBlocks[version], qrEccPerBlock[version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	generator := qrGenerator(eccLen)
+	blocks, eccs := make([][]byte, numBlocks), make([][]byte, numBlocks)
+	for i := range blocks {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		blocks[i], data = data[:n], data[n:]
+		eccs[i] = qrRemainder(blocks[i], generator)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := 0; i <= shortLen-eccLen; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := range eccLen {
+		for _, ecc := range eccs {
+			result = append(result, ecc[i])
+		}
+	}
+	return result
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMultiply(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		carry := z >> 7
+		z = z<<1 ^ carry*0x1d
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// qrGenerator returns the Reed-Solomon generator polynomial of the given
+// degree, without its leading coefficient.
+func qrGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for range degree {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+func qrRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range generator {
+			result[i] ^= qrMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+func newQRCode(version int) *qrCode {
+	size := 4*version + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range size {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	return q
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := range q.size {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	finder := func(cx, cy int) {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := cx+dx, cy+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				q.setFunction(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+	finder(3, 3)
+	finder(q.size-4, 3)
+	finder(3, q.size-4)
+
+	positions := q.alignmentPositions(version)
+	last := len(positions) - 1
+	for i, cx := range positions {
+		for j, cy := range positions {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // taken by the finders
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas, they are drawn along with the mask.
+	q.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for range 12 {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := version<<12 | rem
+		for i := range 18 {
+			dark := bits>>i&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+func (q *qrCode) alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, q.size-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// drawFormat draws both copies of the format information: the error
+// correction level (M) and the mask.
+func (q *qrCode) drawFormat(mask int) {
+	data := 0b00<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+
+	for i := range 6 {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := range 8 {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawCodewords fills the data modules in the zigzag order, two columns at
+// a time from the bottom right, skipping the vertical timing pattern.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := range q.size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i/8]>>(7-i%8)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := range q.size {
+		for x := range q.size {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty rates how hard the code is to scan, following the rules of the
+// standard: long runs, blocks of one color, patterns that look like
+// finders, and an unbalanced number of dark modules.
+func (q *qrCode) penalty() int {
+	at := func(transpose bool, i, j int) bool {
+		if transpose {
+			return q.modules[j][i]
+		}
+		return q.modules[i][j]
+	}
+	finderLike := [2][11]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	penalty := 0
+	for _, transpose := range []bool{false, true} {
+		for i := range q.size {
+			run := 1
+			for j := 1; j <= q.size; j++ {
+				if j < q.size && at(transpose, i, j) == at(transpose, i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			for j := 0; j+11 <= q.size; j++ {
+				for _, pattern := range finderLike {
+					matches := true
+					for k, dark := range pattern {
+						if at(transpose, i, j+k) != dark {
+							matches = false
+							break
+						}
+					}
+					if matches {
+						penalty += 40
+					}
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := range q.size {
+		for x := range q.size {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if c == q.modules[y-1][x] && c == q.modules[y][x-1] && c == q.modules[y-1][x-1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return penalty + k*10
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,66 @@
+package organizer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQREncode(t *testing.T) {
+	// Version 2, as another encoder draws it.
+	want := []string{
+		"#######...#.#.#...#######",
+		"#.....#.#.####....#.....#",
+		"#.###.#...##...#..#.###.#",
+		"#.###.#...##.#....#.###.#",
+		"#.###.#.#..#.#..#.#.###.#",
+		"#.....#...#...##..#.....#",
+		"#######.#.#.#.#.#.#######",
+		"...........##..#.........",
+		"#.#.#.#..##.#..#....#..#.",
+		"#.#.##....####..####.#..#",
+		"...#..####..#.#..#.#..###",
+		"#..#...#..#####.#.#.#..#.",
+		"##...####.....#####....##",
+		"..#.##..#..#..#...##.#..#",
+		"#.#..##.#.#..#..###..####",
+		".#####.#..##...#.#.##...#",
+		"#..#######..#...######.#.",
+		"........#.####..#...#..##",
+		"#######..#.##.###.#.#####",
+		"#.....#..#..###.#...#..#.",
+		"#.###.#.##.#..#.######..#",
+		"#.###.#...##..##....#....",
+		"#.###.#.#.#..#.##...#.#.#",
+		"#.....#....#....#.##...#.",
+		"#######.#...#..###.....##",
+	}
+	q, err := qrEncode("otpauth://totp/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.size != len(want) {
+		t.Fatalf("got size %d, want %d", q.size, len(want))
+	}
+	for y, row := range q.modules {
+		var got strings.Builder
+		for _, dark := range row {
+			if dark {
+				got.WriteByte('#')
+			} else {
+				got.WriteByte('.')
+			}
+		}
+		if got.String() != want[y] {
+			t.Errorf("row %d: got %s, want %s", y, got.String(), want[y])
+		}
+	}
+
+	// Version 40 holds at most 2331 bytes at level M.
+	if q, err := qrEncode(strings.Repeat("x", 2331)); err != nil || q.size != 177 {
+		t.Errorf("2331 bytes: got %v", err)
+	}
+	if _, err := qrEncode(strings.Repeat("x", 2332)); !errors.Is(err, errQRTooLong) {
+		t.Errorf("2332 bytes: got %v, want %v", err, errQRTooLong)
+	}
+}
@@ -0,0 +1,150 @@
+package organizer
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// RateLimit allows bursts of up to Requests requests, which are
+	// replenished evenly over the duration Per.
+	RateLimit struct {
+		Requests int
+		Per      time.Duration
+	}
+	// RateLimiter keeps one token bucket per key, e.g. per ip address.
+	RateLimiter struct {
+		limit       RateLimit
+		mu          sync.Mutex
+		buckets     map[string]*tokenBucket
+		lastCleanup time.Time
+	}
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:       limit,
+		buckets:     map[string]*tokenBucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// Allow takes a token from the bucket of key. If the bucket is empty, it
+// returns false and how long it takes until the next token is available.
+func (r *RateLimiter) Allow(key string) (bool, time.Duration) {
+	return r.check(key, true)
+}
+
+// Peek reports what Allow would, without taking a token.
+func (r *RateLimiter) Peek(key string) (bool, time.Duration) {
+	return r.check(key, false)
+}
+
+func (r *RateLimiter) check(key string, take bool) (bool, time.Duration) {
+	if r == nil || r.limit.Requests <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cleanup(now)
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			tokens: float64(r.limit.Requests),
+			last:   now,
+		}
+	}
+	bucket.refill(now, r.limit)
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / r.limit.perSecond()
+		return false, time.Duration(math.Ceil(wait)) * time.Second
+	}
+	if take {
+		bucket.tokens--
+		r.buckets[key] = bucket
+	}
+	return true, 0
+}
+
+func (b *tokenBucket) refill(now time.Time, limit RateLimit) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+elapsed*limit.perSecond())
+	b.last = now
+}
+
+// cleanup forgets buckets that have filled up again, they are
+// indistinguishable from new ones. Must be called with r.mu held.
+func (r *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(r.lastCleanup) < r.limit.Per {
+		return
+	}
+	r.lastCleanup = now
+	for key, bucket := range r.buckets {
+		bucket.refill(now, r.limit)
+		if bucket.tokens >= float64(r.limit.Requests) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// allowAll checks every limiter against its key, and fails with the longest
+// wait time of the limiters that are exhausted. Tokens are only taken once
+// all limiters allow the request, a request turned away by one of them
+// must not use up the others.
+func allowAll(checks ...rateCheck) error {
+	var retryAfter time.Duration
+	for _, check := range checks {
+		if ok, wait := check.limiter.Peek(check.key); !ok && wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return TooManyRequests(retryAfter)
+	}
+	for _, check := range checks {
+		// A concurrent request may have taken the last token since.
+		if ok, wait := check.limiter.Allow(check.key); !ok {
+			return TooManyRequests(wait)
+		}
+	}
+	return nil
+}
+
+type rateCheck struct {
+	limiter *RateLimiter
+	key     string
+}
+
+// clientIP returns the address of the client, taken from header if the
+// service is configured to run behind a proxy that sets it.
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if ip := r.Header.Get(header); ip != "" {
+			// X-Forwarded-For may be a list, only the last entry was
+			// added by our proxy, the ones before can be forged.
+			if i := strings.LastIndex(ip, ","); i >= 0 {
+				ip = ip[i+1:]
+			}
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,96 @@
+package organizer
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{2, time.Minute})
+	for i := range 2 {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	if ok, wait := limiter.Peek("a"); ok || wait != 30*time.Second {
+		t.Errorf("peek exhausted bucket: got %v, wait %s", ok, wait)
+	}
+	if ok, wait := limiter.Allow("a"); ok || wait != 30*time.Second {
+		t.Errorf("exhausted bucket: got %v, wait %s", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("other key refused")
+	}
+
+	for range 5 {
+		if ok, _ := limiter.Peek("c"); !ok {
+			t.Fatal("peek refused")
+		}
+	}
+	if ok, _ := limiter.Allow("c"); !ok {
+		t.Error("peeking used up tokens")
+	}
+
+	var unlimited *RateLimiter
+	if ok, _ := unlimited.Allow("a"); !ok {
+		t.Error("nil limiter refused")
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	perIP := NewRateLimiter(RateLimit{1, time.Minute})
+	global := NewRateLimiter(RateLimit{2, time.Hour})
+
+	if err := allowAll(rateCheck{perIP, "1.2.3.4"}, rateCheck{global, ""}); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		err := allowAll(rateCheck{perIP, "1.2.3.4"}, rateCheck{global, ""})
+		var tooMany ErrTooManyRequests
+		if !errors.As(err, &tooMany) || tooMany.retryAfter != time.Minute {
+			t.Fatalf("got %v, want to retry after a minute", err)
+		}
+	}
+	// The refused requests didn't touch the global bucket.
+	if err := allowAll(rateCheck{perIP, "5.6.7.8"}, rateCheck{global, ""}); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+	err := allowAll(rateCheck{perIP, "9.9.9.9"}, rateCheck{global, ""})
+	var tooMany ErrTooManyRequests
+	if !errors.As(err, &tooMany) || tooMany.retryAfter != 30*time.Minute {
+		t.Errorf("global limit: got %v, want to retry after 30 minutes", err)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	ts := newTestService(t, WithLoginRateLimits(
+		RateLimit{1, time.Hour},
+		RateLimit{10, time.Hour},
+		RateLimit{100, time.Hour},
+	))
+	ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	b := ts.browser(t)
+
+	if status, _, _ := b.post("/login", url.Values{"email": {"alice@example.com"}}); status != http.StatusOK {
+		t.Fatalf("first login: got status %d", status)
+	}
+	status, hdr, _ := b.post("/login", url.Values{"email": {"alice@example.com"}})
+	if status != http.StatusTooManyRequests || hdr.Get("Retry-After") != "3600" {
+		t.Errorf("second login: got status %d, Retry-After %q", status, hdr.Get("Retry-After"))
+	}
+	if n := len(ts.mail.Sent()); n != 1 {
+		t.Errorf("got %d mails, want 1", n)
+	}
+	// Requests for the throttled address don't count against the client.
+	for range 9 {
+		if status, _, _ := b.post("/login", url.Values{"email": {"alice@example.com"}}); status != http.StatusTooManyRequests {
+			t.Fatalf("got status %d, want %d", status, http.StatusTooManyRequests)
+		}
+	}
+	if status, _, _ := b.post("/login", url.Values{"email": {"bob@example.com"}}); status != http.StatusOK {
+		t.Errorf("other address: got status %d", status)
+	}
+}
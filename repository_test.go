@@ -0,0 +1,883 @@
+package organizer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The repository tests run against every backend that is available. SQLite
+// and the MemoryRepository always are. For Postgres, point
+// ORGANIZER_TEST_POSTGRES at a database the tests may create schemas in,
+// e.g. "host=/run/postgresql dbname=organizer_test sslmode=disable".
+
+func testRepositories(t *testing.T, test func(t *testing.T, repo Repository)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryRepository())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		conn := SqlConnection{Driver: "sqlite", Database: filepath.Join(t.TempDir(), "organizer.db")}
+		test(t, openTestRepository(t, conn.String(), DialectSQLite, &SQLite{}))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn, ok := os.LookupEnv("ORGANIZER_TEST_POSTGRES")
+		if !ok {
+			t.Skip("ORGANIZER_TEST_POSTGRES not set")
+		}
+		// Every test gets a schema of its own, which is dropped afterwards.
+		admin, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer admin.Close()
+		schema := fmt.Sprintf("organizer_test_%d", time.Now().UnixNano())
+		if _, err := admin.Exec("create schema " + schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			admin, err := sql.Open("postgres", dsn)
+			if err == nil {
+				_, err = admin.Exec("drop schema " + schema + " cascade")
+				admin.Close()
+			}
+			if err != nil {
+				t.Errorf("failed to drop schema %s: %v", schema, err)
+			}
+		})
+		test(t, openTestRepository(t, dsn+" search_path="+schema, DialectPostgres, &Postgres{}))
+	})
+}
+
+func openTestRepository(t *testing.T, dsn string, dialect Dialect, repo Repository) Repository {
+	t.Helper()
+	db, err := sql.Open(string(dialect), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db, dialect); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	// Migrating twice must be a no-op.
+	if err := migrate(db, dialect); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	if err := repo.Prepare(db); err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	return repo
+}
+
+func mustCreateUser(t *testing.T, repo Repository, name, email string) User {
+	t.Helper()
+	user, err := repo.CreateUser(context.Background(), NewUser(name, email))
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+func TestRepositoryUsers(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		mustCreateUser(t, repo, "bob", "bob@example.com")
+		if _, err := repo.CreateUser(ctx, NewUser("eve", "alice@example.com")); err == nil {
+			t.Error("created a second user with the same email")
+		}
+
+		if alice.IsActive() {
+			t.Error("new user is active")
+		}
+		if err := repo.ActivateUser(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetUserRole(ctx, alice.ID, RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.UserByEmail(ctx, "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != alice.ID || !got.IsActive() || got.Role != RoleAdmin || got.Display.String != "alice" || got.IsDisabled() {
+			t.Errorf("unexpected user: %+v", got)
+		}
+		if err := repo.SetUserDisabled(ctx, alice.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.User(ctx, alice.ID); err != nil || !got.IsDisabled() {
+			t.Errorf("disable: got %+v, %v", got, err)
+		}
+		if err := repo.SetUserDisabled(ctx, alice.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.User(ctx, alice.ID); err != nil || got.IsDisabled() {
+			t.Errorf("enable: got %+v, %v", got, err)
+		}
+		if _, err := repo.User(ctx, alice.ID+100); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("missing user: got %v, want sql.ErrNoRows", err)
+		}
+
+		users, err := repo.Users(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+			t.Errorf("unexpected users: %+v", users)
+		}
+	})
+}
+
+func TestRepositoryEvents(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		bob := mustCreateUser(t, repo, "bob", "bob@example.com")
+
+		event, err := repo.CreateEvent(ctx, NewEvent(alice.ID, "Boardgames", "Every Friday", 1, RepeatsWeekly, 2, 6))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg, err := repo.RegisterEvent(ctx, NewEventRegistration(bob.ID, event.ID, "Ich mache mit!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := repo.Event(ctx, event.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != "Boardgames" || got.RepeatsScale != RepeatsWeekly || got.MinParticipants.Int64 != 2 || got.NumberOfParticipants != 1 {
+			t.Errorf("unexpected event: %+v", got)
+		}
+
+		if err := repo.DeregisterEvent(ctx, reg.ID); err != nil {
+			t.Fatal(err)
+		}
+		if regs, _ := repo.EventRegistrations(ctx, event.ID); len(regs) != 0 {
+			t.Errorf("got %d registrations after deregistering, want 0", len(regs))
+		}
+		again, err := repo.RegisterEvent(ctx, NewEventRegistration(bob.ID, event.ID, "Doch!"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.ID != reg.ID {
+			t.Errorf("reregistering created registration %d, want %d", again.ID, reg.ID)
+		}
+		if again, _ := repo.EventRegistration(ctx, reg.ID); again.Message.String != "Doch!" {
+			t.Errorf("got message %q after reregistering", again.Message.String)
+		}
+
+		// Without a message, or once anonymized, the message is NULL.
+		quiet, err := repo.RegisterEvent(ctx, NewEventRegistration(alice.ID, event.ID, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeregisterEvent(ctx, quiet.ID); err != nil {
+			t.Fatal(err)
+		}
+		if again, err := repo.RegisterEvent(ctx, NewEventRegistration(alice.ID, event.ID, "")); err != nil {
+			t.Fatal(err)
+		} else if again.ID != quiet.ID {
+			t.Errorf("reregistering created registration %d, want %d", again.ID, quiet.ID)
+		}
+
+		events, err := repo.Events(ctx, EventQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].NumberOfParticipants != 2 {
+			t.Errorf("unexpected events: %+v", events)
+		}
+	})
+}
+
+func TestRepositoryEventQuery(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		bob := mustCreateUser(t, repo, "bob", "bob@example.com")
+		var ids []EventID
+		for _, e := range []Event{
+			NewEvent(alice.ID, "Boardgames", "Every Friday, bring snacks", 1, RepeatsWeekly, 0, 1),
+			NewEvent(alice.ID, "Hiking", "100% fun_trip", 0, RepeatsNever, 0, 0),
+			NewEvent(bob.ID, "Book club", "Reading the rules of BOARDGAMES", 1, RepeatsMonthly, 0, 5),
+			NewEvent(bob.ID, "Cinema", "Movie night", 0, RepeatsNever, 0, 0),
+			NewEvent(bob.ID, "Boardgames again", "", 0, RepeatsNever, 0, 0),
+		} {
+			event, err := repo.CreateEvent(ctx, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, event.ID)
+		}
+		if err := repo.DeleteEvent(ctx, ids[4]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.RegisterEvent(ctx, NewEventRegistration(bob.ID, ids[0], "")); err != nil {
+			t.Fatal(err)
+		}
+		boardgames, hiking, bookClub, cinema := ids[0], ids[1], ids[2], ids[3]
+
+		tests := []struct {
+			name  string
+			query EventQuery
+			want  []EventID
+		}{
+			{"all", EventQuery{}, []EventID{boardgames, hiking, bookClub, cinema}},
+			{"search", EventQuery{Search: "boardgames"}, []EventID{boardgames, bookClub}},
+			{"search wildcard", EventQuery{Search: "_"}, []EventID{hiking}},
+			{"repeating", EventQuery{Repeating: sql.NullBool{Bool: true, Valid: true}}, []EventID{boardgames, bookClub}},
+			{"not repeating", EventQuery{Repeating: sql.NullBool{Valid: true}}, []EventID{hiking, cinema}},
+			{"free spots", EventQuery{HasFreeSpots: true}, []EventID{hiking, bookClub, cinema}},
+			{"created by", EventQuery{CreatedBy: bob.ID}, []EventID{bookClub, cinema}},
+			{"registered by", EventQuery{RegisteredBy: bob.ID}, []EventID{boardgames}},
+			{"oldest", EventQuery{Limit: 2}, []EventID{boardgames, hiking}},
+			{"oldest page 2", EventQuery{Limit: 2, After: EventCursor{ID: hiking}}, []EventID{bookClub, cinema}},
+			{"newest", EventQuery{Sort: SortNewest, Limit: 2}, []EventID{cinema, bookClub}},
+			{"newest page 2", EventQuery{Sort: SortNewest, Limit: 2, After: EventCursor{ID: bookClub}}, []EventID{hiking, boardgames}},
+			{"title", EventQuery{Sort: SortTitle, Limit: 3}, []EventID{boardgames, bookClub, cinema}},
+			{"title page 2", EventQuery{Sort: SortTitle, Limit: 3, After: EventCursor{ID: cinema, Title: "Cinema"}}, []EventID{hiking}},
+		}
+		for _, test := range tests {
+			events, err := repo.Events(ctx, test.query)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			got := []EventID{}
+			for _, e := range events {
+				got = append(got, e.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			}
+		}
+	})
+}
+
+func TestRepositorySessions(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		auth := NewAuthenticator(WithSessionStore(repo), WithSessionTokenExpiryLimit(time.Hour))
+
+		session, err := auth.CreateSession(ctx, alice.ID, ClientInfo{IP: "127.0.0.1", UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		login, err := session.RequestLogin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waiting, ok, err := auth.SessionByLogin(ctx, LoginID(login.Value))
+		if err != nil || !ok || waiting.Hash != session.Hash {
+			t.Fatalf("session not found by its login: %v", err)
+		}
+		if ok, err := waiting.InvalidateLogin(ctx, LoginID(login.Value)); err != nil || !ok {
+			t.Fatalf("failed to redeem login: %v", err)
+		}
+		got, ok, err := auth.SessionByID(ctx, SessionID(session.Value))
+		if err != nil || !ok || !got.IsAuthenticated() {
+			t.Fatalf("session not authenticated after redeeming the login: %v", err)
+		}
+		if got.Client().UserAgent != "test" {
+			t.Errorf("got client %+v", got.Client())
+		}
+
+		sessions, err := repo.SessionsByUser(ctx, alice.ID)
+		if err != nil || len(sessions) != 1 {
+			t.Fatalf("got %d sessions, %v", len(sessions), err)
+		}
+		n, err := repo.DeleteExpiredSessions(ctx, time.Now().Add(-time.Minute), time.Now().Add(-time.Minute))
+		if err != nil || n != 0 {
+			t.Errorf("deleted %d fresh sessions, %v", n, err)
+		}
+		n, err = repo.DeleteExpiredSessions(ctx, time.Now().Add(time.Minute), time.Now())
+		if err != nil || n != 1 {
+			t.Errorf("deleted %d expired sessions, want 1, %v", n, err)
+		}
+	})
+}
+
+func TestRepositoryChallenges(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		expired, fresh := HashToken("expired"), HashToken("fresh")
+		if ok, err := repo.UseChallenge(ctx, expired, time.Now().Add(-time.Minute)); err != nil || !ok {
+			t.Fatalf("first use: %v, %v", ok, err)
+		}
+		if ok, err := repo.UseChallenge(ctx, fresh, time.Now().Add(time.Minute)); err != nil || !ok {
+			t.Fatalf("first use: %v, %v", ok, err)
+		}
+		if ok, err := repo.UseChallenge(ctx, fresh, time.Now().Add(time.Minute)); err != nil || ok {
+			t.Errorf("second use: %v, %v", ok, err)
+		}
+		n, err := repo.DeleteExpiredChallenges(ctx, time.Now())
+		if err != nil || n != 1 {
+			t.Errorf("deleted %d expired challenges, want 1, %v", n, err)
+		}
+		if ok, err := repo.UseChallenge(ctx, fresh, time.Now().Add(time.Minute)); err != nil || ok {
+			t.Errorf("use after sweep: %v, %v", ok, err)
+		}
+	})
+}
+
+// TestConcurrentRedeem has two authenticators share a store, like two
+// instances of the service would. A login may only be redeemed once, no
+// matter which of them is asked to.
+func TestConcurrentRedeem(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		instances := []*Authenticator{
+			NewAuthenticator(WithSessionStore(repo)),
+			NewAuthenticator(WithSessionStore(repo)),
+		}
+		session, err := instances[0].CreateSession(ctx, alice.ID, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		login, err := session.RequestLogin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg       sync.WaitGroup
+			start    = make(chan struct{})
+			redeemed atomic.Int32
+		)
+		for i := range 8 {
+			waiting, ok, err := instances[i%len(instances)].SessionByLogin(ctx, LoginID(login.Value))
+			if err != nil || !ok {
+				t.Fatalf("session not found by its login: %v", err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				ok, err := waiting.InvalidateLogin(ctx, LoginID(login.Value))
+				if err != nil {
+					t.Error(err)
+				}
+				if ok {
+					redeemed.Add(1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if n := redeemed.Load(); n != 1 {
+			t.Errorf("login redeemed %d times, want once", n)
+		}
+
+		// The store has the last word, whatever state the instance saw.
+		stale, err := repo.Session(ctx, session.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := repo.ConsumeLogin(ctx, stale, login.Hash); err != nil || ok {
+			t.Errorf("consumed a redeemed login: %v, %v", ok, err)
+		}
+	})
+}
+
+func TestSweeper(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		auth := NewAuthenticator(WithSessionStore(repo), WithLoginTokenExpiryLimit(50*time.Millisecond))
+		active, err := auth.CreateAuthenticatedSession(ctx, alice.ID, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		abandoned, err := auth.CreateSession(ctx, alice.ID, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := abandoned.RequestLogin(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		sweepCtx, stopSweeper := context.WithCancel(ctx)
+		sweeperDone := make(chan struct{})
+		go func() {
+			defer close(sweeperDone)
+			auth.RunSweeper(sweepCtx, time.Millisecond)
+		}()
+		// The session keeps being used while the sweeper runs.
+		var wg sync.WaitGroup
+		for i := range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range 10 {
+					session, ok, err := auth.SessionByID(ctx, SessionID(active.Value))
+					if err != nil || !ok {
+						t.Errorf("active session is gone: %v", err)
+						return
+					}
+					if err := session.Touch(ctx, ClientInfo{UserAgent: fmt.Sprint(i, j)}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, ok, err := auth.SessionByID(ctx, SessionID(abandoned.Value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("abandoned session has not been swept")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		stopSweeper()
+		<-sweeperDone
+		if _, ok, err := auth.SessionByID(ctx, SessionID(active.Value)); err != nil || !ok {
+			t.Errorf("active session has been swept: %v", err)
+		}
+	})
+}
+
+func TestRepositorySecondFactor(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+
+		if err := repo.SaveTotpSecret(ctx, TotpSecret{User: alice.ID, Secret: []byte("first")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.ConfirmTotpSecret(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := repo.UseTotpStep(ctx, alice.ID, 10); err != nil || !ok {
+			t.Errorf("first use of step: %v, %v", ok, err)
+		}
+		if ok, err := repo.UseTotpStep(ctx, alice.ID, 10); err != nil || ok {
+			t.Errorf("reuse of step: %v, %v", ok, err)
+		}
+		// Saving a new secret starts over.
+		if err := repo.SaveTotpSecret(ctx, TotpSecret{User: alice.ID, Secret: []byte("second")}); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := repo.TotpSecret(ctx, alice.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(secret.Secret) != "second" || secret.IsConfirmed() || secret.LastStep != 0 {
+			t.Errorf("unexpected secret: %+v", secret)
+		}
+
+		if err := repo.SetRecoveryCodes(ctx, alice.ID, [][]byte{[]byte("a"), []byte("b")}); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []bool{true, false} {
+			if ok, err := repo.UseRecoveryCode(ctx, alice.ID, []byte("a")); err != nil || ok != want {
+				t.Errorf("use recovery code: got %v, %v, want %v", ok, err, want)
+			}
+		}
+		if err := repo.DeleteTotpSecret(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := repo.UseRecoveryCode(ctx, alice.ID, []byte("b")); ok {
+			t.Error("recovery code still valid after disabling the second factor")
+		}
+	})
+}
+
+func TestRepositoryEmailChange(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+
+		change, err := repo.CreateEmailChange(ctx, EmailChange{
+			User:        alice.ID,
+			OldEmail:    alice.Email,
+			NewEmail:    "alice@example.org",
+			ConfirmHash: HashToken("confirm"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.EmailChangeByConfirmHash(ctx, HashToken("confirm")); err != nil || got.ID != change.ID {
+			t.Fatalf("change not found by confirm hash: %v", err)
+		}
+		if err := repo.ConfirmEmailChange(ctx, change, HashToken("undo")); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.ConfirmEmailChange(ctx, change, HashToken("undo")); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("confirming twice: got %v, want sql.ErrNoRows", err)
+		}
+		if u, _ := repo.User(ctx, alice.ID); u.Email != "alice@example.org" {
+			t.Errorf("got email %s after confirming", u.Email)
+		}
+
+		change, err = repo.EmailChangeByUndoHash(ctx, HashToken("undo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.UndoEmailChange(ctx, change); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ := repo.User(ctx, alice.ID); u.Email != "alice@example.com" {
+			t.Errorf("got email %s after undoing", u.Email)
+		}
+	})
+}
+
+func TestRepositoryDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		bob := mustCreateUser(t, repo, "bob", "bob@example.com")
+		hers, err := repo.CreateEvent(ctx, NewEvent(alice.ID, "Hers", "", 0, RepeatsNever, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		his, err := repo.CreateEvent(ctx, NewEvent(bob.ID, "His", "", 0, RepeatsNever, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.RegisterEvent(ctx, NewEventRegistration(alice.ID, his.ID, "")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.CreateApiToken(ctx, ApiToken{User: alice.ID, Name: "cli", Hash: HashToken("token"), Scope: ApiTokenScope("read")}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := repo.DeleteUser(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.User(ctx, alice.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("deleted user: got %v, want sql.ErrNoRows", err)
+		}
+		// The address is anonymized, so it is free for a new account.
+		if _, err := repo.CreateUser(ctx, NewUser("alice", "alice@example.com")); err != nil {
+			t.Errorf("reusing the address of a deleted user: %v", err)
+		}
+		if _, err := repo.Event(ctx, hers.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("event of deleted user: got %v, want sql.ErrNoRows", err)
+		}
+		if e, _ := repo.Event(ctx, his.ID); e.NumberOfParticipants != 0 {
+			t.Errorf("deleted user still counted as participant")
+		}
+		if _, err := repo.ApiTokenByHash(ctx, HashToken("token")); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("api token of deleted user: got %v, want sql.ErrNoRows", err)
+		}
+		if users, _ := repo.Users(ctx); len(users) != 2 {
+			t.Errorf("got %d users, want 2", len(users))
+		}
+	})
+}
+
+func TestRepositoryTrash(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		bob := mustCreateUser(t, repo, "bob", "bob@example.com")
+		event, err := repo.CreateEvent(ctx, NewEvent(alice.ID, "Boardgames", "", 0, RepeatsNever, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg, err := repo.RegisterEvent(ctx, NewEventRegistration(bob.ID, event.ID, "dabei"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := repo.DeregisterEvent(ctx, reg.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.EventRegistration(ctx, reg.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("withdrawn registration: got %v, want sql.ErrNoRows", err)
+		}
+		regs, err := repo.DeletedEventRegistrations(ctx, bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(regs) != 1 || regs[0].ID != reg.ID || regs[0].EventTitle != "Boardgames" {
+			t.Fatalf("unexpected deleted registrations: %+v", regs)
+		}
+		if err := repo.RestoreEventRegistration(ctx, reg.ID, alice.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("restoring someone else's registration: got %v, want sql.ErrNoRows", err)
+		}
+		if err := repo.RestoreEventRegistration(ctx, reg.ID, bob.ID); err != nil {
+			t.Fatal(err)
+		}
+		if e, _ := repo.Event(ctx, event.ID); e.NumberOfParticipants != 1 {
+			t.Errorf("got %d participants after restoring, want 1", e.NumberOfParticipants)
+		}
+
+		if err := repo.DeleteEvent(ctx, event.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteEvent(ctx, event.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("deleting twice: got %v, want sql.ErrNoRows", err)
+		}
+		if _, err := repo.RegisterEvent(ctx, NewEventRegistration(alice.ID, event.ID, "")); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("registering for a deleted event: got %v, want sql.ErrNoRows", err)
+		}
+		if events, _ := repo.DeletedEvents(ctx, bob.ID); len(events) != 0 {
+			t.Errorf("bob sees alice's deleted events: %+v", events)
+		}
+		if err := repo.RestoreEvent(ctx, event.ID, bob.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("restoring someone else's event: got %v, want sql.ErrNoRows", err)
+		}
+		events, err := repo.DeletedEvents(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].ID != event.ID || events[0].DeletedAt.IsZero() {
+			t.Fatalf("unexpected deleted events: %+v", events)
+		}
+		if err := repo.RestoreEvent(ctx, event.ID, 0); err != nil {
+			t.Fatal(err)
+		}
+		if e, err := repo.Event(ctx, event.ID); err != nil || e.NumberOfParticipants != 1 {
+			t.Errorf("restored event: got %+v, %v", e, err)
+		}
+
+		if err := repo.DeleteEvent(ctx, event.ID); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := repo.PurgeDeleted(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+			t.Errorf("purged %d rows within the retention period, %v", n, err)
+		}
+		// The registration goes with its event.
+		if n, err := repo.PurgeDeleted(ctx, time.Now().Add(time.Minute)); err != nil || n != 2 {
+			t.Errorf("purged %d rows, want 2, %v", n, err)
+		}
+		if err := repo.RestoreEvent(ctx, event.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("restoring a purged event: got %v, want sql.ErrNoRows", err)
+		}
+
+		// Events of deleted users can't be restored.
+		other, err := repo.CreateEvent(ctx, NewEvent(alice.ID, "Chess", "", 0, RepeatsNever, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteUser(ctx, alice.ID); err != nil {
+			t.Fatal(err)
+		}
+		if events, _ := repo.DeletedEvents(ctx, 0); len(events) != 0 {
+			t.Errorf("got deleted events of a deleted user: %+v", events)
+		}
+		if err := repo.RestoreEvent(ctx, other.ID, 0); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("restoring an event of a deleted user: got %v, want sql.ErrNoRows", err)
+		}
+	})
+}
+
+func TestRepositoryAuditLog(t *testing.T) {
+	ctx := context.Background()
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		alice := mustCreateUser(t, repo, "alice", "alice@example.com")
+		for i := 0; i < 5; i++ {
+			if err := repo.AppendAuditEntry(ctx, AuditEntry{User: alice.ID, Action: AuditLogout, Detail: fmt.Sprint(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := repo.AppendAuditEntry(ctx, AuditEntry{Action: AuditTokenFailed}); err != nil {
+			t.Fatal(err)
+		}
+
+		page, err := repo.AuditEntries(ctx, AuditFilter{User: alice.ID, Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 3 || page[0].Detail != "4" {
+			t.Fatalf("unexpected first page: %+v", page)
+		}
+		page, err = repo.AuditEntries(ctx, AuditFilter{User: alice.ID, Before: page[2].ID, Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 2 || page[0].Detail != "1" {
+			t.Errorf("unexpected second page: %+v", page)
+		}
+		all, err := repo.AuditEntries(ctx, AuditFilter{Action: AuditTokenFailed, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 1 || all[0].User != 0 {
+			t.Errorf("unexpected entries: %+v", all)
+		}
+	})
+}
+
+func TestRepositoryContext(t *testing.T) {
+	testRepositories(t, func(t *testing.T, repo Repository) {
+		if _, ok := repo.(*MemoryRepository); ok {
+			t.Skip("the memory repository ignores contexts")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := repo.Users(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("query: got %v, want context.Canceled", err)
+		}
+		if err := repo.DeleteUser(ctx, 1); !errors.Is(err, context.Canceled) {
+			t.Errorf("transaction: got %v, want context.Canceled", err)
+		}
+	})
+}
+
+func TestRepositoryQueryTimeout(t *testing.T) {
+	conn := SqlConnection{Driver: "sqlite", Database: filepath.Join(t.TempDir(), "organizer.db")}
+	repo := openTestRepository(t, conn.String(), DialectSQLite, &SQLite{MariaDB{queryTimeout: time.Nanosecond}})
+	if _, err := repo.Users(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	names := map[string]bool{}
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			t.Errorf("migration %s: got version %d, want %d", m.name, m.version, i+1)
+		}
+		if names[m.name] {
+			t.Errorf("migration %d: duplicate name %s", m.version, m.name)
+		}
+		names[m.name] = true
+		for _, dialect := range []Dialect{DialectMySQL, DialectSQLite, DialectPostgres} {
+			s := m.For(dialect)
+			if len(s.up) > 0 && len(s.down) == 0 {
+				t.Errorf("migration %d: no down steps for %s", m.version, dialect)
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	conn := SqlConnection{Driver: "sqlite", Database: filepath.Join(t.TempDir(), "organizer.db")}
+	db, err := sql.Open("sqlite", conn.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrateTo := func(target int64) {
+		t.Helper()
+		if err := Migrate(ctx, db, DialectSQLite, MigrateOptions{Target: target}); err != nil {
+			t.Fatalf("migrate to %d: %v", target, err)
+		}
+	}
+	hasUsers := func() bool {
+		_, err := db.Exec("select 1 from users;")
+		return err == nil
+	}
+
+	var dryRun strings.Builder
+	if err := Migrate(ctx, db, DialectSQLite, MigrateOptions{Target: LatestVersion, DryRun: &dryRun}); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !strings.Contains(dryRun.String(), "create table if not exists users") {
+		t.Errorf("dry run didn't print the schema:\n%s", dryRun.String())
+	}
+	if hasUsers() {
+		t.Error("dry run created the schema")
+	}
+
+	migrateTo(LatestVersion)
+	status, err := Migrations(ctx, db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range status {
+		if !st.Applied || st.Modified || st.AppliedAt.IsZero() {
+			t.Errorf("migration %d: got %+v, want applied and unmodified", st.Version, st)
+		}
+	}
+
+	migrateTo(0)
+	if hasUsers() {
+		t.Error("users table still exists after reverting all migrations")
+	}
+	status, err = Migrations(ctx, db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range status {
+		if st.Applied {
+			t.Errorf("migration %d: still applied", st.Version)
+		}
+	}
+	migrateTo(LatestVersion)
+	if !hasUsers() {
+		t.Error("users table missing after migrating up again")
+	}
+
+	if err := Migrate(ctx, db, DialectSQLite, MigrateOptions{Target: LatestVersion + 1}); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("unknown target: got %v, want ErrUnknownVersion", err)
+	}
+	if _, err := db.Exec("update migrations set checksum = 'edited' where version = ?;", LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, db, DialectSQLite, MigrateOptions{Target: 0}); !errors.Is(err, ErrMigrationModified) {
+		t.Errorf("modified migration: got %v, want ErrMigrationModified", err)
+	}
+	if !hasUsers() {
+		t.Error("migrated down despite a modified migration")
+	}
+}
+
+func TestMigrateLegacyTable(t *testing.T) {
+	ctx := context.Background()
+	conn := SqlConnection{Driver: "sqlite", Database: filepath.Join(t.TempDir(), "organizer.db")}
+	db, err := sql.Open("sqlite", conn.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The migrations table as it was before names and checksums.
+	if _, err := db.Exec(`create table migrations (
+		version integer primary key,
+		created_at timestamp not null default current_timestamp
+	);`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, db, DialectSQLite, MigrateOptions{Target: LatestVersion}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var name string
+	var checksum sql.NullString
+	if err := db.QueryRow("select name, checksum from migrations where version = ?;", LatestVersion).Scan(&name, &checksum); err != nil {
+		t.Fatal(err)
+	}
+	if want := migrations[LatestVersion-1]; name != want.name || checksum.String != want.For(DialectSQLite).checksum() {
+		t.Errorf("got %s %v, want %s with checksum", name, checksum, want.name)
+	}
+
+	// Versions applied before checksums existed are adopted as they are.
+	if _, err := db.Exec("update migrations set name = '', checksum = null;"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(ctx, db, DialectSQLite, MigrateOptions{Target: LatestVersion}); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	status, err := Migrations(ctx, db, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := status[len(status)-1]; !st.Applied || st.Modified {
+		t.Errorf("got %+v, want applied and unmodified", st)
+	}
+	if err := db.QueryRow("select name from migrations where version = ?;", LatestVersion).Scan(&name); err != nil || name != migrations[LatestVersion-1].name {
+		t.Errorf("name not recorded: %q, %v", name, err)
+	}
+}
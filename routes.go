@@ -2,11 +2,22 @@ package organizer
 
 import (
 	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
+	"log/slog"
 	"fmt"
+	"html/template"
 	"net/http"
+	"net/mail"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type StringResponder string
@@ -43,25 +54,56 @@ func redirect(to string) HandlerWithError {
 }
 
 func (s *Service) routeIndex(w http.ResponseWriter, r *http.Request) error {
-	session, ok := s.auth.SessionFromRequest(r)
+	session, ok, err := s.auth.SessionFromRequest(r)
+	if err != nil {
+		return err
+	}
 	if ok && session.IsAuthenticated() {
 		http.Redirect(w, r, "/events", http.StatusFound)
 		return nil
 	}
-	return pages.Execute(w, "Landing", nil)
+	if ok && session.HasPendingSecondFactor() {
+		http.Redirect(w, r, "/auth/second-factor", http.StatusFound)
+		return nil
+	}
+	data := LandingData{}
+	if s.auth.oidc != nil {
+		data.Oidc = s.auth.oidc.Name()
+	}
+	return pages.Execute(w, "Landing", data)
 }
 
 func (s *Service) withSession(next HandlerWithError, mustBeAuthed bool) HandlerWithError {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		session, ok := s.auth.SessionFromRequest(r)
+		session, ok, err := s.auth.SessionFromRequest(r)
+		if err != nil {
+			return err
+		}
 		if !ok {
 			//return Unauthorized()
 			return redirect("/home")(w, r)
 		}
 		if mustBeAuthed && !session.IsAuthenticated() {
+			if session.HasPendingSecondFactor() {
+				http.Redirect(w, r, "/auth/second-factor", http.StatusFound)
+				return nil
+			}
 			//return Unauthorized()
 			return redirect("/home")(w, r)
 		}
+		if session.Impersonator() != 0 {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				// Admins may look, but not act on behalf of the user.
+				return Forbidden()
+			}
+		}
+		if session.IsAuthenticated() {
+			if err := session.Touch(r.Context(), s.clientInfo(r)); err != nil {
+				slog.Error("failed to record session activity", "error", err)
+			}
+		}
 		ctx := context.WithValue(r.Context(), "SESSION", session)
 		return next(w, r.WithContext(ctx))
 	}
@@ -71,6 +113,154 @@ func (s *Service) withAuth(next HandlerWithError) HandlerWithError {
 	return s.withSession(next, true)
 }
 
+// withTokenAuth works like withAuth, but also accepts a personal api token
+// in an Authorization: Bearer header, so that scripts can use the handler
+// without a browser.
+func (s *Service) withTokenAuth(next HandlerWithError) HandlerWithError {
+	withCookie := s.withAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) error {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return withCookie(w, r)
+		}
+		token, err := s.repo.ApiTokenByHash(r.Context(), HashApiToken(bearer))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Unauthorized()
+			}
+			return err
+		}
+		if !token.Scope.Allows(r.Method) {
+			return Forbidden()
+		}
+		if err := s.checkEnabled(r.Context(), token.User); err != nil {
+			return err
+		}
+		if err := s.repo.TouchApiToken(r.Context(), token.ID); err != nil {
+			slog.Error("failed to record api token usage", "error", err)
+		}
+		ctx := context.WithValue(r.Context(), "SESSION", s.auth.TokenSession(token.User))
+		ctx = context.WithValue(ctx, "API_TOKEN", token)
+		return next(w, r.WithContext(ctx))
+	}
+}
+
+// withRole rejects users below role. It must be wrapped by withAuth or
+// withTokenAuth.
+func (s *Service) withRole(role Role, next HandlerWithError) HandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		session, valid := r.Context().Value("SESSION").(*Session)
+		if !valid {
+			// Technically, should never reach this case.
+			return Unauthorized()
+		}
+		user, err := s.repo.User(r.Context(), session.User)
+		if err != nil {
+			return err
+		}
+		if !user.Role.Includes(role) {
+			return Forbidden()
+		}
+		return next(w, r)
+	}
+}
+
+// authorize fails with 403, unless the user of session has perm.
+func (s *Service) authorize(ctx context.Context, session *Session, perm Permission) error {
+	user, err := s.repo.User(ctx, session.User)
+	if err != nil {
+		return err
+	}
+	if !user.Can(perm) {
+		return Forbidden()
+	}
+	return nil
+}
+
+// checkEnabled fails with 403 if an admin has disabled the user.
+func (s *Service) checkEnabled(ctx context.Context, id UserID) error {
+	user, err := s.repo.User(ctx, id)
+	if err != nil {
+		return err
+	}
+	if user.IsDisabled() {
+		return Forbidden()
+	}
+	return nil
+}
+
+func (s *Service) withAuthRateLimit(next HandlerWithError) HandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ip := clientIP(r, s.clientIPHeader)
+		if err := allowAll(rateCheck{s.limits.authPerIP, ip}); err != nil {
+			return err
+		}
+		return next(w, r)
+	}
+}
+
+// withCsrf rejects state-changing requests that don't carry a csrf token of
+// the requesting session, either in the csrf form field or in the
+// X-Csrf-Token header. Requests without a session are passed on, the
+// handler has to deal with them anyway, and decoy sessions (see
+// sendSignupLink) must get the same treatment as real ones.
+func (s *Service) withCsrf(next HandlerWithError) HandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(w, r)
+		}
+		// Browsers don't attach bearer tokens on their own.
+		if _, ok := r.Context().Value("API_TOKEN").(ApiToken); ok {
+			return next(w, r)
+		}
+		session, ok := r.Context().Value("SESSION").(*Session)
+		if !ok {
+			var err error
+			session, ok, err = s.auth.SessionFromRequest(r)
+			if err != nil {
+				return err
+			}
+		}
+		if ok {
+			csrf := CsrfID(r.Header.Get("X-Csrf-Token"))
+			if csrf == "" {
+				csrf = CsrfID(r.FormValue("csrf"))
+			}
+			if csrf == "" || !session.VerifyCsrf(csrf) {
+				s.audit(r, AuditEntry{User: session.User, Action: AuditCsrfFailed, Detail: r.URL.Path})
+				if csrf == "" {
+					return BadRequest("missing field: csrf")
+				}
+				return Unauthorized()
+			}
+		}
+		return next(w, r)
+	}
+}
+
+// checkLoginRate must be called before sending any mail to email.
+func (s *Service) checkLoginRate(r *http.Request, email string) error {
+	return allowAll(
+		rateCheck{s.limits.loginPerIP, clientIP(r, s.clientIPHeader)},
+		rateCheck{s.limits.loginPerEmail, strings.ToLower(email)},
+		rateCheck{s.limits.loginGlobal, ""},
+	)
+}
+
+// clientInfo describes the device a request comes from, so that users can
+// recognize their sessions.
+func (s *Service) clientInfo(r *http.Request) ClientInfo {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = strings.ToValidUTF8(userAgent[:255], "")
+	}
+	return ClientInfo{
+		IP:        clientIP(r, s.clientIPHeader),
+		UserAgent: userAgent,
+	}
+}
+
 func (s *Service) login(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost { // @todo: do check for every request handler
 		return MethodNotAllowed()
@@ -80,41 +270,140 @@ func (s *Service) login(w http.ResponseWriter, r *http.Request) error {
 	if email == "" {
 		return BadRequest("missing field: email")
 	}
+	if err := s.checkLoginRate(r, email); err != nil {
+		return err
+	}
 
-	user, err := s.repo.UserByEmail(email)
+	user, err := s.repo.UserByEmail(r.Context(), email)
 	if err != nil {
-		return Maybe404(err)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Respond exactly as if the account existed, so that the login form
+		// can't be used to find out who is registered.
+		return s.sendSignupLink(w, r, email)
+	}
+
+	return s.sendLoginLink(w, r, user)
+}
+
+func (s *Service) signup(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	default:
+		return MethodNotAllowed()
+	case http.MethodGet:
+		return pages.Execute(w, "Signup", nil)
+	case http.MethodPost:
+		name := r.FormValue("name")
+		if name == "" {
+			return BadRequest("missing field: name")
+		}
+		if utf8.RuneCountInString(name) > 30 {
+			return BadRequest("invalid value for field name: must be at most 30 characters")
+		}
+		email := r.FormValue("email")
+		if email == "" {
+			return BadRequest("missing field: email")
+		}
+		// Only the bare address, or the account would be stored under a
+		// name nobody can log in with.
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return BadRequest("invalid value for field email: must be an email address")
+		}
+		if err := s.checkLoginRate(r, email); err != nil {
+			return err
+		}
+
+		user, err := s.repo.UserByEmail(r.Context(), email)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			user, err = s.repo.CreateUser(r.Context(), NewUser(name, email))
+			if err != nil {
+				return err
+			}
+		}
+
+		// If the address is already registered, we send a login link
+		// instead, again without revealing that the account existed.
+		return s.sendLoginLink(w, r, user)
+	}
+}
+
+// sendLoginLink starts a new session for user and mails them the link to
+// authenticate it. Users that haven't verified their email yet get a
+// verification link instead, redeeming it activates their account.
+func (s *Service) sendLoginLink(w http.ResponseWriter, r *http.Request, user User) error {
+	session, err := s.auth.CreateSession(r.Context(), user.ID, s.clientInfo(r))
+	if err != nil {
+		return err
 	}
 
-	session, err := s.auth.CreateSession(user.ID)
+	login, err := session.RequestLogin(r.Context())
+	if err != nil {
+		return err
+	}
+	code, err := session.RequestLoginCode(r.Context())
 	if err != nil {
 		return err
 	}
+	csrf := session.CsrfToken()
 
-	login, err := session.RequestLogin()
+	mail := LoginMail{
+		Link: TokenLink{
+			Token: login.Value,
+			Where: s.url,
+		},
+		Code: code.Value,
+	}
+	if user.IsActive() {
+		err = s.mail.SendLoginLink(user.Email, mail)
+	} else {
+		err = s.mail.SendVerificationLink(user.Email, mail)
+	}
 	if err != nil {
 		return err
 	}
+	s.audit(r, AuditEntry{User: user.ID, Action: AuditLoginRequested})
+
+	setSessionCookie(w, session.Value, session.Expires(s.auth.sessionTokenExpiryLimit))
+	return pages.Execute(w, "LoginLinkSent", LoginLinkSentData{Csrf: csrf})
+}
+
+// sendSignupLink responds to a login attempt for an unknown email the same
+// way sendLoginLink does, but the mail invites the recipient to sign up.
+func (s *Service) sendSignupLink(w http.ResponseWriter, r *http.Request, email string) error {
+	if err := s.mail.SendSignupLink(email, SignupLink{Where: s.url}); err != nil {
+		// Failing here would tell apart unknown addresses.
+		slog.Error("failed to send signup link", "error", err)
+	}
+	s.audit(r, AuditEntry{Action: AuditLoginRequested, Detail: "unknown address"})
 
-	if err := s.mail.SendLoginLink(user.Email, TokenLink{
-		Token: login.Value,
-		Where: s.url,
-	}); err != nil {
+	decoy, err := randomToken(s.auth.tokenLength)
+	if err != nil {
 		return err
 	}
+	setSessionCookie(w, decoy, time.Now().Add(s.auth.sessionTokenExpiryLimit))
+	return pages.Execute(w, "LoginLinkSent", LoginLinkSentData{
+		Csrf: s.auth.CsrfToken(HashToken(decoy)),
+	})
+}
 
+func setSessionCookie(w http.ResponseWriter, value string, expires time.Time) {
 	sessionCookie := &http.Cookie{
 		Name:    "session",
-		Value:   session.Value,
-		Expires: session.Expires(s.auth.sessionTokenExpiryLimit),
+		Value:   value,
+		// Otherwise it defaults to the directory of the route that logged
+		// in, e.g. /oidc.
+		Path:    "/",
+		Expires: expires,
 		// Domain: defaults to host of current document URL, not including subdomains
 		HttpOnly: true, // forbids access via Document.cookie / will still be sent with JS-initiated requests
 		SameSite: http.SameSiteStrictMode,
 		Secure:   true,
 	}
 	http.SetCookie(w, sessionCookie)
-
-	return pages.Execute(w, "LoginLinkSent", nil)
 }
 
 func (s *Service) authenticate(w http.ResponseWriter, r *http.Request) error {
@@ -123,37 +412,56 @@ func (s *Service) authenticate(w http.ResponseWriter, r *http.Request) error {
 		return BadRequest("missing parameter: token")
 	}
 
-	session, valid := r.Context().Value("SESSION").(*Session)
-	if !valid {
-		// Technically, should never reach this case.
-		return Unauthorized()
+	// The link may have been opened on a different device than the one that
+	// requested the login, in that case we offer to approve the login for
+	// the waiting device instead.
+	session, ok, err := s.auth.SessionFromRequest(r)
+	if err != nil {
+		return err
 	}
-
-	switch r.Method {
-	case http.MethodGet:
-		if !session.HasValidLoginRequest() {
+	if !ok || !session.IsLoginRequest(login) {
+		if r.Method != http.MethodGet {
+			s.audit(r, AuditEntry{Action: AuditTokenFailed, Detail: "link"})
 			return Unauthorized()
 		}
-		csrf, err := session.RequestCsrf()
+		waiting, ok, err := s.auth.SessionByLogin(r.Context(), login)
 		if err != nil {
 			return err
 		}
+		if !ok {
+			s.audit(r, AuditEntry{Action: AuditTokenFailed, Detail: "link"})
+			return Unauthorized()
+		}
+		return pages.Execute(w, "ApproveLogin", ApproveLoginData{
+			Token:       login,
+			RequestedAt: waiting.login.Created.Local(),
+			Client:      waiting.Client(),
+		})
+	}
+
+	switch r.Method {
+	case http.MethodGet:
 		data := ConfirmLoginData{
 			Token: login,
-			Csrf:  csrf.Value,
+			Csrf:  session.CsrfToken(),
 		}
 		return pages.Execute(w, "ConfirmLogin", data)
 	case http.MethodPost:
-		csrf := CsrfID(r.FormValue("csrf"))
-		if csrf == "" {
-			return BadRequest("missing parameter: csrf")
+		if err := s.prepareLogin(r.Context(), session); err != nil {
+			return err
 		}
-		if !session.InvalidateCsrf(csrf) {
-			return Unauthorized()
+		redeemed, err := session.InvalidateLogin(r.Context(), login)
+		if err != nil {
+			return err
 		}
-		if !session.InvalidateLogin(login) {
+		if !redeemed {
+			s.audit(r, AuditEntry{User: session.User, Action: AuditTokenFailed, Detail: "link"})
 			return Unauthorized()
 		}
+		if err := s.finishLogin(r.Context(), session); err != nil {
+			return err
+		}
+		s.audit(r, AuditEntry{User: session.User, Action: AuditLoginRedeemed, Detail: "link"})
 		// @todo: for all request handlers: change response depending on requested content-type?
 		//w.WriteHeader(http.StatusOK)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -161,8 +469,144 @@ func (s *Service) authenticate(w http.ResponseWriter, r *http.Request) error {
 	default:
 		return MethodNotAllowed()
 	}
+}
+
+// prepareLogin must be called before the login of session is redeemed. It
+// turns away disabled users, and makes sure users with a second factor
+// don't end up authenticated before they've entered it.
+func (s *Service) prepareLogin(ctx context.Context, session *Session) error {
+	secondFactor, err := s.needsSecondFactor(ctx, session.User)
+	if err != nil || !secondFactor {
+		return err
+	}
+	return session.RequireSecondFactor(ctx)
+}
+
+// needsSecondFactor checks that user may log in at all, and whether a code
+// from the authenticator app is required on top of the first factor.
+func (s *Service) needsSecondFactor(ctx context.Context, user UserID) (bool, error) {
+	if err := s.checkEnabled(ctx, user); err != nil {
+		return false, err
+	}
+	totp, err := s.repo.TotpSecret(ctx, user)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	return err == nil && totp.IsConfirmed(), nil
+}
+
+// finishLogin must be called after the login of session has been redeemed.
+func (s *Service) finishLogin(ctx context.Context, session *Session) error {
+	// Redeeming the link proves control over the mailbox, which is all
+	// that's needed to activate a new account.
+	return s.repo.ActivateUser(ctx, session.User)
+}
+
+// approveLogin redeems a login on behalf of the device that requested it.
+// The token is proof enough, there is no session on this device.
+func (s *Service) approveLogin(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	login := LoginID(r.FormValue("token"))
+	if login == "" {
+		return BadRequest("missing field: token")
+	}
+	session, ok, err := s.auth.SessionByLogin(r.Context(), login)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.audit(r, AuditEntry{Action: AuditTokenFailed, Detail: "link"})
+		return Unauthorized()
+	}
+	if err := s.prepareLogin(r.Context(), session); err != nil {
+		return err
+	}
+	redeemed, err := session.InvalidateLogin(r.Context(), login)
+	if err != nil {
+		return err
+	}
+	if !redeemed {
+		s.audit(r, AuditEntry{User: session.User, Action: AuditTokenFailed, Detail: "link"})
+		return Unauthorized()
+	}
+	if err := s.finishLogin(r.Context(), session); err != nil {
+		return err
+	}
+	// The client recorded is the approving device, the session shows the
+	// other one.
+	s.audit(r, AuditEntry{User: session.User, Action: AuditLoginRedeemed, Detail: "link, approved for another device"})
+	return pages.Execute(w, "LoginApproved", nil)
+}
+
+// loginCode redeems the login with the numeric code from the login mail.
+func (s *Service) loginCode(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	code := strings.TrimSpace(r.FormValue("code"))
+	if code == "" {
+		return BadRequest("missing field: code")
+	}
+
+	// Visitors with a decoy session (see sendSignupLink) must get the same
+	// response as a wrong code.
+	session, ok, err := s.auth.SessionFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.audit(r, AuditEntry{Action: AuditTokenFailed, Detail: "code"})
+		return pages.Execute(w, "LoginLinkSent", LoginLinkSentData{
+			Csrf:   CsrfID(r.FormValue("csrf")),
+			Failed: true,
+		})
+	}
+
+	// Unlike with the login link, the second factor is only required once
+	// the code is right. Guessing must not reset the attempts of a session
+	// already waiting for its second factor.
+	secondFactor, err := s.needsSecondFactor(r.Context(), session.User)
+	if err != nil {
+		return err
+	}
+	redeemed, err := session.InvalidateLoginCode(r.Context(), code, secondFactor)
+	if err != nil {
+		return err
+	}
+	if !redeemed {
+		s.audit(r, AuditEntry{User: session.User, Action: AuditTokenFailed, Detail: "code"})
+		return pages.Execute(w, "LoginLinkSent", LoginLinkSentData{
+			Csrf:   session.CsrfToken(),
+			Failed: true,
+		})
+	}
+	if err := s.finishLogin(r.Context(), session); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: session.User, Action: AuditLoginRedeemed, Detail: "code"})
+	hdr := w.Header()
+	hdr.Set("HX-Redirect", "/")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
 
-	return Unauthorized()
+// loginStatus is polled by the browser waiting for its login to be
+// approved. Responding with no content leaves the page as it is.
+func (s *Service) loginStatus(w http.ResponseWriter, r *http.Request) error {
+	session, ok, err := s.auth.SessionFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if ok && (session.IsAuthenticated() || session.HasPendingSecondFactor()) {
+		hdr := w.Header()
+		hdr.Set("HX-Redirect", "/")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
 func (s *Service) logout(w http.ResponseWriter, r *http.Request) error {
@@ -176,7 +620,10 @@ func (s *Service) logout(w http.ResponseWriter, r *http.Request) error {
 		return Unauthorized()
 	}
 
-	session.Delete()
+	if err := session.Delete(r.Context()); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: session.User, Action: AuditLogout})
 
 	removeCookie := &http.Cookie{
 		Name:    "session",
@@ -195,14 +642,60 @@ func (s *Service) logout(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// eventPageSize is how many events are shown at once, more are loaded on
+// demand.
+const eventPageSize = 20
+
 func (s *Service) events(w http.ResponseWriter, r *http.Request) error {
-	events, err := s.repo.Events()
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	eventsDto := EventListing{
+		Search:     strings.TrimSpace(r.FormValue("q")),
+		Repeats:    r.FormValue("repeats"),
+		Free:       r.FormValue("free") == "on",
+		Mine:       r.FormValue("mine") == "on",
+		Registered: r.FormValue("registered") == "on",
+		Csrf:       session.CsrfToken(),
+	}
+	query := EventQuery{
+		Search:       eventsDto.Search,
+		HasFreeSpots: eventsDto.Free,
+		Limit:        eventPageSize,
+	}
+	switch eventsDto.Repeats {
+	case "":
+	case "yes", "no":
+		query.Repeating = sql.NullBool{Bool: eventsDto.Repeats == "yes", Valid: true}
+	default:
+		return BadRequest("invalid value for field repeats: must be yes or no")
+	}
+	if eventsDto.Mine {
+		query.CreatedBy = session.User
+	}
+	if eventsDto.Registered {
+		query.RegisteredBy = session.User
+	}
+	sort, ok := ValidEventSort(r.FormValue("sort"))
+	if !ok {
+		return BadRequest("invalid value for field sort: unknown order")
+	}
+	query.Sort = sort
+	eventsDto.Sort = sort
+	after, err := eventAfter(r)
+	if err != nil {
+		return err
+	}
+	query.After = after
+
+	events, err := s.repo.Events(r.Context(), query)
 	if err != nil {
 		return Maybe404(err)
 	}
 
 	// @todo: turn this into a dto package function
-	eventsDto := EventListing{}
 	for _, event := range events {
 		eventsDto.Events = append(eventsDto.Events, EventInfo{
 			ID: event.ID,
@@ -213,20 +706,40 @@ func (s *Service) events(w http.ResponseWriter, r *http.Request) error {
 			NumberOfParticipants: event.NumberOfParticipants,
 		})
 	}
+	if len(events) == eventPageSize {
+		eventsDto.More = "/events?" + eventsDto.query(query.CursorOf(events[len(events)-1])).Encode()
+	}
 
+	// htmx only asks for the next page, to append it to the listing.
+	if r.Header.Get("HX-Request") == "true" && !after.IsZero() {
+		return pages.Execute(w, "EventPage", eventsDto)
+	}
 	return pages.Execute(w, "EventListing", eventsDto)
 }
 
+// eventAfter parses the cursor of the next page, written by
+// EventListing.query: the id of the last event shown, and its title when
+// sorting by title.
+func eventAfter(r *http.Request) (EventCursor, error) {
+	str := r.FormValue("after")
+	if str == "" {
+		return EventCursor{}, nil
+	}
+	idStr, title, _ := strings.Cut(str, ":")
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		return EventCursor{}, BadRequest("invalid value for field after: must start with a positive number")
+	}
+	return EventCursor{ID: EventID(id), Title: title}, nil
+}
+
 func (s *Service) event(w http.ResponseWriter, r *http.Request) error {
 	session, valid := r.Context().Value("SESSION").(*Session)
 	if !valid {
 		// Technically, should never reach this case.
 		return Unauthorized()
 	}
-	csrf, err := session.RequestCsrf()
-	if err != nil {
-		return err
-	}
+	csrf := session.CsrfToken()
 
 	eventIDStr := r.FormValue("id")
 	if eventIDStr == "" {
@@ -236,11 +749,15 @@ func (s *Service) event(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return BadRequest("invalid value for field id: must be a number")
 	}
-	event, err := s.repo.Event(EventID(eventID))
+	event, err := s.repo.Event(r.Context(), EventID(eventID))
 	if err != nil {
 		return Maybe404(err)
 	}
-	eventRegs, err := s.repo.EventRegistrations(event.ID)
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return err
+	}
+	eventRegs, err := s.repo.EventRegistrations(r.Context(), event.ID)
 	if err != nil {
 		// @robustness: event should definitely exist here
 		return Maybe404(err)
@@ -251,7 +768,7 @@ func (s *Service) event(w http.ResponseWriter, r *http.Request) error {
 	userSub := EventRegistrationID(-1)
 	var userParticipant Participant
 	for i := range eventRegs {
-		user, err := s.repo.User(eventRegs[i].User)
+		user, err := s.repo.User(r.Context(), eventRegs[i].User)
 		if err != nil {
 			// @robustness: not found here would be an internal server error though
 			return Maybe404(err)
@@ -279,9 +796,10 @@ func (s *Service) event(w http.ResponseWriter, r *http.Request) error {
 		EventInfo: *((&EventInfo{}).From(event)), // @todo: No.
 		Participants: parts,
 		Discussion: []Comment{}, // @todo: impl
-		Csrf: csrf.Value,
+		Csrf: csrf,
 		SubID: userSub,
 		Participant: userParticipant,
+		CanDelete: event.CreatedBy == user.ID || user.Can(PermModerate),
 	}
 	return pages.Execute(w, "EventView", eventDTO)
 }
@@ -292,12 +810,15 @@ func (s *Service) create(w http.ResponseWriter, r *http.Request) error {
 		// Technically, should never reach this case.
 		return Unauthorized()
 	}
+	if err := s.authorize(r.Context(), session, PermCreateEvents); err != nil {
+		return err
+	}
 
 	switch r.Method {
 	default:
 		return MethodNotAllowed()
 	case http.MethodGet:
-		return pages.Execute(w, "Create", nil)
+		return pages.Execute(w, "Create", CreateData{Csrf: session.CsrfToken()})
 	case http.MethodPost:
 		title := r.FormValue("title")
 		desc := r.FormValue("description")
@@ -345,7 +866,7 @@ func (s *Service) create(w http.ResponseWriter, r *http.Request) error {
 			maxPart = val
 		}
 
-		event, err := s.repo.CreateEvent(NewEvent(
+		event, err := s.repo.CreateEvent(r.Context(), NewEvent(
 			session.User,
 			title,
 			desc,
@@ -361,6 +882,7 @@ func (s *Service) create(w http.ResponseWriter, r *http.Request) error {
 		// @todo: make redirectHtmx function?
 		hdr := w.Header()
 		hdr.Set("HX-Redirect", fmt.Sprintf("/event?id=%d", event.ID))
+		hdr.Set("Location", fmt.Sprintf("/event?id=%d", event.ID))
 		w.WriteHeader(http.StatusCreated)
 		return nil
 		//return redirect(fmt.Sprintf("/event?id=%d", event.ID))(w, r)
@@ -373,13 +895,6 @@ func (s *Service) eventRegister(w http.ResponseWriter, r *http.Request) error {
 		// Technically, should never reach this case.
 		return Unauthorized()
 	}
-	csrf := CsrfID(r.FormValue("csrf"))
-	if csrf == "" {
-		return BadRequest("missing field: csrf")
-	}
-	if !session.InvalidateCsrf(csrf) {
-		return Unauthorized()
-	}
 	event := r.FormValue("event")
 	if event == "" {
 		return BadRequest("missing field: event")
@@ -390,16 +905,16 @@ func (s *Service) eventRegister(w http.ResponseWriter, r *http.Request) error {
 	}
 	msg := r.FormValue("message")
 
-	reg, err := s.repo.RegisterEvent(NewEventRegistration(
+	reg, err := s.repo.RegisterEvent(r.Context(), NewEventRegistration(
 		session.User,
 		EventID(eventID),
 		msg,
 	))
 	if err != nil {
-		return err
+		return Maybe404(err)
 	}
 
-	user, err := s.repo.User(reg.User)
+	user, err := s.repo.User(r.Context(), reg.User)
 	if err != nil {
 		// @robustness: shouldn't happen that the user is not found
 		log.Printf("could not find user: %v, got error: %v", reg.User, err)
@@ -414,13 +929,9 @@ func (s *Service) eventRegister(w http.ResponseWriter, r *http.Request) error {
 	if reg.Message.Valid {
 		participantInfo.acceptMessage = reg.Message.String
 	}
-	csrfToken, err := session.RequestCsrf()
-	if err != nil {
-		return err
-	}
 	deregInfo := UserDeregister{
 		Participant: participantInfo,
-		Csrf: csrfToken.Value,
+		Csrf: session.CsrfToken(),
 		SubID: reg.ID,
 	}
 	return pages.Execute(w, "UserDeregister", deregInfo)
@@ -432,13 +943,6 @@ func (s *Service) eventDeregister(w http.ResponseWriter, r *http.Request) error
 		// Technically, should never reach this case.
 		return Unauthorized()
 	}
-	csrf := CsrfID(r.FormValue("csrf"))
-	if csrf == "" {
-		return BadRequest("missing field: csrf")
-	}
-	if !session.InvalidateCsrf(csrf) {
-		return Unauthorized()
-	}
 	subStr := r.FormValue("subscription_id")
 	if subStr == "" {
 		return BadRequest("missing field: subscription_id")
@@ -449,7 +953,7 @@ func (s *Service) eventDeregister(w http.ResponseWriter, r *http.Request) error
 	}
 	subID := EventRegistrationID(subNum)
 
-	sub, err := s.repo.EventRegistration(subID)
+	sub, err := s.repo.EventRegistration(r.Context(), subID)
 	if err != nil {
 		return Maybe404(err)
 	}
@@ -459,18 +963,1558 @@ func (s *Service) eventDeregister(w http.ResponseWriter, r *http.Request) error
 		return NotFound(r) // @todo: maybe make it clearer in the error message that it's the id that was "not found", and not the url path
 	}
 
-	err = s.repo.DeregisterEvent(subID)
+	err = s.repo.DeregisterEvent(r.Context(), subID)
 	if err != nil {
 		return err
 	}
 
-	csrfToken, err := session.RequestCsrf()
-	if err != nil {
-		return err
-	}
 	regInfo := UserRegister{
-		Csrf: csrfToken.Value,
+		Csrf: session.CsrfToken(),
 		ID: sub.Event,
 	}
 	return pages.Execute(w, "UserRegister", regInfo)
 }
+
+// eventDelete moves an event to the trash, from where its creator or a
+// moderator can restore it until it is purged.
+func (s *Service) eventDelete(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		return BadRequest("missing field: id")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return BadRequest("invalid value for field id: must be a number")
+	}
+	event, err := s.repo.Event(r.Context(), EventID(id))
+	if err != nil {
+		return Maybe404(err)
+	}
+	if event.CreatedBy != session.User {
+		if err := s.authorize(r.Context(), session, PermModerate); err != nil {
+			return err
+		}
+	}
+	if err := s.repo.DeleteEvent(r.Context(), event.ID); err != nil {
+		return Maybe404(err)
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+	return nil
+}
+
+// trashOwner returns whose deleted items the user of session may see and
+// restore: their own, or everyone's for moderators.
+func (s *Service) trashOwner(ctx context.Context, session *Session) (UserID, error) {
+	user, err := s.repo.User(ctx, session.User)
+	if err != nil {
+		return 0, err
+	}
+	if user.Can(PermModerate) {
+		return 0, nil
+	}
+	return user.ID, nil
+}
+
+func (s *Service) trash(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	owner, err := s.trashOwner(r.Context(), session)
+	if err != nil {
+		return err
+	}
+	events, err := s.repo.DeletedEvents(r.Context(), owner)
+	if err != nil {
+		return err
+	}
+	regs, err := s.repo.DeletedEventRegistrations(r.Context(), owner)
+	if err != nil {
+		return err
+	}
+	return pages.Execute(w, "Trash", TrashData{
+		Events:        events,
+		Registrations: regs,
+		All:           owner == 0,
+		Retention:     s.trashRetention,
+		Csrf:          session.CsrfToken(),
+	})
+}
+
+func (s *Service) trashRestore(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	owner, err := s.trashOwner(r.Context(), session)
+	if err != nil {
+		return err
+	}
+	if idStr := r.FormValue("event"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return BadRequest("invalid value for field event: must be a number")
+		}
+		if err := s.repo.RestoreEvent(r.Context(), EventID(id), owner); err != nil {
+			return Maybe404(err)
+		}
+		http.Redirect(w, r, fmt.Sprintf("/event?id=%d", id), http.StatusSeeOther)
+		return nil
+	}
+	if idStr := r.FormValue("registration"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return BadRequest("invalid value for field registration: must be a number")
+		}
+		if err := s.repo.RestoreEventRegistration(r.Context(), EventRegistrationID(id), owner); err != nil {
+			return Maybe404(err)
+		}
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return nil
+	}
+	return BadRequest("missing field: event or registration")
+}
+
+func (s *Service) profile(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	passkeys, err := s.repo.Passkeys(r.Context(), session.User)
+	if err != nil {
+		return err
+	}
+	totp, err := s.repo.TotpSecret(r.Context(), session.User)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	return pages.Execute(w, "Profile", ProfileData{
+		User:        user,
+		Passkeys:    passkeys,
+		TotpEnabled: totp.IsConfirmed(),
+		Csrf:        session.CsrfToken(),
+	})
+}
+
+func (s *Service) sessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	sessions, err := s.auth.SessionsOfUser(r.Context(), session.User)
+	if err != nil {
+		return err
+	}
+	csrf := session.CsrfToken()
+	entries := make([]SessionEntry, 0, len(sessions))
+	for _, other := range sessions {
+		entries = append(entries, SessionEntry{
+			Handle:   other.Handle(),
+			Created:  other.Created.Local(),
+			LastSeen: other.LastSeen().Local(),
+			Client:   other.Client(),
+			Current:  other.Hash == session.Hash,
+			Pending:  !other.IsAuthenticated(),
+		})
+	}
+	return pages.Execute(w, "Sessions", SessionsData{
+		Sessions: entries,
+		Csrf:     csrf,
+	})
+}
+
+func (s *Service) revokeSession(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	handle := r.FormValue("session")
+	if handle == "" {
+		return BadRequest("missing field: session")
+	}
+	if handle == session.Handle() {
+		return BadRequest("use logout to end the current session")
+	}
+	found, err := s.auth.RevokeSession(r.Context(), session.User, handle)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return NotFound(r)
+	}
+	s.audit(r, AuditEntry{User: session.User, Action: AuditSessionRevoked, Detail: "one other session"})
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	return nil
+}
+
+func (s *Service) revokeOtherSessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	if err := s.auth.RevokeOtherSessions(r.Context(), session); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: session.User, Action: AuditSessionRevoked, Detail: "all other sessions"})
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	return nil
+}
+
+func (s *Service) apiTokens(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	tokens, err := s.repo.ApiTokens(r.Context(), session.User)
+	if err != nil {
+		return err
+	}
+	return pages.Execute(w, "ApiTokens", ApiTokensData{
+		Tokens: tokens,
+		Csrf:   session.CsrfToken(),
+	})
+}
+
+func (s *Service) apiTokenCreate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return BadRequest("missing field: name")
+	}
+	if utf8.RuneCountInString(name) > 64 {
+		return BadRequest("invalid value for field name: must be at most 64 characters")
+	}
+	scope, ok := ValidApiTokenScope(r.FormValue("scope"))
+	if !ok {
+		return BadRequest("invalid value for field scope: must be one of read or read-write")
+	}
+	secret, hash, err := NewApiToken()
+	if err != nil {
+		return err
+	}
+	token, err := s.repo.CreateApiToken(r.Context(), ApiToken{
+		User:  session.User,
+		Name:  name,
+		Hash:  hash,
+		Scope: scope,
+	})
+	if err != nil {
+		return err
+	}
+	return pages.Execute(w, "ApiTokenCreated", ApiTokenCreatedData{
+		Token:  token,
+		Secret: secret,
+		Csrf:   session.CsrfToken(),
+	})
+}
+
+func (s *Service) apiTokenRevoke(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		return BadRequest("missing field: id")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return BadRequest("invalid value for field id: must be a number")
+	}
+	if err := s.repo.DeleteApiToken(r.Context(), ApiTokenID(id), session.User); err != nil {
+		return Maybe404(err)
+	}
+	http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+	return nil
+}
+
+func (s *Service) adminUsers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	if err := s.authorize(r.Context(), session, PermManageUsers); err != nil {
+		return err
+	}
+	users, err := s.repo.Users(r.Context())
+	if err != nil {
+		return err
+	}
+	return pages.Execute(w, "AdminUsers", AdminUsersData{
+		Users: users,
+		Roles: roles,
+		Self:  session.User,
+		Csrf:  session.CsrfToken(),
+	})
+}
+
+func (s *Service) adminSetRole(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	if err := s.authorize(r.Context(), session, PermManageUsers); err != nil {
+		return err
+	}
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		return BadRequest("missing field: id")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return BadRequest("invalid value for field id: must be a number")
+	}
+	role, ok := ValidRole(r.FormValue("role"))
+	if !ok {
+		return BadRequest("invalid value for field role: must be one of user, organizer or admin")
+	}
+	if UserID(id) == session.User {
+		// Otherwise, the last admin could lock everyone out.
+		return BadRequest("you can't change your own role")
+	}
+	target, err := s.repo.User(r.Context(), UserID(id))
+	if err != nil {
+		return Maybe404(err)
+	}
+	if err := s.repo.SetUserRole(r.Context(), target.ID, role); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{
+		User:   target.ID,
+		Actor:  session.User,
+		Action: AuditRoleChanged,
+		Detail: fmt.Sprintf("%s → %s", target.Role, role),
+	})
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+	return nil
+}
+
+// adminImpersonate lets an admin view the site as another user. The admin's
+// own session is kept aside in the impersonator cookie, so that they can
+// return to it.
+func (s *Service) adminImpersonate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	if err := s.authorize(r.Context(), session, PermManageUsers); err != nil {
+		return err
+	}
+	own, err := r.Cookie("session")
+	if err != nil {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		return BadRequest("missing field: id")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return BadRequest("invalid value for field id: must be a number")
+	}
+	if UserID(id) == session.User {
+		return BadRequest("you can't impersonate yourself")
+	}
+	target, err := s.repo.User(r.Context(), UserID(id))
+	if err != nil {
+		return Maybe404(err)
+	}
+	if target.Role.Includes(RoleAdmin) {
+		return Forbidden()
+	}
+	impersonation, err := s.auth.Impersonate(r.Context(), target.ID, session.User, s.clientInfo(r))
+	if err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: target.ID, Actor: session.User, Action: AuditImpersonationStarted})
+	setImpersonatorCookie(w, own.Value, session.Expires(s.auth.sessionTokenExpiryLimit))
+	setSessionCookie(w, impersonation.Value, impersonation.Expires(s.auth.impersonationExpiryLimit))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// impersonation renders the banner shown while an admin views the site as
+// someone else. The TitleBar loads it on every page, for everyone else the
+// response is empty.
+func (s *Service) impersonation(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, ok, err := s.auth.SessionFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if !ok || session.Impersonator() == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	return pages.Execute(w, "ImpersonationBanner", ImpersonationData{
+		User:    user,
+		Expires: session.Expires(s.auth.impersonationExpiryLimit).Local(),
+		Csrf:    session.CsrfToken(),
+	})
+}
+
+// impersonationStop ends the impersonation, and puts the admin back into
+// their own session if it is still valid. Expired impersonations can be
+// ended too, which is why this doesn't go through withAuth.
+func (s *Service) impersonationStop(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, ok, err := s.auth.SessionFromRequest(r)
+	if err != nil {
+		return err
+	}
+	if !ok || session.Impersonator() == 0 {
+		return BadRequest("not impersonating anyone")
+	}
+	admin := session.Impersonator()
+	if err := session.Delete(r.Context()); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: session.User, Actor: admin, Action: AuditImpersonationEnded})
+
+	setImpersonatorCookie(w, "", time.Time{})
+	if cookie, err := r.Cookie("impersonator"); err == nil {
+		own, ok, err := s.auth.SessionByID(r.Context(), SessionID(cookie.Value))
+		if err != nil {
+			return err
+		}
+		if ok && own.User == admin && own.IsAuthenticated() {
+			setSessionCookie(w, cookie.Value, own.Expires(s.auth.sessionTokenExpiryLimit))
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			return nil
+		}
+	}
+	setSessionCookie(w, "gone with the wind", time.Time{})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// setImpersonatorCookie keeps the session of an admin while they
+// impersonate someone. An empty value removes the cookie.
+func setImpersonatorCookie(w http.ResponseWriter, value string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     "impersonator",
+		Value:    value,
+		// Like the session cookie, otherwise it would only be sent to
+		// /admin.
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// auditPageSize is how many audit log entries are shown at once.
+const auditPageSize = 50
+
+// adminAudit shows the audit log of all accounts, optionally filtered by
+// the email of an account and the action.
+func (s *Service) adminAudit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	filter := AuditFilter{Limit: auditPageSize}
+	before, err := auditBefore(r)
+	if err != nil {
+		return err
+	}
+	filter.Before = before
+	data := AuditLogData{
+		Admin:   true,
+		Actions: auditActions,
+		User:    strings.TrimSpace(r.FormValue("user")),
+		Csrf:    session.CsrfToken(),
+	}
+	if action := r.FormValue("action"); action != "" {
+		a, ok := ValidAuditAction(action)
+		if !ok {
+			return BadRequest("invalid value for field action: unknown action")
+		}
+		filter.Action = a
+		data.Action = a
+	}
+	if data.User != "" {
+		user, err := s.repo.UserByEmail(r.Context(), data.User)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return pages.Execute(w, "AuditLog", data)
+			}
+			return err
+		}
+		filter.User = user.ID
+	}
+	entries, err := s.repo.AuditEntries(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+	if data.Entries, err = s.auditRows(r.Context(), entries); err != nil {
+		return err
+	}
+	data.Next = auditNext(entries)
+	return pages.Execute(w, "AuditLog", data)
+}
+
+// accountActivity shows users the audit log of their own account.
+func (s *Service) accountActivity(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	before, err := auditBefore(r)
+	if err != nil {
+		return err
+	}
+	entries, err := s.repo.AuditEntries(r.Context(), AuditFilter{
+		User:   session.User,
+		Before: before,
+		Limit:  auditPageSize,
+	})
+	if err != nil {
+		return err
+	}
+	rows := make([]AuditRow, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, AuditRow{AuditEntry: e})
+	}
+	return pages.Execute(w, "AuditLog", AuditLogData{
+		Entries: rows,
+		Next:    auditNext(entries),
+		Csrf:    session.CsrfToken(),
+	})
+}
+
+// auditRows looks up the addresses of the accounts involved in entries.
+func (s *Service) auditRows(ctx context.Context, entries []AuditEntry) ([]AuditRow, error) {
+	emails := map[UserID]string{}
+	email := func(id UserID) (string, error) {
+		if id == 0 {
+			return "", nil
+		}
+		if e, ok := emails[id]; ok {
+			return e, nil
+		}
+		user, err := s.repo.User(ctx, id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		emails[id] = user.Email
+		return user.Email, nil
+	}
+	rows := make([]AuditRow, 0, len(entries))
+	for _, e := range entries {
+		userEmail, err := email(e.User)
+		if err != nil {
+			return rows, err
+		}
+		actorEmail, err := email(e.Actor)
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, AuditRow{
+			AuditEntry: e,
+			UserEmail:  userEmail,
+			ActorEmail: actorEmail,
+		})
+	}
+	return rows, nil
+}
+
+func auditBefore(r *http.Request) (AuditEntryID, error) {
+	str := r.FormValue("before")
+	if str == "" {
+		return 0, nil
+	}
+	before, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || before <= 0 {
+		return 0, BadRequest("invalid value for field before: must be a positive number")
+	}
+	return AuditEntryID(before), nil
+}
+
+// auditNext returns where the next page starts, if there is one.
+func auditNext(entries []AuditEntry) AuditEntryID {
+	if len(entries) < auditPageSize {
+		return 0
+	}
+	return entries[len(entries)-1].ID
+}
+
+const (
+	emailChangeConfirmLimit = 24 * time.Hour
+	// emailChangeUndoLimit is how long the old address can undo a change.
+	emailChangeUndoLimit = 14 * 24 * time.Hour
+)
+
+// emailChange sends a confirmation link to the new address. The address of
+// the user only changes once the link has been redeemed.
+func (s *Service) emailChange(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		return BadRequest("missing field: email")
+	}
+	if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		return BadRequest("invalid value for field email: must be a valid email address")
+	}
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	if strings.EqualFold(email, user.Email) {
+		return BadRequest("invalid value for field email: must differ from the current address")
+	}
+	if err := s.checkLoginRate(r, email); err != nil {
+		return err
+	}
+
+	// Addresses of other accounts get the same response, but no mail.
+	_, err = s.repo.UserByEmail(r.Context(), email)
+	if err == nil {
+		return pages.Execute(w, "EmailChangeSent", EmailChangeData{Email: email, Csrf: session.CsrfToken()})
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	token, err := randomToken(s.auth.tokenLength)
+	if err != nil {
+		return err
+	}
+	change, err := s.repo.CreateEmailChange(r.Context(), EmailChange{
+		User:        user.ID,
+		OldEmail:    user.Email,
+		NewEmail:    email,
+		ConfirmHash: HashToken(token),
+	})
+	if err != nil {
+		return err
+	}
+	err = s.mail.SendEmailChange(change.NewEmail, EmailChangeMail{
+		Link: EmailChangeLink{
+			Token:  token,
+			Where:  s.url,
+			Action: "confirm",
+		},
+		OldEmail: change.OldEmail,
+		NewEmail: change.NewEmail,
+	})
+	if err != nil {
+		return err
+	}
+	return pages.Execute(w, "EmailChangeSent", EmailChangeData{Email: email, Csrf: session.CsrfToken()})
+}
+
+// emailConfirm switches the user over to the new address and sends the
+// undo link to the old one. The token is proof enough, the link may be
+// opened on any device.
+func (s *Service) emailConfirm(w http.ResponseWriter, r *http.Request) error {
+	token := r.FormValue("token")
+	if token == "" {
+		return BadRequest("missing parameter: token")
+	}
+	change, err := s.repo.EmailChangeByConfirmHash(r.Context(), HashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Unauthorized()
+		}
+		return err
+	}
+	if change.ConfirmedAt.Valid || change.UndoneAt.Valid || time.Since(change.RequestedAt) > emailChangeConfirmLimit {
+		return Unauthorized()
+	}
+
+	switch r.Method {
+	default:
+		return MethodNotAllowed()
+	case http.MethodGet:
+		// Mail scanners follow links, so the change needs another click.
+		return pages.Execute(w, "EmailChangeConfirm", EmailChangeData{
+			Token: token,
+			Email: change.NewEmail,
+		})
+	case http.MethodPost:
+		undo, err := randomToken(s.auth.tokenLength)
+		if err != nil {
+			return err
+		}
+		if err := s.repo.ConfirmEmailChange(r.Context(), change, HashToken(undo)); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Unauthorized()
+			}
+			return err
+		}
+		err = s.mail.SendEmailChanged(change.OldEmail, EmailChangeMail{
+			Link: EmailChangeLink{
+				Token:  undo,
+				Where:  s.url,
+				Action: "undo",
+			},
+			OldEmail: change.OldEmail,
+			NewEmail: change.NewEmail,
+		})
+		if err != nil {
+			// The change is done, failing now wouldn't help anyone.
+			slog.Error("failed to send email change notice", "error", err, "user", change.User)
+		}
+		s.audit(r, AuditEntry{
+			User:   change.User,
+			Action: AuditEmailChanged,
+			Detail: fmt.Sprintf("%s → %s", change.OldEmail, change.NewEmail),
+		})
+		return pages.Execute(w, "EmailChangeDone", EmailChangeData{Email: change.NewEmail})
+	}
+}
+
+// emailUndo restores the old address of a user and logs out all devices,
+// in case the account has been taken over.
+func (s *Service) emailUndo(w http.ResponseWriter, r *http.Request) error {
+	token := r.FormValue("token")
+	if token == "" {
+		return BadRequest("missing parameter: token")
+	}
+	change, err := s.repo.EmailChangeByUndoHash(r.Context(), HashToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Unauthorized()
+		}
+		return err
+	}
+	if !change.ConfirmedAt.Valid || change.UndoneAt.Valid || time.Since(change.ConfirmedAt.Time) > emailChangeUndoLimit {
+		return Unauthorized()
+	}
+
+	switch r.Method {
+	default:
+		return MethodNotAllowed()
+	case http.MethodGet:
+		return pages.Execute(w, "EmailChangeUndo", EmailChangeData{
+			Token: token,
+			Email: change.OldEmail,
+		})
+	case http.MethodPost:
+		if err := s.repo.UndoEmailChange(r.Context(), change); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return Unauthorized()
+			}
+			return err
+		}
+		if err := s.auth.RevokeAllSessions(r.Context(), change.User); err != nil {
+			return err
+		}
+		s.audit(r, AuditEntry{
+			User:   change.User,
+			Action: AuditEmailChanged,
+			Detail: fmt.Sprintf("undone, back to %s", change.OldEmail),
+		})
+		s.audit(r, AuditEntry{User: change.User, Action: AuditSessionRevoked, Detail: "all sessions"})
+		return pages.Execute(w, "EmailChangeDone", EmailChangeData{
+			Email:  change.OldEmail,
+			Undone: true,
+		})
+	}
+}
+
+// accountExport sends everything stored about the user as a json download.
+func (s *Service) accountExport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	export, err := ExportUserData(r.Context(), s.repo, s.auth, session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Disposition", `attachment; filename="organizer-export.json"`)
+	hdr.Set("Cache-Control", "no-store")
+	return writeJson(w, http.StatusOK, export)
+}
+
+// accountDelete deletes the account of the user. As a guard against
+// accidental clicks, the user has to type in their email.
+func (s *Service) accountDelete(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	confirm := strings.TrimSpace(r.FormValue("confirm"))
+	if confirm == "" {
+		return BadRequest("missing field: confirm")
+	}
+	if !strings.EqualFold(confirm, user.Email) {
+		return BadRequest("invalid value for field confirm: must be the email of the account")
+	}
+	if err := s.repo.DeleteUser(r.Context(), user.ID); err != nil {
+		return err
+	}
+	if err := s.auth.RevokeAllSessions(r.Context(), user.ID); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: user.ID, Action: AuditAccountDeleted})
+
+	removeCookie := &http.Cookie{
+		Name:    "session",
+		Value: "gone with the wind",
+		Expires: time.Time{},
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	}
+	http.SetCookie(w, removeCookie)
+
+	return pages.Execute(w, "AccountDeleted", nil)
+}
+
+type (
+	passkeyCredentialParam struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+	passkeyCredentialDescriptor struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	passkeyCreationOptions struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"rp"`
+		User struct {
+			ID          string `json:"id"`
+			Name        string `json:"name"`
+			DisplayName string `json:"displayName"`
+		} `json:"user"`
+		PubKeyCredParams       []passkeyCredentialParam      `json:"pubKeyCredParams"`
+		ExcludeCredentials     []passkeyCredentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection struct {
+			ResidentKey      string `json:"residentKey"`
+			UserVerification string `json:"userVerification"`
+		} `json:"authenticatorSelection"`
+		Attestation string `json:"attestation"`
+		Timeout     int64  `json:"timeout"`
+	}
+	passkeyRequestOptions struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		UserVerification string `json:"userVerification"`
+		Timeout          int64  `json:"timeout"`
+	}
+	passkeyRegistration struct {
+		Name     string `json:"name"`
+		ID       string `json:"id"`
+		Response struct {
+			ClientDataJSON    string `json:"clientDataJSON"`
+			AttestationObject string `json:"attestationObject"`
+		} `json:"response"`
+	}
+	passkeyAssertion struct {
+		ID       string `json:"id"`
+		Response struct {
+			ClientDataJSON    string `json:"clientDataJSON"`
+			AuthenticatorData string `json:"authenticatorData"`
+			Signature         string `json:"signature"`
+			UserHandle        string `json:"userHandle"`
+		} `json:"response"`
+	}
+)
+
+func (s *Service) passkeyRegisterBegin(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	passkeys, err := s.repo.Passkeys(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	challenge, err := s.auth.NewChallenge(passkeyRegisterPurpose(session))
+	if err != nil {
+		return err
+	}
+
+	opts := passkeyCreationOptions{
+		Challenge:   base64.RawURLEncoding.EncodeToString(challenge),
+		Attestation: "none",
+		Timeout:     s.auth.loginTokenExpiryLimit.Milliseconds(),
+	}
+	opts.RP.ID = s.rp.ID
+	opts.RP.Name = s.rp.Name
+	opts.User.ID = base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(int(user.ID))))
+	opts.User.Name = user.Email
+	opts.User.DisplayName = user.Name
+	if user.Display.Valid {
+		opts.User.DisplayName = user.Display.String
+	}
+	for _, alg := range coseAlgorithms {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, passkeyCredentialParam{"public-key", alg})
+	}
+	opts.ExcludeCredentials = []passkeyCredentialDescriptor{}
+	for _, passkey := range passkeys {
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, passkeyCredentialDescriptor{
+			Type: "public-key",
+			ID:   base64.RawURLEncoding.EncodeToString(passkey.CredentialID),
+		})
+	}
+	opts.AuthenticatorSelection.ResidentKey = "required"
+	opts.AuthenticatorSelection.UserVerification = "preferred"
+
+	return writeJson(w, http.StatusOK, map[string]any{"publicKey": opts})
+}
+
+func (s *Service) passkeyRegisterFinish(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	var reg passkeyRegistration
+	if err := readJson(r, &reg); err != nil {
+		return err
+	}
+	name := reg.Name
+	if name == "" {
+		return BadRequest("missing field: name")
+	}
+	if utf8.RuneCountInString(name) > 64 {
+		return BadRequest("invalid value for field name: must be at most 64 characters")
+	}
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(reg.Response.ClientDataJSON)
+	if err != nil {
+		return BadRequest("invalid value for field clientDataJSON: must be base64url")
+	}
+	attestationObject, err := base64.RawURLEncoding.DecodeString(reg.Response.AttestationObject)
+	if err != nil {
+		return BadRequest("invalid value for field attestationObject: must be base64url")
+	}
+
+	challenge, err := ChallengeFromClientData(clientDataJSON)
+	if err != nil {
+		return BadRequest(err.Error())
+	}
+	if !s.auth.VerifyChallenge(challenge, passkeyRegisterPurpose(session)) {
+		return Unauthorized()
+	}
+	cred, err := s.rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		slog.Info("passkey registration rejected", "error", err)
+		return Unauthorized()
+	}
+
+	if _, err := s.repo.PasskeyByCredentialID(r.Context(), cred.ID); err == nil {
+		return BadRequest("passkey is already registered")
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = s.repo.CreatePasskey(r.Context(), Passkey{
+		User:         session.User,
+		Name:         name,
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    cred.SignCount,
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Service) passkeyDelete(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	idStr := r.FormValue("id")
+	if idStr == "" {
+		return BadRequest("missing field: id")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return BadRequest("invalid value for field id: must be a number")
+	}
+	if err := s.repo.DeletePasskey(r.Context(), PasskeyID(id), session.User); err != nil {
+		return Maybe404(err)
+	}
+	hdr := w.Header()
+	hdr.Set("HX-Redirect", "/profile")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Service) passkeyLoginBegin(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	// The challenge is bound to a nonce cookie, so that a captured assertion
+	// can't be replayed from another browser.
+	nonce, err := randomToken(s.auth.tokenLength)
+	if err != nil {
+		return err
+	}
+	challenge, err := s.auth.NewChallenge(passkeyLoginPurpose(nonce))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "passkey",
+		Value:    nonce,
+		Path:     "/passkey/login",
+		MaxAge:   int(s.auth.loginTokenExpiryLimit.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	})
+	opts := passkeyRequestOptions{
+		Challenge:        base64.RawURLEncoding.EncodeToString(challenge),
+		RPID:             s.rp.ID,
+		UserVerification: "preferred",
+		Timeout:          s.auth.loginTokenExpiryLimit.Milliseconds(),
+	}
+	return writeJson(w, http.StatusOK, map[string]any{"publicKey": opts})
+}
+
+func (s *Service) passkeyLoginFinish(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	nonceCookie, err := r.Cookie("passkey")
+	if err != nil {
+		return Unauthorized()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "passkey",
+		Path:     "/passkey/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	})
+
+	var assertion passkeyAssertion
+	if err := readJson(r, &assertion); err != nil {
+		return err
+	}
+	credentialID, err := base64.RawURLEncoding.DecodeString(assertion.ID)
+	if err != nil {
+		return BadRequest("invalid value for field id: must be base64url")
+	}
+	clientDataJSON, err := base64.RawURLEncoding.DecodeString(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return BadRequest("invalid value for field clientDataJSON: must be base64url")
+	}
+	authData, err := base64.RawURLEncoding.DecodeString(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return BadRequest("invalid value for field authenticatorData: must be base64url")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(assertion.Response.Signature)
+	if err != nil {
+		return BadRequest("invalid value for field signature: must be base64url")
+	}
+
+	challenge, err := ChallengeFromClientData(clientDataJSON)
+	if err != nil {
+		return BadRequest(err.Error())
+	}
+	if !s.auth.VerifyChallenge(challenge, passkeyLoginPurpose(nonceCookie.Value)) {
+		return Unauthorized()
+	}
+	passkey, err := s.repo.PasskeyByCredentialID(r.Context(), credentialID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Unauthorized()
+		}
+		return err
+	}
+	signCount, err := s.rp.VerifyAssertion(challenge, WebAuthnCredential{
+		ID:        passkey.CredentialID,
+		PublicKey: passkey.PublicKey,
+		SignCount: passkey.SignCount,
+	}, clientDataJSON, authData, signature)
+	if err != nil {
+		slog.Info("passkey assertion rejected", "error", err, "passkey", passkey.ID)
+		return Unauthorized()
+	}
+	// Authenticators without a signature counter can't tell a replayed
+	// assertion from a new one, so the challenge can't be reused either.
+	fresh, err := s.auth.ConsumeChallenge(r.Context(), challenge, passkeyLoginPurpose(nonceCookie.Value))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		slog.Info("passkey assertion replayed", "passkey", passkey.ID)
+		return Unauthorized()
+	}
+	if err := s.repo.UpdatePasskeySignCount(r.Context(), passkey.ID, signCount); err != nil {
+		return err
+	}
+	if err := s.checkEnabled(r.Context(), passkey.User); err != nil {
+		return err
+	}
+
+	session, err := s.auth.CreateAuthenticatedSession(r.Context(), passkey.User, s.clientInfo(r))
+	if err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: passkey.User, Action: AuditLoginRedeemed, Detail: "passkey"})
+	setSessionCookie(w, session.Value, session.Expires(s.auth.sessionTokenExpiryLimit))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// oidcLogin sends the browser to the identity provider. The secrets of the
+// request are kept in a cookie until the browser returns to oidcCallback.
+func (s *Service) oidcLogin(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	if s.auth.oidc == nil {
+		return NotFound(r)
+	}
+	req, err := NewOidcRequest()
+	if err != nil {
+		return err
+	}
+	where, err := s.auth.oidc.AuthorizationURL(r.Context(), req)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc",
+		Value:    strings.Join([]string{req.State, req.Nonce, req.Verifier}, "."),
+		Path:     "/oidc",
+		MaxAge:   int(s.auth.loginTokenExpiryLimit.Seconds()),
+		HttpOnly: true,
+		// The provider redirects back cross-site, a strict cookie wouldn't
+		// be sent along.
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+	})
+	http.Redirect(w, r, where, http.StatusFound)
+	return nil
+}
+
+// oidcCallback logs in the user the identity provider vouches for. Users are
+// matched by their email address, unknown addresses get a new account.
+func (s *Service) oidcCallback(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return MethodNotAllowed()
+	}
+	if s.auth.oidc == nil {
+		return NotFound(r)
+	}
+	cookie, err := r.Cookie("oidc")
+	if err != nil {
+		return Unauthorized()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oidc",
+		Path:     "/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   true,
+	})
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return Unauthorized()
+	}
+	req := OidcRequest{State: parts[0], Nonce: parts[1], Verifier: parts[2]}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("state")), []byte(req.State)) != 1 {
+		return Unauthorized()
+	}
+	if errCode := r.FormValue("error"); errCode != "" {
+		slog.Info("oidc login failed at provider", "error", errCode, "description", r.FormValue("error_description"))
+		return Unauthorized()
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		return BadRequest("missing parameter: code")
+	}
+
+	identity, err := s.auth.oidc.Exchange(r.Context(), req, code)
+	if err != nil {
+		if errors.Is(err, ErrOidc) {
+			slog.Info("oidc login rejected", "error", err)
+			return Unauthorized()
+		}
+		return err
+	}
+	if identity.Email == "" || !identity.EmailVerified {
+		return BadRequest("the identity provider did not confirm an email address")
+	}
+	if addr, err := mail.ParseAddress(identity.Email); err != nil || addr.Address != identity.Email {
+		return BadRequest("the identity provider sent an invalid email address")
+	}
+
+	user, err := s.repo.UserByEmail(r.Context(), identity.Email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		user, err = s.repo.CreateUser(r.Context(), NewUser(oidcUserName(identity), identity.Email))
+		if err != nil {
+			return err
+		}
+	}
+
+	session, err := s.auth.CreateSession(r.Context(), user.ID, s.clientInfo(r))
+	if err != nil {
+		return err
+	}
+	if err := s.prepareLogin(r.Context(), session); err != nil {
+		return err
+	}
+	if err := session.Authenticate(r.Context()); err != nil {
+		return err
+	}
+	// The provider has verified the address, same as a login link would.
+	if err := s.finishLogin(r.Context(), session); err != nil {
+		return err
+	}
+	s.audit(r, AuditEntry{User: user.ID, Action: AuditLoginRedeemed, Detail: "oidc"})
+	setSessionCookie(w, session.Value, session.Expires(s.auth.sessionTokenExpiryLimit))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// oidcUserName picks a name for users provisioned through oidc, within the
+// limits of the signup form.
+func oidcUserName(identity OidcIdentity) string {
+	name := strings.TrimSpace(identity.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if runes := []rune(name); len(runes) > 30 {
+		name = string(runes[:30])
+	}
+	return name
+}
+
+func passkeyRegisterPurpose(session *Session) string {
+	return "passkey-register:" + session.Handle()
+}
+
+func passkeyLoginPurpose(nonce string) string {
+	return "passkey-login:" + nonce
+}
+
+// readJson decodes a json request body. The content type is enforced, since
+// json endpoints don't check csrf tokens: cross-site forms can't send json.
+func readJson(r *http.Request, v any) error {
+	if mime := r.Header.Get("Content-Type"); !strings.HasPrefix(mime, "application/json") {
+		return BadRequest("content type must be application/json")
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(v); err != nil {
+		return BadRequest(fmt.Sprintf("malformed json: %v", err))
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) error {
+	hdr := w.Header()
+	hdr.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (s *Service) secondFactor(w http.ResponseWriter, r *http.Request) error {
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	if !session.HasPendingSecondFactor() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+
+	switch r.Method {
+	default:
+		return MethodNotAllowed()
+	case http.MethodGet:
+		return pages.Execute(w, "SecondFactor", SecondFactorData{Csrf: session.CsrfToken()})
+	case http.MethodPost:
+		code := r.FormValue("code")
+		if code == "" {
+			return BadRequest("missing field: code")
+		}
+		ok, err := s.verifySecondFactor(r.Context(), session.User, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			attemptsLeft, err := session.FailSecondFactor(r.Context())
+			if err != nil {
+				return err
+			}
+			s.audit(r, AuditEntry{User: session.User, Action: AuditTokenFailed, Detail: "second factor"})
+			if attemptsLeft == 0 {
+				return Unauthorized()
+			}
+			return pages.Execute(w, "SecondFactor", SecondFactorData{
+				Csrf:         session.CsrfToken(),
+				Failed:       true,
+				AttemptsLeft: attemptsLeft,
+			})
+		}
+		if err := session.CompleteSecondFactor(r.Context()); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
+}
+
+// verifySecondFactor accepts either a current TOTP code or one of the
+// user's unused recovery codes. Either can only be used once.
+func (s *Service) verifySecondFactor(ctx context.Context, user UserID, code string) (bool, error) {
+	totp, err := s.repo.TotpSecret(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	if !totp.IsConfirmed() {
+		return false, nil
+	}
+	if step, ok := ValidateTotp(totp.Secret, code, time.Now(), totp.LastStep); ok {
+		return s.repo.UseTotpStep(ctx, user, step)
+	}
+	return s.repo.UseRecoveryCode(ctx, user, HashRecoveryCode(code))
+}
+
+func (s *Service) totpEnroll(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	user, err := s.repo.User(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	existing, err := s.repo.TotpSecret(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && existing.IsConfirmed() {
+		return BadRequest("second factor is already enabled")
+	}
+
+	secret, err := NewTotpSecret()
+	if err != nil {
+		return err
+	}
+	if err := s.repo.SaveTotpSecret(r.Context(), TotpSecret{User: user.ID, Secret: secret}); err != nil {
+		return err
+	}
+	uri := TotpProvisioningUri(s.rp.Name, user.Email, secret)
+	qr, err := qrEncode(uri)
+	if err != nil {
+		return err
+	}
+	return pages.Execute(w, "TotpEnroll", TotpEnrollData{
+		// otpauth: isn't a scheme html/template trusts on its own.
+		ProvisioningUri: template.URL(uri),
+		QRCode:          qr.SVG(),
+		Secret:          TotpSecretString(secret),
+		Csrf:            session.CsrfToken(),
+	})
+}
+
+func (s *Service) totpConfirm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		return BadRequest("missing field: code")
+	}
+	totp, err := s.repo.TotpSecret(r.Context(), session.User)
+	if err != nil {
+		return Maybe404(err)
+	}
+	if totp.IsConfirmed() {
+		return BadRequest("second factor is already enabled")
+	}
+	step, ok := ValidateTotp(totp.Secret, code, time.Now(), totp.LastStep)
+	if !ok {
+		return BadRequest("invalid value for field code: code does not match, check the time of your device")
+	}
+	used, err := s.repo.UseTotpStep(r.Context(), session.User, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		// A concurrent request got in first with the same code.
+		return BadRequest("invalid value for field code: code does not match, check the time of your device")
+	}
+
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := s.repo.SetRecoveryCodes(r.Context(), session.User, hashes); err != nil {
+		return err
+	}
+	if err := s.repo.ConfirmTotpSecret(r.Context(), session.User); err != nil {
+		return err
+	}
+	return pages.Execute(w, "TotpRecoveryCodes", TotpRecoveryCodesData{
+		Codes: codes,
+		Csrf:  session.CsrfToken(),
+	})
+}
+
+func (s *Service) totpDisable(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return MethodNotAllowed()
+	}
+	session, valid := r.Context().Value("SESSION").(*Session)
+	if !valid {
+		// Technically, should never reach this case.
+		return Unauthorized()
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		return BadRequest("missing field: code")
+	}
+	ok, err := s.verifySecondFactor(r.Context(), session.User, code)
+	if err != nil {
+		return Maybe404(err)
+	}
+	if !ok {
+		return Unauthorized()
+	}
+	if err := s.repo.DeleteTotpSecret(r.Context(), session.User); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	return nil
+}
@@ -2,24 +2,32 @@ package organizer
 
 import (
 	"context"
-	"database/sql"
-	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	"log/slog"
 	"net/http"
 	"time"
-
-	"github.com/cvanloo/organizer/isdelve"
 )
 
 type (
 	Service struct {
 		url    Url
+		rp     RelyingParty
 		mux    *http.ServeMux
 		dbConn SqlConnection
 		repo   Repository
 		auth   *Authenticator
-		mail   *Mailer
+		mail   Mailer
+
+		persistSessions bool
+		clientIPHeader  string
+		trashRetention  time.Duration
+		limits          struct {
+			loginPerEmail *RateLimiter
+			loginPerIP    *RateLimiter
+			loginGlobal   *RateLimiter
+			authPerIP     *RateLimiter
+		}
 	}
 	Url        string
 	ServiceOpt func(*Service)
@@ -28,19 +36,36 @@ type (
 func NewService(opts ...ServiceOpt) (*Service, error) {
 	// @todo: mandatory args
 	s := &Service{
-		url:  "http://localhost:8080/",
-		mux:  http.DefaultServeMux,
-		auth: NewAuthenticator(),
+		url:            "http://localhost:8080/",
+		mux:            http.DefaultServeMux,
+		auth:           NewAuthenticator(),
+		trashRetention: 30 * 24 * time.Hour,
 	}
 
+	s.limits.loginPerEmail = NewRateLimiter(RateLimit{3, 10 * time.Minute})
+	s.limits.loginPerIP = NewRateLimiter(RateLimit{10, 10 * time.Minute})
+	s.limits.loginGlobal = NewRateLimiter(RateLimit{100, time.Minute})
+	s.limits.authPerIP = NewRateLimiter(RateLimit{30, time.Minute})
+
 	for _, opt := range opts {
 		opt(s)
 	}
 
+	rp, err := RelyingPartyFromUrl(s.url, "Organizer")
+	if err != nil {
+		return nil, fmt.Errorf("invalid service url: %w", err)
+	}
+	s.rp = rp
+
 	s.setupRoutes()
 
-	if err := s.initializeDatabase(); err != nil {
-		return nil, err
+	if s.repo == nil {
+		if err := s.initializeDatabase(); err != nil {
+			return nil, err
+		}
+	}
+	if s.persistSessions {
+		s.auth.store = s.repo
 	}
 
 	return s, nil
@@ -64,39 +89,103 @@ func WithDatabase(conn SqlConnection) ServiceOpt {
 	}
 }
 
+// WithRepository uses repo instead of connecting to the database configured
+// with WithDatabase, e.g. a MemoryRepository for tests.
+func WithRepository(repo Repository) ServiceOpt {
+	return func(s *Service) {
+		s.repo = repo
+	}
+}
+
 func WithAuthentication(auth *Authenticator) ServiceOpt {
 	return func(s *Service) {
 		s.auth = auth
 	}
 }
 
-func WithMailer(mail *Mailer) ServiceOpt {
+// WithPersistentSessions stores sessions in the database instead of the
+// session store the Authenticator was configured with, so that they survive
+// restarts and can be shared between multiple instances.
+func WithPersistentSessions() ServiceOpt {
 	return func(s *Service) {
-		s.mail = mail
+		s.persistSessions = true
 	}
 }
 
-func (s *Service) TestUser(email string, sessionID string) (*Session, error) {
-	if !isdelve.Enabled {
-		return nil, errors.New("test user must only be used in debug mode")
+// WithLoginRateLimits limits how often login and signup mails may be
+// requested, per recipient, per client ip and in total.
+func WithLoginRateLimits(perEmail, perIP, global RateLimit) ServiceOpt {
+	return func(s *Service) {
+		s.limits.loginPerEmail = NewRateLimiter(perEmail)
+		s.limits.loginPerIP = NewRateLimiter(perIP)
+		s.limits.loginGlobal = NewRateLimiter(global)
 	}
-	user, err := s.repo.UserByEmail(email)
-	if err != nil {
-		return nil, err
+}
+
+// WithAuthRateLimit limits how often a client may try to redeem a login
+// token, login code or second factor.
+func WithAuthRateLimit(perIP RateLimit) ServiceOpt {
+	return func(s *Service) {
+		s.limits.authPerIP = NewRateLimiter(perIP)
 	}
-	session := s.auth.createSessionWithID(user.ID, SessionID(sessionID))
-	if err != nil {
-		return nil, err
+}
+
+// WithClientIPHeader takes the client's ip address from a header, like
+// X-Real-IP or X-Forwarded-For, when running behind a reverse proxy. Never
+// use this if clients can reach the service directly.
+func WithClientIPHeader(header string) ServiceOpt {
+	return func(s *Service) {
+		s.clientIPHeader = header
 	}
-	login, err := session.RequestLogin()
+}
+
+func WithMailer(mail Mailer) ServiceOpt {
+	return func(s *Service) {
+		s.mail = mail
+	}
+}
+
+// WithTrashRetention sets how long deleted events and registrations can be
+// restored, before PurgeTrash removes them for good. Defaults to 30 days.
+func WithTrashRetention(d time.Duration) ServiceOpt {
+	return func(s *Service) {
+		s.trashRetention = d
+	}
+}
+
+// GrantRole sets the role of the user with email, e.g. to appoint the first
+// admin.
+func (s *Service) GrantRole(ctx context.Context, email string, role Role) error {
+	user, err := s.repo.UserByEmail(ctx, email)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	ok := session.InvalidateLogin(LoginID(login.Value))
-	if !ok {
-		panic("expected login to be valid")
+	return s.repo.SetUserRole(ctx, user.ID, role)
+}
+
+// PurgeTrash removes deleted events and registrations whose retention
+// period is over.
+func (s *Service) PurgeTrash(ctx context.Context) (int64, error) {
+	return s.repo.PurgeDeleted(ctx, time.Now().Add(-s.trashRetention))
+}
+
+// RunPurger calls PurgeTrash every interval until ctx is cancelled.
+func (s *Service) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.PurgeTrash(ctx)
+			if err != nil {
+				slog.Error("failed to purge trash", "error", err)
+			} else if n > 0 {
+				slog.Info("purged trash", "count", n)
+			}
+		}
 	}
-	return session, nil
 }
 
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -108,53 +197,70 @@ func (s *Service) setupRoutes() {
 	mux.Handle("/", homeOrNotFound{})
 	mux.Handle("/home", HandlerWithError(s.routeIndex))
 	mux.Handle("/login", HandlerWithError(s.login))
-	mux.Handle("/logout", s.withSession(HandlerWithError(s.logout), false))
-	mux.Handle("/auth", s.withSession(HandlerWithError(s.authenticate), false))
-	mux.Handle("/events", s.withAuth(HandlerWithError(s.events)))
-	mux.Handle("/create", s.withAuth(HandlerWithError(s.create)))
-	mux.Handle("/event/", s.withAuth(HandlerWithError(s.event)))
-	mux.Handle("/event/register", s.withAuth(HandlerWithError(s.eventRegister)))
-	mux.Handle("/event/deregister", s.withAuth(HandlerWithError(s.eventDeregister)))
+	mux.Handle("/signup", HandlerWithError(s.signup))
+	mux.Handle("/logout", s.withSession(s.withCsrf(HandlerWithError(s.logout)), false))
+	mux.Handle("/auth", s.withAuthRateLimit(s.withCsrf(HandlerWithError(s.authenticate))))
+	mux.Handle("/auth/approve", s.withAuthRateLimit(HandlerWithError(s.approveLogin)))
+	mux.Handle("/auth/code", s.withAuthRateLimit(s.withCsrf(HandlerWithError(s.loginCode))))
+	mux.Handle("/auth/status", HandlerWithError(s.loginStatus))
+	mux.Handle("/auth/second-factor", s.withAuthRateLimit(s.withSession(s.withCsrf(HandlerWithError(s.secondFactor)), false)))
+	mux.Handle("/events", s.withTokenAuth(HandlerWithError(s.events)))
+	mux.Handle("/create", s.withTokenAuth(s.withCsrf(HandlerWithError(s.create))))
+	mux.Handle("/event/", s.withTokenAuth(HandlerWithError(s.event)))
+	mux.Handle("/event/register", s.withTokenAuth(s.withCsrf(HandlerWithError(s.eventRegister))))
+	mux.Handle("/event/deregister", s.withTokenAuth(s.withCsrf(HandlerWithError(s.eventDeregister))))
+	mux.Handle("/event/delete", s.withTokenAuth(s.withCsrf(HandlerWithError(s.eventDelete))))
+	mux.Handle("/trash", s.withAuth(HandlerWithError(s.trash)))
+	mux.Handle("/trash/restore", s.withAuth(s.withCsrf(HandlerWithError(s.trashRestore))))
+	mux.Handle("/profile", s.withAuth(HandlerWithError(s.profile)))
+	mux.Handle("/email/change", s.withAuth(s.withCsrf(HandlerWithError(s.emailChange))))
+	mux.Handle("/email/confirm", s.withAuthRateLimit(HandlerWithError(s.emailConfirm)))
+	mux.Handle("/email/undo", s.withAuthRateLimit(HandlerWithError(s.emailUndo)))
+	mux.Handle("/account/export", s.withAuth(HandlerWithError(s.accountExport)))
+	mux.Handle("/account/delete", s.withAuth(s.withCsrf(HandlerWithError(s.accountDelete))))
+	mux.Handle("/account/activity", s.withAuth(HandlerWithError(s.accountActivity)))
+	mux.Handle("/sessions", s.withAuth(HandlerWithError(s.sessions)))
+	mux.Handle("/sessions/revoke", s.withAuth(s.withCsrf(HandlerWithError(s.revokeSession))))
+	mux.Handle("/sessions/revoke-others", s.withAuth(s.withCsrf(HandlerWithError(s.revokeOtherSessions))))
+	mux.Handle("/tokens", s.withAuth(HandlerWithError(s.apiTokens)))
+	mux.Handle("/tokens/create", s.withAuth(s.withCsrf(HandlerWithError(s.apiTokenCreate))))
+	mux.Handle("/tokens/revoke", s.withAuth(s.withCsrf(HandlerWithError(s.apiTokenRevoke))))
+	mux.Handle("/admin/users", s.withAuth(HandlerWithError(s.adminUsers)))
+	mux.Handle("/admin/users/role", s.withAuth(s.withCsrf(HandlerWithError(s.adminSetRole))))
+	mux.Handle("/admin/audit", s.withAuth(s.withRole(RoleAdmin, HandlerWithError(s.adminAudit))))
+	mux.Handle("/admin/impersonate", s.withAuth(s.withCsrf(HandlerWithError(s.adminImpersonate))))
+	mux.Handle("/impersonation", HandlerWithError(s.impersonation))
+	mux.Handle("/impersonation/stop", s.withCsrf(HandlerWithError(s.impersonationStop)))
+	mux.Handle("/passkey/register/begin", s.withAuth(HandlerWithError(s.passkeyRegisterBegin)))
+	mux.Handle("/passkey/register/finish", s.withAuth(HandlerWithError(s.passkeyRegisterFinish)))
+	mux.Handle("/passkey/delete", s.withAuth(s.withCsrf(HandlerWithError(s.passkeyDelete))))
+	mux.Handle("/totp/enroll", s.withAuth(s.withCsrf(HandlerWithError(s.totpEnroll))))
+	mux.Handle("/totp/confirm", s.withAuth(s.withCsrf(HandlerWithError(s.totpConfirm))))
+	mux.Handle("/totp/disable", s.withAuth(s.withCsrf(HandlerWithError(s.totpDisable))))
+	mux.Handle("/oidc/login", HandlerWithError(s.oidcLogin))
+	mux.Handle("/oidc/callback", s.withAuthRateLimit(HandlerWithError(s.oidcCallback)))
+	mux.Handle("/passkey/login/begin", HandlerWithError(s.passkeyLoginBegin))
+	mux.Handle("/passkey/login/finish", s.withAuthRateLimit(HandlerWithError(s.passkeyLoginFinish)))
 	mux.Handle("/styles.css", styles)
 	mux.Handle("/js/htmx.js", htmxScript)
+	mux.Handle("/js/passkeys.js", passkeysScript)
 }
 
 func (s *Service) initializeDatabase() error {
-	var repo Repository
 	cfg := s.dbConn
-	switch cfg.Driver {
-	case "mysql":
-		repo = &MariaDB{}
-	default:
-		return fmt.Errorf("no backend implemented for database: %s", cfg.Driver)
-	}
-
-	db, err := sql.Open(cfg.Driver, cfg.String())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	db, repo, err := OpenDatabase(ctx, cfg)
 	if err != nil {
-		return fmt.Errorf("db dns: %w", err)
+		return err
 	}
-	db.SetConnMaxLifetime(cfg.MaxLifetime)
-	db.SetMaxOpenConns(cfg.MaxConns)
-	db.SetMaxIdleConns(cfg.MaxConns)
-
 	s.repo = repo
 
-	{
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := db.PingContext(ctx); err != nil {
-			return fmt.Errorf("db ping failed: %w", err)
-		}
-	}
-
-	if err := migrate(db); err != nil {
+	if err := migrate(db, cfg.Dialect()); err != nil {
 		return fmt.Errorf("db migrations failed to run: %w", err)
 	}
 
 	// preparations must be run after migrations, because some prepared
 	// statements might depend on tables from newer migrations.
-	if err := repo.Prepare(db); err != nil {
-		return err
-	}
-	return nil
+	return repo.Prepare(db)
 }
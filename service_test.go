@@ -0,0 +1,788 @@
+package organizer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testService runs a service on a MemoryRepository and a MemoryMailer. The
+// server uses TLS, because the session cookie is only sent over https.
+type testService struct {
+	*Service
+	repo   *MemoryRepository
+	mail   *MemoryMailer
+	server *httptest.Server
+}
+
+func newTestService(t *testing.T, opts ...ServiceOpt) *testService {
+	t.Helper()
+	server := httptest.NewUnstartedServer(nil)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	ts := &testService{
+		repo:   NewMemoryRepository(),
+		mail:   &MemoryMailer{},
+		server: server,
+	}
+	service, err := NewService(append([]ServiceOpt{
+		WithUrl(Url(server.URL + "/")),
+		WithMux(http.NewServeMux()),
+		WithRepository(ts.repo),
+		WithPersistentSessions(),
+		WithMailer(ts.mail),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	ts.Service = service
+	server.Config.Handler = service
+	return ts
+}
+
+func (ts *testService) createUser(t *testing.T, name, email string, role Role) User {
+	t.Helper()
+	ctx := context.Background()
+	user := NewUser(name, email)
+	user.Role = role
+	user, err := ts.repo.CreateUser(ctx, user)
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := ts.repo.ActivateUser(ctx, user.ID); err != nil {
+		t.Fatalf("failed to activate user: %v", err)
+	}
+	return user
+}
+
+// lastMail returns the newest mail sent to email.
+func (ts *testService) lastMail(t *testing.T, email string) SentMail {
+	t.Helper()
+	sent := ts.mail.Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To == email {
+			return sent[i]
+		}
+	}
+	t.Fatalf("no mail sent to %s", email)
+	return SentMail{}
+}
+
+// testBrowser keeps cookies like a browser, but doesn't follow redirects.
+type testBrowser struct {
+	t      *testing.T
+	client *http.Client
+	url    string
+}
+
+func (ts *testService) browser(t *testing.T) *testBrowser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A copy, the server hands out the same client every time.
+	client := *ts.server.Client()
+	client.Jar = jar
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &testBrowser{t: t, client: &client, url: ts.server.URL}
+}
+
+func (b *testBrowser) get(path string) (int, http.Header, string) {
+	b.t.Helper()
+	return b.do(http.NewRequest(http.MethodGet, b.url+path, nil))
+}
+
+func (b *testBrowser) post(path string, form url.Values) (int, http.Header, string) {
+	b.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, b.url+path, strings.NewReader(form.Encode()))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return b.do(req, err)
+}
+
+func (b *testBrowser) do(req *http.Request, err error) (int, http.Header, string) {
+	b.t.Helper()
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		b.t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	return res.StatusCode, res.Header, string(body)
+}
+
+// login goes through the whole magic link flow.
+func (b *testBrowser) login(ts *testService, email string) {
+	b.t.Helper()
+	status, _, _ := b.post("/login", url.Values{"email": {email}})
+	if status != http.StatusOK {
+		b.t.Fatalf("login: got status %d", status)
+	}
+	login := ts.lastMail(b.t, email).Data.(LoginMail)
+
+	status, _, body := b.get("/auth?token=" + url.QueryEscape(login.Link.Token))
+	if status != http.StatusOK {
+		b.t.Fatalf("open login link: got status %d", status)
+	}
+	status, hdr, _ := b.post("/auth", url.Values{
+		"token": {login.Link.Token},
+		"csrf":  {inputValue(b.t, body, "csrf")},
+	})
+	if status != http.StatusSeeOther || hdr.Get("Location") != "/" {
+		b.t.Fatalf("confirm login: got status %d, location %q", status, hdr.Get("Location"))
+	}
+}
+
+// inputValue finds the value of the first input called name in page.
+func inputValue(t *testing.T, page, name string) string {
+	t.Helper()
+	re := regexp.MustCompile(`name="` + regexp.QuoteMeta(name) + `"[^>]*value="([^"]*)"`)
+	m := re.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("no input %s in page", name)
+	}
+	return html.UnescapeString(m[1])
+}
+
+func TestLoginCreateRegisterDeregister(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleOrganizer)
+	b := ts.browser(t)
+
+	b.login(ts, "alice@example.com")
+	if mail := ts.lastMail(t, "alice@example.com"); mail.Kind != "LoginLink" {
+		t.Errorf("got %s mail, want LoginLink", mail.Kind)
+	}
+
+	status, _, page := b.get("/create")
+	if status != http.StatusOK {
+		t.Fatalf("create form: got status %d", status)
+	}
+	status, hdr, _ := b.post("/create", url.Values{
+		"csrf":         {inputValue(t, page, "csrf")},
+		"title":        {"Boardgames"},
+		"description":  {"Every Friday"},
+		"repeats":      {"on"},
+		"every":        {"1"},
+		"scale":        {"weekly"},
+		"max_part":     {"on"},
+		"max_part_num": {"6"},
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("create: got status %d", status)
+	}
+	var eventID EventID
+	if _, err := fmt.Sscanf(hdr.Get("Location"), "/event?id=%d", &eventID); err != nil {
+		t.Fatalf("create: unexpected location %q", hdr.Get("Location"))
+	}
+	event, err := ts.repo.Event(ctx, eventID)
+	if err != nil {
+		t.Fatalf("created event not found: %v", err)
+	}
+	if event.Title != "Boardgames" || event.RepeatsScale != RepeatsWeekly || event.MaxParticipants.Int64 != 6 {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	status, _, page = b.get(fmt.Sprintf("/event/?id=%d", eventID))
+	if status != http.StatusOK {
+		t.Fatalf("event page: got status %d", status)
+	}
+	if !strings.Contains(page, "Anzahl Teilnehmer: 0") {
+		t.Errorf("event page doesn't show 0 participants")
+	}
+
+	status, _, page = b.post("/event/register", url.Values{
+		"csrf":    {inputValue(t, page, "csrf")},
+		"event":   {fmt.Sprint(eventID)},
+		"message": {"Ich mache mit!"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("register: got status %d", status)
+	}
+	if event, _ := ts.repo.Event(ctx, eventID); event.NumberOfParticipants != 1 {
+		t.Errorf("got %d participants after registering, want 1", event.NumberOfParticipants)
+	}
+
+	status, _, _ = b.post("/event/deregister", url.Values{
+		"csrf":            {inputValue(t, page, "csrf")},
+		"subscription_id": {inputValue(t, page, "subscription_id")},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("deregister: got status %d", status)
+	}
+	if event, _ := ts.repo.Event(ctx, eventID); event.NumberOfParticipants != 0 {
+		t.Errorf("got %d participants after deregistering, want 0", event.NumberOfParticipants)
+	}
+}
+
+func TestLoginLinkIsSingleUse(t *testing.T) {
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+
+	token := ts.lastMail(t, "alice@example.com").Data.(LoginMail).Link.Token
+	status, _, _ := ts.browser(t).get("/auth?token=" + url.QueryEscape(token))
+	if status != http.StatusUnauthorized {
+		t.Errorf("reusing login link: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestUnknownEmailGetsSignupLink(t *testing.T) {
+	ts := newTestService(t)
+	b := ts.browser(t)
+
+	status, _, _ := b.post("/login", url.Values{"email": {"nobody@example.com"}})
+	if status != http.StatusOK {
+		t.Fatalf("login: got status %d", status)
+	}
+	if mail := ts.lastMail(t, "nobody@example.com"); mail.Kind != "SignupLink" {
+		t.Errorf("got %s mail, want SignupLink", mail.Kind)
+	}
+}
+
+func TestSignup(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	b := ts.browser(t)
+
+	status, _, _ := b.post("/signup", url.Values{"name": {"Bob"}, "email": {"Bob <bob@example.com>"}})
+	if status != http.StatusBadRequest {
+		t.Errorf("signup with display name: got status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	// Fits in 30 characters, but not in 30 bytes.
+	name := "Jürgen Lüdenscheid-Größenbühl"
+	status, _, _ = b.post("/signup", url.Values{"name": {name}, "email": {"juergen@example.com"}})
+	if status != http.StatusOK {
+		t.Fatalf("signup: got status %d", status)
+	}
+	user, err := ts.repo.UserByEmail(ctx, "juergen@example.com")
+	if err != nil {
+		t.Fatalf("signed up user not found: %v", err)
+	}
+	if user.Name != name {
+		t.Errorf("got name %q, want %q", user.Name, name)
+	}
+	if mail := ts.lastMail(t, "juergen@example.com"); mail.Kind != "VerificationLink" {
+		t.Errorf("got %s mail, want VerificationLink", mail.Kind)
+	}
+}
+
+func TestEventRoutesRequireLogin(t *testing.T) {
+	ts := newTestService(t)
+	b := ts.browser(t)
+
+	for _, path := range []string{"/create", "/events"} {
+		status, _, _ := b.get(path)
+		if status == http.StatusOK {
+			t.Errorf("GET %s without session: got status %d", path, status)
+		}
+	}
+}
+
+func TestCreateNeedsCsrfToken(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleOrganizer)
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+
+	status, _, _ := b.post("/create", url.Values{"title": {"Boardgames"}})
+	if status != http.StatusBadRequest {
+		t.Errorf("create without csrf: got status %d, want %d", status, http.StatusBadRequest)
+	}
+	status, _, _ = b.post("/create", url.Values{"title": {"Boardgames"}, "csrf": {"forged"}})
+	if status != http.StatusUnauthorized {
+		t.Errorf("create with forged csrf: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if events, _ := ts.repo.Events(ctx, EventQuery{}); len(events) != 0 {
+		t.Errorf("got %d events, want none", len(events))
+	}
+}
+
+func TestCannotDeregisterOthers(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	alice := ts.createUser(t, "alice", "alice@example.com", RoleOrganizer)
+	ts.createUser(t, "bob", "bob@example.com", RoleUser)
+	event, err := ts.repo.CreateEvent(ctx, NewEvent(alice.ID, "Boardgames", "", 0, RepeatsNever, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := ts.repo.RegisterEvent(ctx, NewEventRegistration(alice.ID, event.ID, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := ts.browser(t)
+	b.login(ts, "bob@example.com")
+	_, _, page := b.get(fmt.Sprintf("/event/?id=%d", event.ID))
+	status, _, _ := b.post("/event/deregister", url.Values{
+		"csrf":            {inputValue(t, page, "csrf")},
+		"subscription_id": {fmt.Sprint(reg.ID)},
+	})
+	if status != http.StatusNotFound {
+		t.Errorf("deregister someone else: got status %d, want %d", status, http.StatusNotFound)
+	}
+	if event, _ := ts.repo.Event(ctx, event.ID); event.NumberOfParticipants != 1 {
+		t.Errorf("got %d participants, want 1", event.NumberOfParticipants)
+	}
+}
+
+func TestTimeoutResponses(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want int
+	}{
+		{Maybe404(fmt.Errorf("load event: %w", context.DeadlineExceeded)), http.StatusGatewayTimeout},
+		{context.Canceled, http.StatusServiceUnavailable},
+		{Maybe404(sql.ErrNoRows), http.StatusNotFound},
+	} {
+		h := HandlerWithError(func(http.ResponseWriter, *http.Request) error {
+			return test.err
+		})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/event/?id=1", nil))
+		if w.Code != test.want {
+			t.Errorf("%v: got status %d, want %d", test.err, w.Code, test.want)
+		}
+	}
+}
+
+func TestDeleteAndRestoreEvent(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	alice := ts.createUser(t, "alice", "alice@example.com", RoleOrganizer)
+	ts.createUser(t, "bob", "bob@example.com", RoleUser)
+	event, err := ts.repo.CreateEvent(ctx, NewEvent(alice.ID, "Boardgames", "", 0, RepeatsNever, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob := ts.browser(t)
+	bob.login(ts, "bob@example.com")
+	_, _, page := bob.get(fmt.Sprintf("/event/?id=%d", event.ID))
+	if strings.Contains(page, "Event löschen") {
+		t.Errorf("bob is offered to delete alice's event")
+	}
+	status, _, _ := bob.post("/event/delete", url.Values{
+		"csrf": {inputValue(t, page, "csrf")},
+		"id":   {fmt.Sprint(event.ID)},
+	})
+	if status != http.StatusForbidden {
+		t.Errorf("bob deletes alice's event: got status %d, want %d", status, http.StatusForbidden)
+	}
+
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+	_, _, page = b.get(fmt.Sprintf("/event/?id=%d", event.ID))
+	status, hdr, _ := b.post("/event/delete", url.Values{
+		"csrf": {inputValue(t, page, "csrf")},
+		"id":   {fmt.Sprint(event.ID)},
+	})
+	if status != http.StatusSeeOther || hdr.Get("Location") != "/trash" {
+		t.Fatalf("delete: got status %d, location %q", status, hdr.Get("Location"))
+	}
+	if status, _, _ := b.get(fmt.Sprintf("/event/?id=%d", event.ID)); status != http.StatusNotFound {
+		t.Errorf("deleted event page: got status %d, want %d", status, http.StatusNotFound)
+	}
+
+	status, _, page = b.get("/trash")
+	if status != http.StatusOK || !strings.Contains(page, "Boardgames") {
+		t.Fatalf("trash: got status %d, event listed: %t", status, strings.Contains(page, "Boardgames"))
+	}
+	status, _, _ = b.post("/trash/restore", url.Values{
+		"csrf":  {inputValue(t, page, "csrf")},
+		"event": {fmt.Sprint(event.ID)},
+	})
+	if status != http.StatusSeeOther {
+		t.Fatalf("restore: got status %d", status)
+	}
+	if _, err := ts.repo.Event(ctx, event.ID); err != nil {
+		t.Errorf("restored event: %v", err)
+	}
+}
+
+func TestEventListing(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	alice := ts.createUser(t, "alice", "alice@example.com", RoleOrganizer)
+	for i := range eventPageSize + 1 {
+		title := fmt.Sprintf("Event %02d", i)
+		if _, err := ts.repo.CreateEvent(ctx, NewEvent(alice.ID, title, "", 0, RepeatsNever, 0, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ts.repo.CreateEvent(ctx, NewEvent(alice.ID, "Boardgames", "", 0, RepeatsNever, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+	_, _, page := b.get("/events?q=board")
+	if !strings.Contains(page, "Boardgames") || strings.Contains(page, "Event 00") || strings.Contains(page, "Mehr laden") {
+		t.Errorf("search lists the wrong events")
+	}
+
+	_, _, page = b.get("/events?sort=newest")
+	if !strings.Contains(page, "Boardgames") || strings.Contains(page, "Event 01") {
+		t.Errorf("first page lists the wrong events")
+	}
+	m := regexp.MustCompile(`id="more-events"><a href="([^"]*)"`).FindStringSubmatch(page)
+	if m == nil {
+		t.Fatal("no link to load more events")
+	}
+	req, err := http.NewRequest(http.MethodGet, b.url+html.UnescapeString(m[1]), nil)
+	if err == nil {
+		req.Header.Set("HX-Request", "true")
+	}
+	status, _, page := b.do(req, err)
+	if status != http.StatusOK {
+		t.Fatalf("more events: got status %d", status)
+	}
+	if strings.Contains(page, "<html") {
+		t.Errorf("more events: got a whole page instead of a fragment")
+	}
+	if !strings.Contains(page, "Event 00") || !strings.Contains(page, "Event 01") || strings.Contains(page, "Event 02") || strings.Contains(page, "Mehr laden") {
+		t.Errorf("more events lists the wrong events")
+	}
+
+	if status, _, _ := b.get("/events?sort=random"); status != http.StatusBadRequest {
+		t.Errorf("unknown sort: got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestDisabledUserIsLockedOut(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	alice := ts.createUser(t, "alice", "alice@example.com", RoleOrganizer)
+	token, hash, err := NewApiToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.repo.CreateApiToken(ctx, ApiToken{User: alice.ID, Name: "script", Hash: hash, Scope: ScopeRead}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.repo.SetUserDisabled(ctx, alice.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	b := ts.browser(t)
+	b.post("/login", url.Values{"email": {"alice@example.com"}})
+	login := ts.lastMail(t, "alice@example.com").Data.(LoginMail)
+	_, _, body := b.get("/auth?token=" + url.QueryEscape(login.Link.Token))
+	status, _, _ := b.post("/auth", url.Values{
+		"token": {login.Link.Token},
+		"csrf":  {inputValue(t, body, "csrf")},
+	})
+	if status != http.StatusForbidden {
+		t.Errorf("login: got status %d, want 403", status)
+	}
+	if status, _, _ := b.get("/events"); status == http.StatusOK {
+		t.Error("disabled user got logged in")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.server.URL+"/events", nil)
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if status, _, _ := ts.browser(t).do(req, err); status != http.StatusForbidden {
+		t.Errorf("api token: got status %d, want 403", status)
+	}
+
+	if err := ts.repo.SetUserDisabled(ctx, alice.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	ts.browser(t).login(ts, "alice@example.com")
+}
+
+func TestTotpEnrollPage(t *testing.T) {
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+
+	_, _, profile := b.get("/profile")
+	status, _, page := b.post("/totp/enroll", url.Values{"csrf": {inputValue(t, profile, "csrf")}})
+	if status != http.StatusOK {
+		t.Fatalf("enroll: got status %d", status)
+	}
+	if !strings.Contains(page, `href="otpauth://totp/`) || strings.Contains(page, "ZgotmplZ") {
+		t.Error("provisioning link is not rendered")
+	}
+	if !strings.Contains(page, "<svg") || strings.Contains(page, "&lt;svg") {
+		t.Error("qr code is not rendered")
+	}
+}
+
+func TestApiTokenName(t *testing.T) {
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+	_, _, page := b.get("/tokens")
+	csrf := inputValue(t, page, "csrf")
+
+	for _, test := range []struct {
+		name string
+		want int
+	}{
+		{name: strings.Repeat("ü", 64), want: http.StatusOK},
+		{name: strings.Repeat("ü", 65), want: http.StatusBadRequest},
+	} {
+		form := url.Values{"csrf": {csrf}, "name": {test.name}, "scope": {"read"}}
+		if status, _, _ := b.post("/tokens/create", form); status != test.want {
+			t.Errorf("%d characters: got status %d, want %d", len([]rune(test.name)), status, test.want)
+		}
+	}
+}
+
+func TestLoginCodeKeepsSecondFactor(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	alice := ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	secret, err := NewTotpSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.repo.SaveTotpSecret(ctx, TotpSecret{User: alice.ID, Secret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.repo.ConfirmTotpSecret(ctx, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	b := ts.browser(t)
+	_, _, page := b.post("/login", url.Values{"email": {"alice@example.com"}})
+	csrf := inputValue(t, page, "csrf")
+	loginCode := func(code string) (int, http.Header) {
+		status, hdr, _ := b.post("/auth/code", url.Values{"code": {code}, "csrf": {csrf}})
+		return status, hdr
+	}
+	secondFactor := func(code string) int {
+		_, _, page := b.get("/auth/second-factor")
+		status, _, _ := b.post("/auth/second-factor", url.Values{"code": {code}, "csrf": {inputValue(t, page, "csrf")}})
+		return status
+	}
+
+	if _, hdr := loginCode(ts.lastMail(t, "alice@example.com").Data.(LoginMail).Code); hdr.Get("HX-Redirect") != "/" {
+		t.Fatal("right login code was not accepted")
+	}
+	for range 4 {
+		if status := secondFactor("wrong"); status != http.StatusOK {
+			t.Fatalf("wrong second factor: got status %d", status)
+		}
+	}
+	// Guessing login codes must not buy more second factor attempts.
+	loginCode("000000")
+	if status := secondFactor("wrong"); status != http.StatusUnauthorized {
+		t.Errorf("last attempt: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	b = ts.browser(t)
+	_, _, page = b.post("/login", url.Values{"email": {"alice@example.com"}})
+	csrf = inputValue(t, page, "csrf")
+	loginCode(ts.lastMail(t, "alice@example.com").Data.(LoginMail).Code)
+	if status := secondFactor(totpCode(secret, totpStep(time.Now()))); status != http.StatusSeeOther {
+		t.Fatalf("right second factor: got status %d", status)
+	}
+	// Nor must they send a logged in session back to the second factor.
+	loginCode("000000")
+	if status, _, _ := b.get("/events"); status != http.StatusOK {
+		t.Errorf("events after guessing a login code: got status %d", status)
+	}
+}
+
+func TestLogoutNeedsCsrfToken(t *testing.T) {
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+
+	logout := func(token string) int {
+		req, err := http.NewRequest(http.MethodPost, b.url+"/logout", nil)
+		if err == nil && token != "" {
+			req.Header.Set("X-Csrf-Token", token)
+		}
+		status, _, _ := b.do(req, err)
+		return status
+	}
+	if status := logout(""); status != http.StatusBadRequest {
+		t.Errorf("logout without csrf: got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := logout("forged"); status != http.StatusUnauthorized {
+		t.Errorf("logout with forged csrf: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _, _ := b.get("/events"); status != http.StatusOK {
+		t.Fatalf("still logged in: got status %d", status)
+	}
+
+	// The logout link in the title bar sends the token along.
+	_, _, page := b.get("/events")
+	m := regexp.MustCompile(`hx-post="/logout" hx-headers='\{"X-Csrf-Token": "([^"]+)"\}'`).FindStringSubmatch(page)
+	if m == nil {
+		t.Fatal("no logout link with csrf token in page")
+	}
+	if status := logout(html.UnescapeString(m[1])); status != http.StatusOK {
+		t.Errorf("logout: got status %d", status)
+	}
+	if status, _, _ := b.get("/events"); status == http.StatusOK {
+		t.Error("still logged in after logout")
+	}
+}
+
+func TestManageUsersNeedsPermission(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleAdmin)
+	bob := ts.createUser(t, "bob", "bob@example.com", RoleOrganizer)
+
+	b := ts.browser(t)
+	b.login(ts, "bob@example.com")
+	_, _, page := b.get("/create")
+	csrf := inputValue(t, page, "csrf")
+	if status, _, _ := b.get("/admin/users"); status != http.StatusForbidden {
+		t.Errorf("list users: got status %d, want %d", status, http.StatusForbidden)
+	}
+	form := url.Values{"csrf": {csrf}, "id": {fmt.Sprint(bob.ID)}, "role": {string(RoleAdmin)}}
+	if status, _, _ := b.post("/admin/users/role", form); status != http.StatusForbidden {
+		t.Errorf("set role: got status %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _, _ := b.post("/admin/impersonate", form); status != http.StatusForbidden {
+		t.Errorf("impersonate: got status %d, want %d", status, http.StatusForbidden)
+	}
+	if user, _ := ts.repo.User(ctx, bob.ID); user.Role != RoleOrganizer {
+		t.Errorf("got role %s, want %s", user.Role, RoleOrganizer)
+	}
+
+	b = ts.browser(t)
+	b.login(ts, "alice@example.com")
+	if status, _, _ := b.get("/admin/users"); status != http.StatusOK {
+		t.Errorf("admin lists users: got status %d", status)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleAdmin)
+	bob := ts.createUser(t, "bob", "bob@example.com", RoleUser)
+
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+	site, err := url.Parse(ts.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionCookie := func() string {
+		for _, c := range b.client.Jar.Cookies(site) {
+			if c.Name == "session" {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	own := sessionCookie()
+
+	_, _, page := b.get("/admin/users")
+	form := url.Values{"csrf": {inputValue(t, page, "csrf")}, "id": {fmt.Sprint(bob.ID)}}
+	if status, _, _ := b.post("/admin/impersonate", form); status != http.StatusSeeOther {
+		t.Fatalf("impersonate: got status %d", status)
+	}
+	if sessionCookie() == own {
+		t.Fatal("still in the admin's session")
+	}
+	if status, _, _ := b.get("/admin/users"); status != http.StatusForbidden {
+		t.Errorf("list users as bob: got status %d, want %d", status, http.StatusForbidden)
+	}
+
+	_, _, banner := b.get("/impersonation")
+	status, hdr, _ := b.post("/impersonation/stop", url.Values{"csrf": {inputValue(t, banner, "csrf")}})
+	if status != http.StatusSeeOther || hdr.Get("Location") != "/admin/users" {
+		t.Fatalf("stop: got status %d, location %q", status, hdr.Get("Location"))
+	}
+	if sessionCookie() != own {
+		t.Error("admin's session was not restored")
+	}
+	if status, _, _ := b.get("/admin/users"); status != http.StatusOK {
+		t.Errorf("list users as admin: got status %d", status)
+	}
+}
+
+// timeoutStore is a session store whose database doesn't answer in time
+// when a login is redeemed, or when sessions are loaded if lookups is set.
+type timeoutStore struct {
+	SessionStore
+	lookups bool
+}
+
+func (s *timeoutStore) Session(ctx context.Context, hash TokenHash) (Session, error) {
+	if s.lookups {
+		return Session{}, context.DeadlineExceeded
+	}
+	return s.SessionStore.Session(ctx, hash)
+}
+
+func (s *timeoutStore) SessionByLogin(ctx context.Context, login TokenHash) (Session, error) {
+	if s.lookups {
+		return Session{}, context.DeadlineExceeded
+	}
+	return s.SessionStore.SessionByLogin(ctx, login)
+}
+
+func (s *timeoutStore) ConsumeLogin(ctx context.Context, session Session, login TokenHash) (bool, error) {
+	return false, context.DeadlineExceeded
+}
+
+func TestSessionStoreTimeouts(t *testing.T) {
+	ts := newTestService(t)
+	ts.createUser(t, "alice", "alice@example.com", RoleUser)
+	b := ts.browser(t)
+	b.login(ts, "alice@example.com")
+	_, _, page := b.post("/login", url.Values{"email": {"alice@example.com"}})
+	csrf := inputValue(t, page, "csrf")
+	login := ts.lastMail(t, "alice@example.com").Data.(LoginMail)
+
+	store := &timeoutStore{SessionStore: ts.auth.store}
+	ts.auth.store = store
+	if status, _, _ := b.post("/auth/code", url.Values{"code": {login.Code}, "csrf": {csrf}}); status != http.StatusGatewayTimeout {
+		t.Errorf("redeem code: got status %d, want %d", status, http.StatusGatewayTimeout)
+	}
+	if status, _, _ := ts.browser(t).post("/auth/approve", url.Values{"token": {login.Link.Token}}); status != http.StatusGatewayTimeout {
+		t.Errorf("approve login: got status %d, want %d", status, http.StatusGatewayTimeout)
+	}
+	store.lookups = true
+	if status, _, _ := b.get("/auth?token=" + url.QueryEscape(login.Link.Token)); status != http.StatusGatewayTimeout {
+		t.Errorf("open login link: got status %d, want %d", status, http.StatusGatewayTimeout)
+	}
+	if status, _, _ := b.get("/events"); status != http.StatusGatewayTimeout {
+		t.Errorf("events: got status %d, want %d", status, http.StatusGatewayTimeout)
+	}
+
+	// Nothing was redeemed while the store was down.
+	ts.auth.store = store.SessionStore
+	if _, hdr, _ := b.post("/auth/code", url.Values{"code": {login.Code}, "csrf": {csrf}}); hdr.Get("HX-Redirect") != "/" {
+		t.Error("login code was used up")
+	}
+}
@@ -0,0 +1,111 @@
+package organizer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time-based one-time passwords as per RFC 6238, with the parameters every
+// authenticator app supports: HMAC-SHA1, 6 digits and a 30 second period.
+
+const (
+	totpDigits     = 6
+	totpPeriod     = 30
+	totpSecretSize = 20
+	// totpSkew is the number of periods a code may lag behind or be ahead,
+	// to account for clock drift and slow typing.
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewTotpSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// TotpProvisioningUri returns the otpauth:// uri that authenticator apps
+// expect to find in the QR code.
+func TotpProvisioningUri(issuer, account string, secret []byte) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	params := url.Values{}
+	params.Set("secret", totpEncoding.EncodeToString(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+func TotpSecretString(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1_000_000)
+}
+
+// ValidateTotp checks code against the periods around t. On success it
+// returns the matching time step, which must be stored and passed as
+// lastStep on the next call, so that every code can only be used once.
+func ValidateTotp(secret []byte, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := totpStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes creates single-use codes that can stand in for a TOTP
+// code if the authenticator is lost. Only their hashes must be stored.
+func NewRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		bs := make([]byte, 5)
+		if _, err := rand.Read(bs); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(bs))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.TrimSpace(code))
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}